@@ -0,0 +1,231 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+)
+
+// Action Type function that takes the context of the event and a pointer to Event as arguments
+// `E` the event type
+// `PE` is deducted (Pointer to E)
+// `ctx` the context of the event (see DispatchEventContext)
+// `event` the event that triggered this action
+type ActionCtx[E any, PE EventCst[E]] func(ctx context.Context, event PE)
+
+// Custom reaction function type receiving the context of the event
+type ReactionCtx[E any, PE EventCst[E]] func(ctx context.Context, event PE) ReactionResult
+
+// the state enter action receiving the context of the event (see StateSetupProxy.SetEntryActionCtx)
+type EntryActionCtx func(ctx context.Context)
+
+// the state exit action receiving the context of the event (see StateSetupProxy.SetExitActionCtx)
+type ExitActionCtx func(ctx context.Context)
+
+// Implemented by StateProxy, and by the instances for the actions they run
+type contextProvider interface {
+	Context() context.Context
+}
+
+// A function that convert an ActionCtx to a BaseAction.
+// `proxy` the proxy providing the context of the event, for a state of a Definition the proxy
+// bound to the instance (see StateProxy.Bind)
+// `action` the concrete action
+// returns the abstract action
+func ToBaseActionCtx[E any, PE EventCst[E]](proxy contextProvider, action ActionCtx[E, PE]) BaseAction {
+	if action == nil {
+		return nil
+	}
+	return func(e Event) {
+		action(proxy.Context(), e.(PE))
+	}
+}
+
+// Returns the context of the event being processed, context.Background for the states of a
+// Definition (see StateProxy.Bind)
+func (s *stateImpl[C]) Context() context.Context {
+	if sm := s.definition.owner; sm != nil && sm.eventContext != nil {
+		return sm.eventContext
+	}
+	return context.Background()
+}
+
+func (s *stateImpl[C]) SetEntryActionCtx(action EntryActionCtx) {
+	s.enterAction = func(instance contextProvider) error {
+		action(instance.Context())
+		return nil
+	}
+}
+
+func (s *stateImpl[C]) SetExitActionCtx(action ExitActionCtx) {
+	s.exitAction = func(instance contextProvider) error {
+		action(instance.Context())
+		return nil
+	}
+}
+
+// the key of the instance bound to the context of the actions
+type instanceKey struct{}
+
+// Returns the context given to the actions: the context of the event being processed. For an
+// instance of a Definition, the context is bound to the instance (see StateProxy.Bind).
+func (sm *stateMachineImpl[C]) Context() context.Context {
+	ctx := sm.eventContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if sm.owner == sm {
+		// the proxies of a state machine made by MakeStateMachine know the instance
+		return ctx
+	}
+	if sm.boundContext == nil {
+		sm.boundContext = context.WithValue(ctx, instanceKey{}, sm)
+	}
+	return sm.boundContext
+}
+
+// Returns the instance of `d` bound to `ctx`, nil if there is none
+func boundInstance[C any](ctx context.Context, d *definitionImpl[C]) *stateMachineImpl[C] {
+	if sm, ok := ctx.Value(instanceKey{}).(*stateMachineImpl[C]); ok && sm.definitionImpl == d {
+		return sm
+	}
+	return nil
+}
+
+func (s *stateImpl[C]) Bind(ctx context.Context) StateProxy[C] {
+	if sm := boundInstance(ctx, s.definition); sm != nil {
+		return sm.proxy(s)
+	}
+	return s
+}
+
+// Returns the proxy of `state` bound to the instance
+func (sm *stateMachineImpl[C]) proxy(state *stateImpl[C]) *instanceProxy[C] {
+	if sm.proxies == nil {
+		sm.proxies = make([]instanceProxy[C], len(sm.states))
+		for i, s := range sm.states {
+			sm.proxies[i] = instanceProxy[C]{s, sm}
+		}
+	}
+	return &sm.proxies[state.id]
+}
+
+// The proxy of a state of a Definition bound to one of its instances, see StateProxy.Bind
+type instanceProxy[C any] struct {
+	*stateImpl[C]
+	instance *stateMachineImpl[C]
+}
+
+func (p *instanceProxy[C]) GetContext() *C {
+	return p.instance.userContext
+}
+
+func (p *instanceProxy[C]) PostEvent(event Event) {
+	p.postEvent(p.instance, event)
+}
+
+func (p *instanceProxy[C]) DeferredEvents() []Event {
+	return p.instance.deferredEvents.slice()
+}
+
+func (p *instanceProxy[C]) EventMetadata() EventMetadata {
+	return p.instance.currentMetadata
+}
+
+func (p *instanceProxy[C]) Context() context.Context {
+	return p.instance.Context()
+}
+
+func (p *instanceProxy[C]) IsReplaying() bool {
+	return p.instance.replaying
+}
+
+func (p *instanceProxy[C]) Bind(ctx context.Context) StateProxy[C] {
+	return p
+}
+
+// Returns the function running an ActionCtx, nil if `action` is nil
+func toActionCtx[E any, PE EventCst[E]](action ActionCtx[E, PE]) func(context.Context, Event) {
+	if action == nil {
+		return nil
+	}
+	return func(ctx context.Context, e Event) {
+		action(ctx, e.(PE))
+	}
+}
+
+// Create a transition result with an action receiving the context (only needed for custom reactions)
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `action` is the action associated with the transition
+// `kind` is the transition kind (EXTERNAL by default)
+func TransitWithActionCtx[S any, C any, E any, PS StateCst[S, C], PE EventCst[E]](from StateProxy[C], action ActionCtx[E, PE], kind ...TransitionKind) ReactionResult {
+	toId := FindStateId[S, C, PS](from)
+	result := from.Transit(toId, nil, kind...)
+	result.actionCtx = toActionCtx(action)
+	return result
+}
+
+// Add a simple state transition with an action receiving the context of the event
+// `E` is the event type
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `action` is the action associated with the transition (optional)
+// `kind` is the transition kind (EXTERNAL by default)
+func AddSimpleStateTransitionCtx[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], action ActionCtx[E, PE], kind ...TransitionKind) {
+	toId := FindStateId[S, C, PS](from)
+	actionCtx := toActionCtx(action)
+	transitionKind := transitionKindOf(kind)
+	// the slice is made once, so the reaction doesn't allocate
+	kinds := []TransitionKind{transitionKind}
+	reaction := func(e PE) ReactionResult {
+		result := from.Transit(toId, nil, kinds...)
+		result.actionCtx = actionCtx
+		return result
+	}
+	actionDocText := ""
+	if action != nil {
+		actionDocText = "WithAction"
+	}
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{TRANSIT, toId, actionDocText, ""})
+	eventReaction.unbound = false
+	eventReaction.local = transitionKind == LOCAL
+	from.AddReaction(eventReaction)
+}
+
+// Add a custom reaction receiving the context of the event
+// `E` is the event type
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `from` is the proxy of the current state
+// `reaction` is the custom reaction function
+func AddCustomStateReactionCtx[E any, C any, PE EventCst[E]](from StateSetupProxy[C], reaction ReactionCtx[E, PE]) {
+	eventReaction := MakeEventReaction[E, PE](nil, UmlDocReaction{DISCARD, INVALID_STATE_ID, "Custom(TODO)", ""})
+	if reaction != nil {
+		eventReaction.reaction = func(instance contextProvider, e Event) ReactionResult {
+			return reaction(instance.Context(), e.(PE))
+		}
+	}
+	from.AddReaction(eventReaction)
+}
+
+// Add an in-state reaction with an action receiving the context of the event
+// `E` is the event type
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `state` is the proxy of the current state
+// `action` is the action function
+func AddInStateReactionCtx[E any, C any, PE EventCst[E]](state StateSetupProxy[C], action ActionCtx[E, PE]) {
+	eventReaction := MakeEventReaction[E, PE](nil, UmlDocReaction{DISCARD, INVALID_STATE_ID, "WithAction", ""})
+	eventReaction.reaction = func(instance contextProvider, e Event) ReactionResult {
+		action(instance.Context(), e.(PE))
+		return ReactionResult{status: DISCARD}
+	}
+	state.AddReaction(eventReaction)
+}
@@ -0,0 +1,108 @@
+package statechart
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type requestIdKey struct{}
+
+type RequestContext struct {
+	log []string
+}
+
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+type SubmitEvent struct {
+	EventDefault
+}
+
+type AuditEvent struct {
+	EventDefault
+}
+
+type Draft struct {
+	StateDefault[RequestContext]
+}
+
+func (s *Draft) Setup(proxy StateSetupProxy[RequestContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransitionCtx[SubmitEvent, Submitted](proxy, func(ctx context.Context, e *SubmitEvent) {
+		s.GetContext().log = append(s.GetContext().log, "action "+requestId(ctx))
+	})
+	proxy.SetExitActionCtx(func(ctx context.Context) {
+		s.GetContext().log = append(s.GetContext().log, "exit "+requestId(ctx))
+	})
+	return nil, nil
+}
+
+type Submitted struct {
+	StateDefault[RequestContext]
+}
+
+func (s *Submitted) Setup(proxy StateSetupProxy[RequestContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.SetEntryActionCtx(func(ctx context.Context) {
+		s.GetContext().log = append(s.GetContext().log, "entry "+requestId(ctx))
+		proxy.PostEvent(&AuditEvent{})
+	})
+	AddCustomStateReaction(proxy, func(e *AuditEvent) ReactionResult {
+		s.GetContext().log = append(s.GetContext().log, "posted "+requestId(proxy.Context()))
+		return proxy.Discard()
+	})
+	return nil, nil
+}
+
+func makeRequestStateMachine(ctx *RequestContext, options ...Option) *StateMachine[RequestContext] {
+	sm := MakeStateMachine(ctx, options...)
+	draftId := sm.AddState(&Draft{})
+	sm.AddState(&Submitted{})
+	sm.Initialize(draftId)
+	return &sm
+}
+
+func TestDispatchEventContext(t *testing.T) {
+	ctx := RequestContext{}
+	sm := makeRequestStateMachine(&ctx)
+	requestCtx := context.WithValue(context.Background(), requestIdKey{}, "req-1")
+	sm.DispatchEventContext(requestCtx, &SubmitEvent{})
+	assert.Equal(t, []string{"exit req-1", "action req-1", "entry req-1", "posted req-1"}, ctx.log)
+	// outside of a run-to-completion step
+	assert.Equal(t, context.Background(), sm.impl.states[0].Context())
+}
+
+func TestDispatchEventWithoutContext(t *testing.T) {
+	ctx := RequestContext{}
+	sm := makeRequestStateMachine(&ctx)
+	sm.DispatchEvent(&SubmitEvent{})
+	assert.Equal(t, []string{"exit ", "action ", "entry ", "posted "}, ctx.log)
+}
+
+func TestDispatchEventContextCanceled(t *testing.T) {
+	ctx := RequestContext{}
+	observer := DeadLetterObserver{}
+	sm := makeRequestStateMachine(&ctx, WithObserver(&observer))
+	requestCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	event := &SubmitEvent{}
+	sm.DispatchEventContext(requestCtx, event)
+	assert.Empty(t, ctx.log)
+	assert.Equal(t, []DroppedEvent{{event, DROP_CONTEXT_DONE}}, observer.dropped)
+	assert.Equal(t, "ContextDone", DROP_CONTEXT_DONE.String())
+}
+
+func TestAsyncDispatchEventContext(t *testing.T) {
+	ctx := RequestContext{}
+	sm := MakeAsyncStateMachine(&ctx)
+	draftId := sm.AddState(&Draft{})
+	sm.AddState(&Submitted{})
+	sm.Initialize(draftId)
+	sm.DispatchEventContext(context.WithValue(context.Background(), requestIdKey{}, "req-2"), &SubmitEvent{})
+	sm.Close()
+	assert.Equal(t, []string{"exit req-2", "action req-2", "entry req-2", "posted req-2"}, ctx.log)
+}
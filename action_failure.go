@@ -0,0 +1,302 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// The state enter action that can fail (see StateSetupProxy.SetFallibleEntryAction)
+type FallibleEntryAction func() error
+
+// The state exit action that can fail (see StateSetupProxy.SetFallibleExitAction)
+type FallibleExitAction func() error
+
+// Transition action that can fail
+// `E` the event type
+// `PE` is deducted (Pointer to E)
+// `event` the event that triggered this action
+type FallibleAction[E any, PE EventCst[E]] func(event PE) error
+
+// the abstract transition action that can fail
+// `event` the event that triggered this action
+type FallibleBaseAction func(event Event) error
+
+// A function that convert a FallibleAction to a FallibleBaseAction
+// `action` the concrete action
+// returns the abstract action
+func ToFallibleBaseAction[E any, PE EventCst[E]](action FallibleAction[E, PE]) FallibleBaseAction {
+	if action == nil {
+		return nil
+	}
+	return func(e Event) error {
+		return action(e.(PE))
+	}
+}
+
+// Create a transition result with an action that can fail (only needed for custom reactions)
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `action` is the action associated with the transition
+// `kind` is the transition kind (EXTERNAL by default)
+func TransitWithFallibleAction[S any, C any, E any, PS StateCst[S, C], PE EventCst[E]](from StateProxy[C], action FallibleAction[E, PE], kind ...TransitionKind) ReactionResult {
+	result := Transit[S, C, PS](from, kind...)
+	result.fallibleAction = ToFallibleBaseAction(action)
+	return result
+}
+
+// Add a simple state transition with an action that can fail
+// `E` is the event type
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `action` is the action associated with the transition
+// `kind` is the transition kind (EXTERNAL by default)
+func AddFallibleStateTransition[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], action FallibleAction[E, PE], kind ...TransitionKind) {
+	toId := FindStateId[S, C, PS](from)
+	baseAction := ToFallibleBaseAction(action)
+	transitionKind := transitionKindOf(kind)
+	kinds := []TransitionKind{transitionKind}
+	reaction := func(e PE) ReactionResult {
+		result := from.Transit(toId, nil, kinds...)
+		result.fallibleAction = baseAction
+		return result
+	}
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{TRANSIT, toId, "WithAction", ""})
+	eventReaction.local = transitionKind == LOCAL
+	from.AddReaction(eventReaction)
+}
+
+// The action of a transition step
+type ActionPhase int16
+
+const (
+	// the exit action of a state
+	EXIT_ACTION ActionPhase = iota
+	// the transition action
+	TRANSITION_ACTION
+	// the entry action of a state
+	ENTRY_ACTION
+)
+
+func (p ActionPhase) String() string {
+	switch p {
+	case EXIT_ACTION:
+		return "Exit"
+	case TRANSITION_ACTION:
+		return "Transition"
+	case ENTRY_ACTION:
+		return "Entry"
+	}
+	return "Unknown"
+}
+
+// What the state machine does when an action fails
+type ActionFailurePolicy int16
+
+const (
+	// Runs the rest of the transition
+	CONTINUE_ON_FAILURE ActionFailurePolicy = iota
+	// Stops the transition and transits to the error state (see SetErrorState)
+	ABORT_TO_ERROR_STATE
+	// Stops the transition and the state machine, the next events are dropped
+	STOP_ON_FAILURE
+)
+
+func (p ActionFailurePolicy) String() string {
+	switch p {
+	case CONTINUE_ON_FAILURE:
+		return "Continue"
+	case ABORT_TO_ERROR_STATE:
+		return "AbortToErrorState"
+	case STOP_ON_FAILURE:
+		return "Stop"
+	}
+	return "Unknown"
+}
+
+// The event posted when an action returns an error (like error.execution in SCXML).
+// It is posted after the transition (or the abort to the error state), and is not posted
+// when the machine is stopped. It is also an error wrapping the action error.
+type ActionFailedEvent struct {
+	EventDefault
+	// the error returned by the action
+	Err error
+	// the failed action
+	Phase ActionPhase
+	// the state of the failed entry or exit action (INVALID_STATE_ID for a transition action)
+	State StateId
+	// the event that triggered the transition (nil for the initial transition)
+	Event Event
+	// the active state when the transition started (INVALID_STATE_ID for the initial transition)
+	From StateId
+	// the target state of the transition
+	To StateId
+	// the policy applied
+	Policy ActionFailurePolicy
+	// the names of State, From and To, for the error message
+	stateName, fromName, toName string
+}
+
+func (e *ActionFailedEvent) Error() string {
+	return fmt.Sprintf("%v action failed (state %s, transition %s -> %s, event %v): %v", e.Phase,
+		failedStateName(e.State, e.stateName), failedStateName(e.From, e.fromName), failedStateName(e.To, e.toName),
+		reflect.TypeOf(e.Event), e.Err)
+}
+
+// Returns the name of a state of an ActionFailedEvent or an InvariantViolation, its id if the
+// name is unknown
+func failedStateName(id StateId, name string) string {
+	if name != "" {
+		return name
+	}
+	if id == INVALID_STATE_ID {
+		return "none"
+	}
+	return fmt.Sprint(id)
+}
+
+func (e *ActionFailedEvent) Unwrap() error {
+	return e.Err
+}
+
+// Sets the actions of a state from the Setup results, the actions set with the proxy are kept
+func (s *stateImpl[C]) setActions(entry EntryAction, exit ExitAction) {
+	if entry != nil {
+		if s.enterAction != nil {
+			panic("The state has two entry actions")
+		}
+		s.enterAction = func(contextProvider) error { entry(); return nil }
+		s.setUnbound("entry action")
+	}
+	if exit != nil {
+		if s.exitAction != nil {
+			panic("The state has two exit actions")
+		}
+		s.exitAction = func(contextProvider) error { exit(); return nil }
+		s.setUnbound("exit action")
+	}
+}
+
+func (s *stateImpl[C]) SetFallibleEntryAction(action FallibleEntryAction) {
+	s.enterAction = func(contextProvider) error { return action() }
+	s.setUnbound("fallible entry action")
+}
+
+func (s *stateImpl[C]) SetFallibleExitAction(action FallibleExitAction) {
+	s.exitAction = func(contextProvider) error { return action() }
+	s.setUnbound("fallible exit action")
+}
+
+// Runs the actions of a transition path, and applies the failure policy when an action fails.
+// `event` the event that triggered the transition (nil for the initial transition)
+// `result` the result of the reaction, with the transition actions
+// `handler` the reaction (nil for the initial transition and the abort to the error state)
+// returns the new active state
+func (sm *stateMachineImpl[C]) runTransition(event Event, path *transitionPath[C], result ReactionResult, target *stateImpl[C], handler *reactionHandler[C]) *stateImpl[C] {
+	from := sm.currentState
+	failure := func(err error, phase ActionPhase, state *stateImpl[C]) *ActionFailedEvent {
+		failed := &ActionFailedEvent{Err: err, Phase: phase, State: INVALID_STATE_ID, Event: event, From: INVALID_STATE_ID, To: target.id, Policy: sm.actionFailurePolicy, toName: target.name}
+		if state != nil {
+			failed.State = state.id
+			failed.stateName = state.name
+		}
+		if from != nil {
+			failed.From = from.id
+			failed.fromName = from.name
+		}
+		return failed
+	}
+	// Run all the exits not including lca
+	for _, state := range path.exits {
+		sm.stopActivity(state)
+		var err error
+		if state.exitAction != nil {
+			err = state.exitAction(sm)
+		}
+		// a state whose exit action failed is not active anymore
+		sm.stateExited(state)
+		if err != nil {
+			if leaf, stop := sm.actionFailed(failure(err, EXIT_ACTION, state), state.parent); stop {
+				return leaf
+			}
+		}
+	}
+	// Run the action
+	if handler != nil && len(sm.observers.actions) != 0 && (result.action != nil || result.actionCtx != nil || result.fallibleAction != nil) {
+		sm.actionRun(event, handler, documentedAction(handler, result))
+	}
+	if result.action != nil {
+		result.action(event)
+	}
+	if result.actionCtx != nil {
+		result.actionCtx(sm.Context(), event)
+	}
+	if result.fallibleAction != nil {
+		if err := result.fallibleAction(event); err != nil {
+			var lca *stateImpl[C]
+			if len(path.enters) != 0 {
+				lca = path.enters[0].parent
+			} else if len(path.exits) != 0 {
+				lca = path.exits[len(path.exits)-1].parent
+			} else {
+				lca = path.leaf
+			}
+			if leaf, stop := sm.actionFailed(failure(err, TRANSITION_ACTION, nil), lca); stop {
+				return leaf
+			}
+		}
+	}
+	// Run all the enters not including lca, then the starting states
+	for _, state := range path.enters {
+		if state.enterAction != nil {
+			if err := state.enterAction(sm); err != nil {
+				if leaf, stop := sm.actionFailed(failure(err, ENTRY_ACTION, state), state.parent); stop {
+					return leaf
+				}
+				continue
+			}
+		}
+		sm.stateEntered(state)
+		sm.startActivity(state)
+	}
+	return path.leaf
+}
+
+// Applies the failure policy, a state with a failed entry or exit action is not active.
+// `active` the active state after the failure (nil if no state is active)
+// returns the new active state, and true if the transition is stopped
+func (sm *stateMachineImpl[C]) actionFailed(failed *ActionFailedEvent, active *stateImpl[C]) (*stateImpl[C], bool) {
+	if sm.DebugLogger != nil {
+		sm.DebugLogger("Action Failed", "error", failed.Error(), "policy", failed.Policy)
+	}
+	for _, o := range sm.observers.failures {
+		o.OnActionFailed(failed)
+	}
+	switch sm.actionFailurePolicy {
+	case ABORT_TO_ERROR_STATE:
+		if sm.aborting {
+			// a failure while aborting is only reported
+			break
+		}
+		sm.aborting = true
+		defer func() { sm.aborting = false }()
+		path := sm.transitionPath(active, sm.errorState, nil, false)
+		sm.checkLeaf(path.leaf)
+		leaf := sm.runTransition(failed, path, ReactionResult{}, sm.errorState, nil)
+		sm.post(failed, "")
+		return leaf, true
+	case STOP_ON_FAILURE:
+		sm.stopped = true
+		sm.stopActivities()
+		return active, true
+	}
+	sm.post(failed, "")
+	return nil, false
+}
@@ -0,0 +1,185 @@
+package statechart
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errPortBusy = errors.New("port busy")
+
+type PortContext struct {
+	openErr      error
+	configureErr error
+	log          string
+}
+
+type OpenEvent struct {
+	EventDefault
+}
+
+type FailureObserver struct {
+	ObserverDefault
+	failures []*ActionFailedEvent
+	dropped  []Event
+}
+
+func (o *FailureObserver) OnActionFailed(failure *ActionFailedEvent) {
+	o.failures = append(o.failures, failure)
+}
+
+func (o *FailureObserver) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+	o.dropped = append(o.dropped, event)
+}
+
+type PortClosed struct {
+	StateDefault[PortContext]
+}
+
+func (s *PortClosed) Setup(proxy StateSetupProxy[PortContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddFallibleStateTransition[OpenEvent, PortOpen](proxy, func(e *OpenEvent) error {
+		s.GetContext().log += "configure "
+		return s.GetContext().configureErr
+	})
+	return nil, func() { s.GetContext().log += "-PortClosed " }
+}
+
+type PortOpen struct {
+	StateDefault[PortContext]
+}
+
+func (s *PortOpen) Setup(proxy StateSetupProxy[PortContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.SetFallibleEntryAction(func() error {
+		s.GetContext().log += "+PortOpen "
+		return s.GetContext().openErr
+	})
+	AddCustomStateReaction(proxy, func(e *ActionFailedEvent) ReactionResult {
+		s.GetContext().log += "PortOpen:failed "
+		return proxy.Discard()
+	})
+	return nil, nil
+}
+
+type PortFaulted struct {
+	StateDefault[PortContext]
+}
+
+func (s *PortFaulted) Setup(proxy StateSetupProxy[PortContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *ActionFailedEvent) ReactionResult {
+		s.GetContext().log += "PortFaulted:failed "
+		return proxy.Discard()
+	})
+	return func() { s.GetContext().log += "+PortFaulted " }, nil
+}
+
+func makePortStateMachine(ctx *PortContext, observer Observer, policy ActionFailurePolicy) (*StateMachine[PortContext], StateId) {
+	sm := MakeStateMachine(ctx, WithObserver(observer), WithActionFailurePolicy(policy))
+	sm.AddState(&PortClosed{})
+	openId := sm.AddState(&PortOpen{})
+	sm.SetErrorState(sm.AddState(&PortFaulted{}))
+	return &sm, openId
+}
+
+func TestActionFailurePolicy(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       ActionFailurePolicy
+		openErr      error
+		configureErr error
+		expected     string
+		state        string
+		phase        ActionPhase
+	}{
+		{"no failure", ABORT_TO_ERROR_STATE, nil, nil,
+			"-PortClosed configure +PortOpen ", "PortOpen", 0},
+		{"entry continue", CONTINUE_ON_FAILURE, errPortBusy, nil,
+			"-PortClosed configure +PortOpen PortOpen:failed ", "PortOpen", ENTRY_ACTION},
+		{"entry abort", ABORT_TO_ERROR_STATE, errPortBusy, nil,
+			"-PortClosed configure +PortOpen +PortFaulted PortFaulted:failed ", "PortFaulted", ENTRY_ACTION},
+		{"entry stop", STOP_ON_FAILURE, errPortBusy, nil,
+			"-PortClosed configure +PortOpen ", "", ENTRY_ACTION},
+		{"action continue", CONTINUE_ON_FAILURE, nil, errPortBusy,
+			"-PortClosed configure +PortOpen PortOpen:failed ", "PortOpen", TRANSITION_ACTION},
+		{"action abort", ABORT_TO_ERROR_STATE, nil, errPortBusy,
+			"-PortClosed configure +PortFaulted PortFaulted:failed ", "PortFaulted", TRANSITION_ACTION},
+	}
+	for _, tc := range testCases {
+		ctx := PortContext{openErr: tc.openErr, configureErr: tc.configureErr}
+		observer := FailureObserver{}
+		sm, _ := makePortStateMachine(&ctx, &observer, tc.policy)
+		sm.Initialize(0)
+		sm.DispatchEvent(&OpenEvent{})
+		assert.Equal(t, tc.expected, ctx.log, tc.name)
+		configuration := sm.Configuration()
+		if tc.state == "" {
+			assert.Empty(t, configuration, tc.name)
+		} else {
+			assert.Equal(t, tc.state, configuration[len(configuration)-1].Name, tc.name)
+		}
+		if tc.openErr == nil && tc.configureErr == nil {
+			assert.Empty(t, observer.failures, tc.name)
+			continue
+		}
+		assert.Len(t, observer.failures, 1, tc.name)
+		failure := observer.failures[0]
+		assert.Equal(t, tc.phase, failure.Phase, tc.name)
+		assert.Equal(t, tc.policy, failure.Policy, tc.name)
+		assert.Equal(t, StateId(0), failure.From, tc.name)
+		assert.Equal(t, StateId(1), failure.To, tc.name)
+		assert.IsType(t, &OpenEvent{}, failure.Event, tc.name)
+		assert.ErrorIs(t, failure, errPortBusy, tc.name)
+		assert.Equal(t, tc.policy == STOP_ON_FAILURE, sm.IsStopped(), tc.name)
+	}
+}
+
+func TestActionFailureStop(t *testing.T) {
+	ctx := PortContext{openErr: errPortBusy}
+	observer := FailureObserver{}
+	sm, openId := makePortStateMachine(&ctx, &observer, STOP_ON_FAILURE)
+	sm.Initialize(0)
+	sm.DispatchEvent(&OpenEvent{})
+	assert.Equal(t, openId, observer.failures[0].State)
+	assert.Equal(t, "Entry action failed (state PortOpen, transition PortClosed -> PortOpen, event *statechart.OpenEvent): port busy", observer.failures[0].Error())
+	event := &OpenEvent{}
+	sm.DispatchEvent(event)
+	assert.Equal(t, []Event{event}, observer.dropped)
+	assert.Equal(t, INVALID_STATE_ID, sm.CurrentStateId())
+}
+
+func TestActionFailureInitialTransition(t *testing.T) {
+	ctx := PortContext{openErr: errPortBusy}
+	observer := FailureObserver{}
+	sm, openId := makePortStateMachine(&ctx, &observer, ABORT_TO_ERROR_STATE)
+	sm.Initialize(openId)
+	// the failure event posted by the initial transition is processed by Initialize
+	assert.Equal(t, "+PortOpen +PortFaulted PortFaulted:failed ", ctx.log)
+	assert.Equal(t, INVALID_STATE_ID, observer.failures[0].From)
+	assert.Nil(t, observer.failures[0].Event)
+	assert.Equal(t, "Entry action failed (state PortOpen, transition none -> PortOpen, event <nil>): port busy", observer.failures[0].Error())
+}
+
+func TestActionFailureAbortRequiresErrorState(t *testing.T) {
+	sm := MakeStateMachine(&PortContext{}, WithActionFailurePolicy(ABORT_TO_ERROR_STATE))
+	closedId := sm.AddState(&PortClosed{})
+	sm.AddState(&PortOpen{})
+	assert.Panics(t, func() { sm.Initialize(closedId) })
+}
+
+type BothEntryActions struct {
+	StateDefault[PortContext]
+}
+
+func (s *BothEntryActions) Setup(proxy StateSetupProxy[PortContext]) (EntryAction, ExitAction) {
+	proxy.SetFallibleEntryAction(func() error { return nil })
+	return func() {}, nil
+}
+
+func TestFallibleAndEntryAction(t *testing.T) {
+	sm := MakeStateMachine(&PortContext{})
+	id := sm.AddState(&BothEntryActions{})
+	assert.Panics(t, func() { sm.Initialize(id) })
+}
@@ -0,0 +1,60 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import "fmt"
+
+// The kind of a finding of Analyze
+type FindingKind int16
+
+const (
+	// A super state without a starting state: it is the active state when it is the target of a
+	// transition, which is only allowed with WithSuperStateLeaf
+	SUPER_STATE_WITHOUT_STARTING_STATE FindingKind = iota
+	// A state handles an event type that is not in the event registry (see SetEventRegistry)
+	UNDECLARED_EVENT
+	// An event type of the event registry is handled by no state
+	UNUSED_EVENT
+)
+
+func (k FindingKind) String() string {
+	switch k {
+	case SUPER_STATE_WITHOUT_STARTING_STATE:
+		return "SUPER_STATE_WITHOUT_STARTING_STATE"
+	case UNDECLARED_EVENT:
+		return "UNDECLARED_EVENT"
+	case UNUSED_EVENT:
+		return "UNUSED_EVENT"
+	}
+	return fmt.Sprintf("FindingKind(%d)", int(k))
+}
+
+// A finding reported by Analyze
+type Finding struct {
+	Kind    FindingKind
+	State   StateId
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%v: %s", f.Kind, f.Message)
+}
+
+// Returns the findings of the static analysis of a built definition
+func (d *definitionImpl[C]) analyze() []Finding {
+	if !d.built {
+		panic("State Machine not Initialized")
+	}
+	var findings []Finding
+	for _, state := range d.states {
+		if state.isSuperState && state.startingState == nil && state.subMachineEntry == nil {
+			findings = append(findings, Finding{
+				Kind:    SUPER_STATE_WITHOUT_STARTING_STATE,
+				State:   state.id,
+				Message: fmt.Sprintf("super state %s has no starting state, it can be the active state", state.name),
+			})
+		}
+	}
+	return append(findings, d.analyzeEvents()...)
+}
@@ -4,19 +4,21 @@
 package statechart
 
 import (
+	"context"
 	"io"
 	"sync"
 )
 
 type AsyncStateMachine[C any] struct {
 	impl         stateMachineImpl[C]
-	eventQueue   chan Event
+	eventQueue   chan queuedEvent
 	dispatcherWG sync.WaitGroup
 }
 
 // Creates an async state machine with a user context
-func MakeAsyncStateMachine[C any](userContext_ *C) AsyncStateMachine[C] {
-	return AsyncStateMachine[C]{impl: stateMachineImpl[C]{userContext: userContext_}}
+// `options` the optional settings of the state machine (WithObserver, WithMaxDeferredEvents, ...)
+func MakeAsyncStateMachine[C any](userContext_ *C, options ...Option) AsyncStateMachine[C] {
+	return AsyncStateMachine[C]{impl: stateMachineImpl[C]{machineOptions: makeOptions(options), userContext: userContext_}}
 }
 
 // Adds a new State to the State Machine
@@ -33,20 +35,73 @@ func (sm *AsyncStateMachine[C]) AddSubState(state State[C], parentId StateId) St
 	return sm.impl.AddSubState(state, parentId)
 }
 
+// Adds a new keyed State to the State Machine.
+// Several states of the same type can be added with different keys, they are found with
+// FindStateIdByKey (FindStateId only finds the states added without a key).
+// `state` the new state object to add
+// `key` the key of the state, unique for the state type
+// returns the new stateId
+func (sm *AsyncStateMachine[C]) AddKeyedState(state State[C], key string) StateId {
+	return sm.impl.AddKeyedState(state, key)
+}
+
+// Adds a keyed Sub-State to the State Machine, see AddKeyedState
+// `state` the new state object to add
+// `parentId` the parent (super state) ID
+// `key` the key of the state, unique for the state type
+func (sm *AsyncStateMachine[C]) AddKeyedSubState(state State[C], parentId StateId, key string) StateId {
+	return sm.impl.AddKeyedSubState(state, parentId, key)
+}
+
+// Mounts a sub machine as a sub machine state, see StateMachine.AddSubMachine
+// `container` the sub machine state
+// `sub` the sub machine to mount
+// `parentId` the parent of the container (INVALID_STATE_ID for a top state)
+// returns the StateId of the container
+func (sm *AsyncStateMachine[C]) AddSubMachine(container State[C], sub SubMachine[C], parentId StateId) StateId {
+	return sm.impl.AddSubMachine(container, sub, parentId)
+}
+
+// Sets the error state, see StateMachine.SetErrorState
+func (sm *AsyncStateMachine[C]) SetErrorState(id StateId) {
+	sm.impl.SetErrorState(id)
+}
+
+// Sets the event registry, see StateMachine.SetEventRegistry
+func (sm *AsyncStateMachine[C]) SetEventRegistry(registry *EventRegistry) {
+	sm.impl.SetEventRegistry(registry)
+}
+
+// Adds an observer, like WithObserver. It can be called while the state machine runs (not from an
+// action), the observer is notified from the next run-to-completion step.
+// `observer` the observer
+func (sm *AsyncStateMachine[C]) AddObserver(observer Observer) {
+	sm.impl.addObserver(observer)
+}
+
+func (sm *AsyncStateMachine[C]) machineImpl() *stateMachineImpl[C] {
+	return &sm.impl
+}
+
 // Initializes the state machine
 // `initStateId` the initial starting state
 func (sm *AsyncStateMachine[C]) Initialize(initStateId StateId) {
 	sm.impl.Initialize(initStateId)
-	sm.dispatcherWG.Add(1)
-	sm.eventQueue = make(chan Event, 10)
-	go sm.eventDispatcher()
+	sm.startDispatcher()
 }
 
 // Dispatches an events to the state machine
 // `event` The Event to dispatch
 // No error will occur if the Event is unknown to the state machine
 func (sm *AsyncStateMachine[C]) DispatchEvent(event Event) {
-	sm.eventQueue <- event
+	sm.eventQueue <- queuedEvent{event: event}
+}
+
+// Dispatches an events to the state machine with a context, see StateMachine.DispatchEventContext
+// `ctx` the context of the event
+// `event` The Event to dispatch
+func (sm *AsyncStateMachine[C]) DispatchEventContext(ctx context.Context, event Event) {
+	sm.eventQueue <- queuedEvent{event: event, ctx: ctx}
 }
 
 // Closes the async channel
@@ -55,6 +110,47 @@ func (sm *AsyncStateMachine[C]) Close() {
 	sm.dispatcherWG.Wait()
 }
 
+// Returns the events currently deferred, in the order they were deferred.
+// It must not be called from an action, use StateProxy.DeferredEvents instead
+func (sm *AsyncStateMachine[C]) DeferredEvents() []Event {
+	return sm.impl.DeferredEvents()
+}
+
+// Returns the active configuration, see StateMachine.Configuration
+func (sm *AsyncStateMachine[C]) Configuration() []StateInfo {
+	return sm.impl.Configuration()
+}
+
+// Returns the active state (INVALID_STATE_ID before Initialize)
+func (sm *AsyncStateMachine[C]) CurrentStateId() StateId {
+	return sm.impl.CurrentStateId()
+}
+
+// Returns true if the state is the active state or one of its ancestors
+func (sm *AsyncStateMachine[C]) IsInState(id StateId) bool {
+	return sm.impl.IsInState(id)
+}
+
+// Returns the stable identifier of a state, see StateMachine.StatePath
+func (sm *AsyncStateMachine[C]) StatePath(id StateId) string {
+	return sm.impl.definition().statePath(id)
+}
+
+// Returns true if the state machine was stopped by an action failure (see STOP_ON_FAILURE)
+func (sm *AsyncStateMachine[C]) IsStopped() bool {
+	return sm.impl.IsStopped()
+}
+
+// Returns the findings of the static analysis of the state machine (after Initialize)
+func (sm *AsyncStateMachine[C]) Analyze() []Finding {
+	return sm.impl.definition().analyze()
+}
+
+// Returns the model of the state machine (after Initialize), see Model
+func (sm *AsyncStateMachine[C]) Model() Model {
+	return sm.impl.definition().model()
+}
+
 // Sets the Debug Trace Logger for the state machine
 func (sm *AsyncStateMachine[C]) SetDebugLogger(logger func(msg string, keysAndValues ...interface{})) {
 	sm.impl.DebugLogger = logger
@@ -68,9 +164,15 @@ func (sm *AsyncStateMachine[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, di
 	sm.impl.GenerateUml(w, umlSyntax, diagramType)
 }
 
+func (sm *AsyncStateMachine[C]) startDispatcher() {
+	sm.dispatcherWG.Add(1)
+	sm.eventQueue = make(chan queuedEvent, 10)
+	go sm.eventDispatcher()
+}
+
 func (sm *AsyncStateMachine[C]) eventDispatcher() {
 	for event := range sm.eventQueue {
-		sm.impl.DispatchEvent(event)
+		sm.impl.dispatch(event)
 	}
 	sm.dispatcherWG.Done()
 }
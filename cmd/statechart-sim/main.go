@@ -0,0 +1,82 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+// Command statechart-sim simulates a state machine interactively: an exported JSON model
+// (-model) or a registered Go machine (-machine). The Go machines are registered with
+// statechartsim.Register, a project builds its own simulator with its machines:
+//
+//	func init() {
+//		statechartsim.Register("order", makeOrderMachine)
+//	}
+//
+// The command line "statechart-sim -machine turnstile -export" writes the JSON model of a
+// registered machine.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hhassoubi/go-statechart/statechartsim"
+)
+
+func main() {
+	modelPath := flag.String("model", "", "the JSON model to simulate")
+	machineName := flag.String("machine", "", "the registered machine to simulate")
+	export := flag.Bool("export", false, "writes the JSON model of the machine instead of simulating it")
+	list := flag.Bool("list", false, "lists the registered machines")
+	flag.Parse()
+
+	if *list {
+		fmt.Println(strings.Join(statechartsim.Registered(), "\n"))
+		return
+	}
+	factory, err := makeFactory(*modelPath, *machineName)
+	if err == nil && *export {
+		err = exportModel(factory)
+	} else if err == nil {
+		var session *statechartsim.Session
+		if session, err = statechartsim.NewSession(factory); err == nil {
+			fmt.Println(`Type "help" for the commands`)
+			err = session.Run(os.Stdin, os.Stdout)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func makeFactory(modelPath string, machineName string) (statechartsim.Factory, error) {
+	switch {
+	case modelPath != "" && machineName != "":
+		return nil, fmt.Errorf("-model and -machine are exclusive")
+	case machineName != "":
+		return statechartsim.Lookup(machineName)
+	case modelPath != "":
+		file, err := os.Open(modelPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		model, err := statechartsim.LoadModel(file)
+		if err != nil {
+			return nil, err
+		}
+		return func() (statechartsim.Machine, error) { return statechartsim.FromModel(model) }, nil
+	}
+	return nil, fmt.Errorf("Usage: statechart-sim -model model.json | -machine name [-export] | -list")
+}
+
+func exportModel(factory statechartsim.Factory) error {
+	machine, err := factory()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(machine.Model())
+}
@@ -0,0 +1,61 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package main
+
+import (
+	statechart "github.com/hhassoubi/go-statechart"
+	"github.com/hhassoubi/go-statechart/statechartsim"
+)
+
+// The turnstile, the machine registered as an example
+
+type TurnstileContext struct {
+	coins int
+}
+
+type CoinEvent struct {
+	statechart.EventDefault
+}
+
+type PushEvent struct {
+	statechart.EventDefault
+}
+
+type Locked struct {
+	statechart.StateDefault[TurnstileContext]
+}
+
+func (s *Locked) Setup(proxy statechart.StateSetupProxy[TurnstileContext]) (statechart.EntryAction, statechart.ExitAction) {
+	s.Init(proxy)
+	statechart.AddSimpleStateTransition[CoinEvent, Unlocked](proxy, func(e *CoinEvent) {
+		s.GetContext().coins++
+	})
+	return nil, nil
+}
+
+type Unlocked struct {
+	statechart.StateDefault[TurnstileContext]
+}
+
+func (s *Unlocked) Setup(proxy statechart.StateSetupProxy[TurnstileContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[PushEvent, Locked](proxy, nil)
+	statechart.AddDiscard[CoinEvent](proxy)
+	return nil, nil
+}
+
+func makeTurnstile() (statechartsim.Machine, error) {
+	registry := statechart.MakeEventRegistry()
+	statechart.RegisterEvent[CoinEvent](&registry, "coin")
+	statechart.RegisterEvent[PushEvent](&registry, "push")
+	sm := statechart.MakeStateMachine(&TurnstileContext{})
+	sm.SetEventRegistry(&registry)
+	lockedId := sm.AddState(&Locked{})
+	sm.AddState(&Unlocked{})
+	sm.Initialize(lockedId)
+	return statechartsim.FromStateMachine(&sm, &registry), nil
+}
+
+func init() {
+	statechartsim.Register("turnstile", makeTurnstile)
+}
@@ -0,0 +1,294 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// An edge of the coverage: a documented reaction of a state (see UmlDocReaction), or an outcome
+// that fired without being documented (e.g. a guard forwarding the event)
+type CoverageEdge struct {
+	// the path of the state owning the reaction (see StateMachine.StatePath)
+	State string
+	// the event name, as in the UML diagram
+	Event string
+	// the result of the reaction
+	Result ResultType
+	// the path of the target state of a TRANSIT result, empty otherwise
+	Target string
+	// the number of times the edge fired
+	Count int
+	// true if the edge is documented
+	Declared bool
+}
+
+// the key of a fired reaction, the states are identified by their paths so that the coverage of
+// several instances of a state machine can be merged
+type coverageKey struct {
+	state    string
+	reaction int
+	result   ResultType
+	target   string
+}
+
+type coverageHit struct {
+	event string
+	count int
+}
+
+// A Coverage collects the reactions fired by state machines, typically during a test suite, and
+// reports the documented reactions that never fired:
+//
+//	coverage := statechart.MakeCoverage[MyContext]()
+//	coverage.Attach(&sm)
+//	...
+//	coverage.Report(os.Stdout)
+//
+// A reaction documented once is covered by any result, a reaction with several UmlDocReaction
+// is covered result by result (and target by target).
+type Coverage[C any] struct {
+	// the definition laid out in the reports, the one of the first attached machine
+	definition *definitionImpl[C]
+	hits       map[coverageKey]*coverageHit
+	mutex      sync.Mutex
+}
+
+// Creates an empty coverage
+func MakeCoverage[C any]() Coverage[C] {
+	return Coverage[C]{hits: map[coverageKey]*coverageHit{}}
+}
+
+// Records the reactions of a state machine
+type coverageObserver[C any] struct {
+	ObserverDefault
+	coverage   *Coverage[C]
+	definition *definitionImpl[C]
+}
+
+func (o *coverageObserver[C]) OnReaction(event Event, state StateId, result ResultType, target StateId) {
+	s := o.definition.getState(state)
+	reaction := s.selectReaction(reflect.TypeOf(event))
+	if reaction < 0 {
+		return
+	}
+	targetPath := ""
+	if target != INVALID_STATE_ID {
+		targetPath = o.definition.getState(target).path()
+	}
+	o.coverage.hit(coverageKey{s.path(), reaction, result, targetPath}, s.events[reaction].docEventName, 1)
+}
+
+// A state machine that a Coverage can attach to: a StateMachine or an AsyncStateMachine, made
+// from its own states or by a Definition (see Definition.NewInstance)
+type ObservedMachine[C any] interface {
+	// Adds an observer (see WithObserver)
+	AddObserver(observer Observer)
+	machineImpl() *stateMachineImpl[C]
+}
+
+// Attaches the coverage to a state machine (see StateMachine.AddObserver), several machines can
+// be attached to the same coverage. Panics if the states of the machine don't match the ones of
+// the first attached machine.
+// `machine` the state machine
+func (c *Coverage[C]) Attach(machine ObservedMachine[C]) {
+	definition := machine.machineImpl().definition()
+	c.mutex.Lock()
+	if c.definition == nil {
+		c.definition = definition
+	} else if !c.definition.sameStates(definition) {
+		c.mutex.Unlock()
+		panic("The states of the machine don't match the ones of the coverage")
+	}
+	c.mutex.Unlock()
+	machine.AddObserver(&coverageObserver[C]{coverage: c, definition: definition})
+}
+
+// Returns true if the definitions have the same states (by path) with the same reactions, the
+// coverage of their machines can be merged
+func (d *definitionImpl[C]) sameStates(other *definitionImpl[C]) bool {
+	if d == other {
+		return true
+	}
+	if len(d.states) != len(other.states) {
+		return false
+	}
+	for i, state := range d.states {
+		if state.path() != other.states[i].path() || len(state.events) != len(other.states[i].events) {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges the reactions collected by another coverage, e.g. of another test
+// `other` the merged coverage
+func (c *Coverage[C]) Merge(other *Coverage[C]) {
+	if other == c {
+		return
+	}
+	other.mutex.Lock()
+	definition := other.definition
+	hits := make(map[coverageKey]coverageHit, len(other.hits))
+	for key, hit := range other.hits {
+		hits[key] = *hit
+	}
+	other.mutex.Unlock()
+
+	c.mutex.Lock()
+	if c.definition == nil {
+		c.definition = definition
+	}
+	c.mutex.Unlock()
+	for key, hit := range hits {
+		c.hit(key, hit.event, hit.count)
+	}
+}
+
+func (c *Coverage[C]) hit(key coverageKey, event string, count int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.hits == nil {
+		c.hits = map[coverageKey]*coverageHit{}
+	}
+	if hit, ok := c.hits[key]; ok {
+		hit.count += count
+	} else {
+		c.hits[key] = &coverageHit{event: event, count: count}
+	}
+}
+
+// Returns the number of times a documented reaction fired, and the keys it covers
+func (c *Coverage[C]) count(state *stateImpl[C], reaction int, doc int) (int, map[coverageKey]bool) {
+	umlDoc := state.events[reaction].umlDoc
+	path := state.path()
+	target := ""
+	if umlDoc[doc].TargetState != INVALID_STATE_ID {
+		target = c.definition.getState(umlDoc[doc].TargetState).path()
+	}
+	count := 0
+	covered := map[coverageKey]bool{}
+	for key, hit := range c.hits {
+		if key.state != path || key.reaction != reaction {
+			continue
+		}
+		// a forwarded event is not a documented result
+		if key.result != FORWARD && (len(umlDoc) == 1 || (key.result == umlDoc[doc].ReactionResult && key.target == target)) {
+			count += hit.count
+			covered[key] = true
+		}
+	}
+	return count, covered
+}
+
+// Returns the edges: the documented reactions of the states, in the order of the definition,
+// then the outcomes that fired without being documented
+func (c *Coverage[C]) Edges() []CoverageEdge {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	edges := []CoverageEdge{}
+	covered := map[coverageKey]bool{}
+	if c.definition != nil {
+		for _, state := range c.definition.states {
+			for i, ev := range state.events {
+				for j, doc := range ev.umlDoc {
+					count, keys := c.count(state, i, j)
+					for key := range keys {
+						covered[key] = true
+					}
+					target := ""
+					if doc.TargetState != INVALID_STATE_ID {
+						target = c.definition.getState(doc.TargetState).path()
+					}
+					edges = append(edges, CoverageEdge{state.path(), ev.docEventName, doc.ReactionResult, target, count, true})
+				}
+			}
+		}
+	}
+	undeclared := []CoverageEdge{}
+	for key, hit := range c.hits {
+		if !covered[key] {
+			undeclared = append(undeclared, CoverageEdge{key.state, hit.event, key.result, key.target, hit.count, false})
+		}
+	}
+	sort.Slice(undeclared, func(i, j int) bool {
+		a, b := undeclared[i], undeclared[j]
+		if a.State != b.State {
+			return a.State < b.State
+		}
+		if a.Event != b.Event {
+			return a.Event < b.Event
+		}
+		if a.Result != b.Result {
+			return a.Result < b.Result
+		}
+		return a.Target < b.Target
+	})
+	return append(edges, undeclared...)
+}
+
+func (e CoverageEdge) String() string {
+	if e.Result == TRANSIT {
+		return fmt.Sprintf("%s -> %s : %s", e.State, e.Target, e.Event)
+	}
+	return fmt.Sprintf("%s : %s / %v", e.State, e.Event, e.Result)
+}
+
+// Writes the text report of the coverage: the ratio of covered documented edges, the uncovered
+// edges, then the outcomes that fired without being documented
+// `w` the writer
+func (c *Coverage[C]) Report(w io.Writer) {
+	edges := c.Edges()
+	declared, covered := 0, 0
+	for _, edge := range edges {
+		if edge.Declared {
+			declared++
+			if edge.Count > 0 {
+				covered++
+			}
+		}
+	}
+	percent := 100.0
+	if declared > 0 {
+		percent = float64(covered) * 100 / float64(declared)
+	}
+	fmt.Fprintf(w, "Transition coverage: %d/%d (%.1f%%)\n", covered, declared, percent)
+	for _, edge := range edges {
+		if edge.Declared && edge.Count == 0 {
+			fmt.Fprintf(w, "  uncovered: %v\n", edge)
+		}
+	}
+	for _, edge := range edges {
+		if edge.Declared && edge.Count > 0 {
+			fmt.Fprintf(w, "  covered:   %v (%d)\n", edge, edge.Count)
+		}
+	}
+	for _, edge := range edges {
+		if !edge.Declared {
+			fmt.Fprintf(w, "  undocumented: %v (%d)\n", edge, edge.Count)
+		}
+	}
+}
+
+// Generates the UML diagram of the state machine, with the uncovered reactions in red
+// `w` the writer
+// `umlSyntax` the UML syntax
+// `diagramType` the diagram type
+func (c *Coverage[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.definition == nil || !c.definition.built {
+		panic("State Machine not Initialized")
+	}
+	if umlSyntax == PLANT_UML {
+		plantUmlPrint(w, c.definition, diagramType, func(state *stateImpl[C], reaction int, doc int) bool {
+			count, _ := c.count(state, reaction, doc)
+			return count == 0
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeOrderStateMachine(ctx *OrderContext) *StateMachine[OrderContext] {
+	sm := MakeStateMachine(ctx)
+	cartId := sm.AddState(&OrderCart{})
+	sm.AddState(&OrderPaying{})
+	sm.AddState(&OrderShipping{})
+	sm.AddState(&OrderShipped{})
+	sm.Initialize(cartId)
+	return &sm
+}
+
+func TestCoverage(t *testing.T) {
+	coverage := MakeCoverage[OrderContext]()
+	sm := makeOrderStateMachine(&OrderContext{})
+	coverage.Attach(sm)
+	sm.DispatchEvent(&AddItemEvent{Count: 1})
+	sm.DispatchEvent(&AddItemEvent{Count: 1})
+	sm.DispatchEvent(&CheckoutEvent{})
+
+	// another test of the suite
+	other := MakeCoverage[OrderContext]()
+	otherSm := makeOrderStateMachine(&OrderContext{})
+	other.Attach(otherSm)
+	otherSm.DispatchEvent(&CheckoutEvent{})
+	otherSm.DispatchEvent(&PayEvent{})
+	coverage.Merge(&other)
+
+	assert.Equal(t, []CoverageEdge{
+		{"OrderCart", "AddItemEvent", DISCARD, "", 2, true},
+		{"OrderCart", "CheckoutEvent", TRANSIT, "OrderPaying", 2, true},
+		{"OrderPaying", "ShipEvent", DEFER, "", 0, true},
+		{"OrderPaying", "PayEvent", TRANSIT, "OrderShipping", 1, true},
+		{"OrderShipping", "ShipEvent", TRANSIT, "OrderShipped", 0, true},
+	}, coverage.Edges())
+
+	buffer := bytes.Buffer{}
+	coverage.Report(&buffer)
+	assert.Equal(t, "Transition coverage: 3/5 (60.0%)\n"+
+		"  uncovered: OrderPaying : ShipEvent / Defer\n"+
+		"  uncovered: OrderShipping -> OrderShipped : ShipEvent\n"+
+		"  covered:   OrderCart : AddItemEvent / Discard (2)\n"+
+		"  covered:   OrderCart -> OrderPaying : CheckoutEvent (2)\n"+
+		"  covered:   OrderPaying -> OrderShipping : PayEvent (1)\n", buffer.String())
+
+	buffer.Reset()
+	coverage.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	uml := buffer.String()
+	assert.Contains(t, uml, "OrderPaying: <color:red>ShipEvent[] / DEFER</color> \n")
+	assert.Contains(t, uml, "OrderShipping -[#red]-> OrderShipped : ShipEvent\n")
+	assert.Contains(t, uml, "OrderCart -> OrderPaying : CheckoutEvent\n")
+	assert.Contains(t, uml, "OrderCart: AddItemEvent[] / Custom(TODO) \n")
+}
+
+type GuardedContext struct {
+	open bool
+}
+
+type GuardedIdle struct {
+	StateDefault[GuardedContext]
+}
+
+func (s *GuardedIdle) Setup(proxy StateSetupProxy[GuardedContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *PayEvent) ReactionResult {
+		if s.GetContext().open {
+			return Transit[GuardedIdle, GuardedContext](proxy)
+		}
+		return proxy.Forward()
+	})
+	return nil, nil
+}
+
+func TestCoverageUndocumentedOutcome(t *testing.T) {
+	sm := MakeStateMachine(&GuardedContext{})
+	sm.Initialize(sm.AddState(&GuardedIdle{}))
+	coverage := MakeCoverage[GuardedContext]()
+	coverage.Attach(&sm)
+	sm.DispatchEvent(&PayEvent{})
+
+	edges := coverage.Edges()
+	assert.Equal(t, []CoverageEdge{
+		{"GuardedIdle", "PayEvent", DISCARD, "", 0, true},
+		{"GuardedIdle", "PayEvent", FORWARD, "", 1, false},
+	}, edges)
+	buffer := bytes.Buffer{}
+	coverage.Report(&buffer)
+	assert.Contains(t, buffer.String(), "  undocumented: GuardedIdle : PayEvent / Forward (1)\n")
+}
+
+func TestCoverageDefinitionInstances(t *testing.T) {
+	def := MakeOnOffDefinition(&OnOffTestContext{})
+	ctx := OnOffTestContext{}
+	ctx.OffEnter.ResetNoLimit(t)
+	ctx.OffExit.ResetNoLimit(t)
+	ctx.OnEnter.ResetNoLimit(t)
+	asyncCtx := ctx
+	coverage := MakeCoverage[OnOffTestContext]()
+	sm := def.NewInstance(&ctx)
+	coverage.Attach(sm)
+	async := def.NewAsyncInstance(&asyncCtx)
+	coverage.Attach(async)
+	sm.DispatchEvent(&OnEvent{})
+	async.DispatchEvent(&ToggleEvent{})
+	async.Close()
+	assert.Equal(t, []CoverageEdge{
+		{"SharedOn", "OffEvent", TRANSIT, "SharedOff", 0, true},
+		{"SharedOn", "ToggleEvent", TRANSIT, "SharedOff", 0, true},
+		{"SharedOff", "OnEvent", TRANSIT, "SharedOn", 1, true},
+		{"SharedOff", "ToggleEvent", TRANSIT, "SharedOn", 1, true},
+	}, coverage.Edges())
+
+	// a machine with other states
+	other := MakeStateMachine(&OnOffTestContext{})
+	other.Initialize(other.AddState(&OffDefault{}))
+	assert.PanicsWithValue(t, "The states of the machine don't match the ones of the coverage", func() { coverage.Attach(&other) })
+}
@@ -0,0 +1,290 @@
+package statechart
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Deferral conformance suite.
+// Waiting and AlsoWaiting defer WorkEvent, Ready handles it, Choosy defers the odd ones with a
+// custom reaction and defers HoldEvent, Guarded (child of Guard) does not react to WorkEvent while Guard defers it,
+// and Greedy (child of Guard) handles it before its parent.
+
+type WorkEvent struct {
+	EventDefault
+	id int
+}
+
+type HoldEvent struct {
+	EventDefault
+	id int
+}
+
+type GoEvent struct {
+	EventDefault
+}
+
+type ReadyEvent struct {
+	EventDefault
+}
+
+type ChoosyEvent struct {
+	EventDefault
+}
+
+type GuardEvent struct {
+	EventDefault
+}
+
+type GreedyEvent struct {
+	EventDefault
+}
+
+type DeferralContext struct {
+	handled  []int
+	reacted  int
+	postWork bool
+}
+
+type Waiting struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Waiting) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddDefer[WorkEvent](proxy)
+	AddDefer[HoldEvent](proxy)
+	AddSimpleStateTransition[GoEvent, AlsoWaiting](proxy, nil)
+	AddSimpleStateTransition[ReadyEvent, Ready](proxy, nil)
+	AddSimpleStateTransition[ChoosyEvent, Choosy](proxy, nil)
+	AddSimpleStateTransition[GuardEvent, Guarded](proxy, nil)
+	AddSimpleStateTransition[GreedyEvent, Greedy](proxy, nil)
+	AddInStateReaction(proxy, func(e *TestEvent) {
+		// posts an event that is deferred
+		proxy.PostEvent(&WorkEvent{id: 100})
+	})
+	return nil, nil
+}
+
+type AlsoWaiting struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *AlsoWaiting) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddDefer[WorkEvent](proxy)
+	AddSimpleStateTransition[ReadyEvent, Ready](proxy, nil)
+	return nil, nil
+}
+
+type Ready struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Ready) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddInStateReaction(proxy, func(e *WorkEvent) {
+		proxy.GetContext().handled = append(proxy.GetContext().handled, e.id)
+	})
+	AddInStateReaction(proxy, func(e *HoldEvent) {
+		proxy.GetContext().handled = append(proxy.GetContext().handled, e.id)
+	})
+	AddSimpleStateTransition[GoEvent, Waiting](proxy, nil)
+	AddDiscard[ReadyEvent](proxy)
+	return func() {
+		if proxy.GetContext().postWork {
+			proxy.PostEvent(&WorkEvent{id: 200})
+		}
+	}, nil
+}
+
+type Choosy struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Choosy) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddCustomStateReaction(proxy, func(e *WorkEvent) ReactionResult {
+		ctx := proxy.GetContext()
+		ctx.reacted++
+		if e.id%2 == 1 {
+			return proxy.Defer()
+		}
+		ctx.handled = append(ctx.handled, e.id)
+		return proxy.Discard()
+	})
+	AddDefer[HoldEvent](proxy)
+	AddSimpleStateTransition[ReadyEvent, Ready](proxy, nil)
+	return nil, nil
+}
+
+type Guard struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Guard) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	SetStartingState[Guarded](proxy)
+	AddDefer[WorkEvent](proxy)
+	AddSimpleStateTransition[ReadyEvent, Ready](proxy, nil)
+	AddSimpleStateTransition[GreedyEvent, Greedy](proxy, nil)
+	return nil, nil
+}
+
+type Guarded struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Guarded) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	return nil, nil
+}
+
+type Greedy struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Greedy) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddInStateReaction(proxy, func(e *WorkEvent) {
+		proxy.GetContext().handled = append(proxy.GetContext().handled, -e.id)
+	})
+	return nil, nil
+}
+
+func makeDeferralStateMachine(ctx *DeferralContext) *stateMachineImpl[DeferralContext] {
+	sm := &stateMachineImpl[DeferralContext]{userContext: ctx}
+	waitingId := sm.AddState(&Waiting{})
+	sm.AddState(&AlsoWaiting{})
+	sm.AddState(&Ready{})
+	sm.AddState(&Choosy{})
+	guardId := sm.AddState(&Guard{})
+	sm.AddSubState(&Guarded{}, guardId)
+	sm.AddSubState(&Greedy{}, guardId)
+	sm.Initialize(waitingId)
+	return sm
+}
+
+func deferredIds(events []Event) []int {
+	ids := []int{}
+	for _, e := range events {
+		switch e := e.(type) {
+		case *WorkEvent:
+			ids = append(ids, e.id)
+		case *HoldEvent:
+			ids = append(ids, e.id)
+		}
+	}
+	return ids
+}
+
+func TestDeferralConformance(t *testing.T) {
+	tests := []struct {
+		name             string
+		postWork         bool
+		events           []Event
+		expectedState    string
+		expectedHandled  []int
+		expectedDeferred []int
+		expectedReacted  int
+	}{
+		{
+			name:             "deferred while the state defers",
+			events:           []Event{&WorkEvent{id: 1}, &WorkEvent{id: 2}},
+			expectedState:    "Waiting",
+			expectedHandled:  []int{},
+			expectedDeferred: []int{1, 2},
+		},
+		{
+			name:             "replayed in order when a state handles it",
+			events:           []Event{&WorkEvent{id: 1}, &WorkEvent{id: 2}, &ReadyEvent{}},
+			expectedState:    "Ready",
+			expectedHandled:  []int{1, 2},
+			expectedDeferred: []int{},
+		},
+		{
+			name:             "kept when the next state still defers it",
+			events:           []Event{&WorkEvent{id: 1}, &GoEvent{}},
+			expectedState:    "AlsoWaiting",
+			expectedHandled:  []int{},
+			expectedDeferred: []int{1},
+		},
+		{
+			name:             "kept across several deferring states then replayed",
+			events:           []Event{&WorkEvent{id: 1}, &GoEvent{}, &WorkEvent{id: 2}, &ReadyEvent{}},
+			expectedState:    "Ready",
+			expectedHandled:  []int{1, 2},
+			expectedDeferred: []int{},
+		},
+		{
+			name:             "a posted event is deferred, not the dispatched one",
+			events:           []Event{&TestEvent{}},
+			expectedState:    "Waiting",
+			expectedHandled:  []int{},
+			expectedDeferred: []int{100},
+		},
+		{
+			name:             "replayed before the events posted by the entry action",
+			postWork:         true,
+			events:           []Event{&WorkEvent{id: 1}, &WorkEvent{id: 2}, &ReadyEvent{}},
+			expectedState:    "Ready",
+			expectedHandled:  []int{1, 2, 200},
+			expectedDeferred: []int{},
+		},
+		{
+			name:             "custom reaction defers again and keeps the order",
+			events:           []Event{&WorkEvent{id: 1}, &WorkEvent{id: 2}, &WorkEvent{id: 3}, &ChoosyEvent{}},
+			expectedState:    "Choosy",
+			expectedHandled:  []int{2},
+			expectedDeferred: []int{1, 3},
+			expectedReacted:  3,
+		},
+		{
+			name:             "custom and plain deferral keep the order",
+			events:           []Event{&WorkEvent{id: 1}, &HoldEvent{id: 10}, &WorkEvent{id: 3}, &ChoosyEvent{}},
+			expectedState:    "Choosy",
+			expectedHandled:  []int{},
+			expectedDeferred: []int{1, 10, 3},
+			expectedReacted:  2,
+		},
+		{
+			name:             "custom and plain deferral replayed in order",
+			events:           []Event{&WorkEvent{id: 1}, &HoldEvent{id: 10}, &WorkEvent{id: 3}, &ChoosyEvent{}, &ReadyEvent{}},
+			expectedState:    "Ready",
+			expectedHandled:  []int{1, 10, 3},
+			expectedDeferred: []int{},
+			expectedReacted:  2,
+		},
+		{
+			name:             "deferred by the parent when the child does not react",
+			events:           []Event{&WorkEvent{id: 1}, &GuardEvent{}, &WorkEvent{id: 2}},
+			expectedState:    "Guarded",
+			expectedHandled:  []int{},
+			expectedDeferred: []int{1, 2},
+		},
+		{
+			name:             "handled by the child before the deferring parent",
+			events:           []Event{&WorkEvent{id: 1}, &GuardEvent{}, &GreedyEvent{}, &WorkEvent{id: 2}},
+			expectedState:    "Greedy",
+			expectedHandled:  []int{-1, -2},
+			expectedDeferred: []int{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := DeferralContext{handled: []int{}, postWork: test.postWork}
+			sm := makeDeferralStateMachine(&ctx)
+			for _, e := range test.events {
+				sm.DispatchEvent(e)
+			}
+			assert.Equal(t, test.expectedState, sm.currentState.name)
+			assert.Equal(t, test.expectedHandled, ctx.handled)
+			assert.Equal(t, test.expectedDeferred, deferredIds(sm.DeferredEvents()))
+			assert.Equal(t, test.expectedReacted, ctx.reacted)
+		})
+	}
+}
+
+func TestDeferredEventsIsACopy(t *testing.T) {
+	ctx := DeferralContext{}
+	sm := makeDeferralStateMachine(&ctx)
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	deferred := sm.DeferredEvents()
+	deferred[0] = &WorkEvent{id: 2}
+	assert.Equal(t, []int{1}, deferredIds(sm.DeferredEvents()))
+	assert.Equal(t, []int{1}, deferredIds(sm.states[sm.currentState.id].DeferredEvents()))
+}
@@ -0,0 +1,187 @@
+package statechart
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeClock struct {
+	now time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.now
+}
+
+type DroppedEvent struct {
+	event  Event
+	reason DropReason
+}
+
+type DeadLetterObserver struct {
+	ObserverDefault
+	dropped []DroppedEvent
+}
+
+func (o *DeadLetterObserver) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+	o.dropped = append(o.dropped, DroppedEvent{event, reason})
+}
+
+type Expiring struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Expiring) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddDeferWithTTL[WorkEvent](proxy, time.Minute)
+	AddSimpleStateTransition[ReadyEvent, Released](proxy, nil)
+	AddSimpleStateTransition[GoEvent, StillWaiting](proxy, nil)
+	return nil, nil
+}
+
+type StillWaiting struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *StillWaiting) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddDefer[WorkEvent](proxy)
+	return nil, nil
+}
+
+type Released struct {
+	StateDefault[DeferralContext]
+}
+
+func (s *Released) Setup(proxy StateSetupProxy[DeferralContext]) (EntryAction, ExitAction) {
+	AddInStateReactionCtx(proxy, func(ctx context.Context, e *WorkEvent) {
+		context := proxy.Bind(ctx).GetContext()
+		context.handled = append(context.handled, e.id)
+	})
+	return nil, nil
+}
+
+func makeExpiringStateMachine(ctx *DeferralContext, options ...Option) *StateMachine[DeferralContext] {
+	def := MakeDefinition[DeferralContext]()
+	expiringId := def.AddState(&Expiring{})
+	def.AddState(&StillWaiting{})
+	def.AddState(&Released{})
+	def.Build(expiringId)
+	return def.NewInstance(ctx, options...)
+}
+
+func TestDeferredOverflowDropOldest(t *testing.T) {
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithMaxDeferredEvents(2, DROP_OLDEST), WithObserver(&observer))
+	for i := 1; i <= 4; i++ {
+		sm.DispatchEvent(&WorkEvent{id: i})
+	}
+	assert.Equal(t, []int{3, 4}, deferredIds(sm.DeferredEvents()))
+	assert.Len(t, observer.dropped, 2)
+	assert.Equal(t, 1, observer.dropped[0].event.(*WorkEvent).id)
+	assert.Equal(t, 2, observer.dropped[1].event.(*WorkEvent).id)
+	assert.Equal(t, DROP_DEFERRED_OVERFLOW, observer.dropped[0].reason)
+
+	sm.DispatchEvent(&ReadyEvent{})
+	assert.Equal(t, []int{3, 4}, ctx.handled)
+}
+
+func TestDeferredOverflowDropNewest(t *testing.T) {
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithMaxDeferredEvents(2, DROP_NEWEST), WithObserver(&observer))
+	for i := 1; i <= 4; i++ {
+		sm.DispatchEvent(&WorkEvent{id: i})
+	}
+	assert.Equal(t, []int{1, 2}, deferredIds(sm.DeferredEvents()))
+	assert.Len(t, observer.dropped, 2)
+	assert.Equal(t, 3, observer.dropped[0].event.(*WorkEvent).id)
+	assert.Equal(t, 4, observer.dropped[1].event.(*WorkEvent).id)
+}
+
+func TestDeferredOverflowPanic(t *testing.T) {
+	ctx := DeferralContext{}
+	sm := makeExpiringStateMachine(&ctx, WithMaxDeferredEvents(1, PANIC_ON_OVERFLOW))
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	assert.Panics(t, func() { sm.DispatchEvent(&WorkEvent{id: 2}) })
+}
+
+func TestDeferredTTL(t *testing.T) {
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithClock(&clock), WithObserver(&observer))
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	clock.now = clock.now.Add(30 * time.Second)
+	sm.DispatchEvent(&WorkEvent{id: 2})
+	assert.Equal(t, []int{1, 2}, deferredIds(sm.DeferredEvents()))
+
+	clock.now = clock.now.Add(30 * time.Second)
+	assert.Equal(t, []int{2}, deferredIds(sm.DeferredEvents()))
+	assert.Len(t, observer.dropped, 1)
+	assert.Equal(t, 1, observer.dropped[0].event.(*WorkEvent).id)
+	assert.Equal(t, DROP_DEFERRED_EXPIRED, observer.dropped[0].reason)
+
+	clock.now = clock.now.Add(10 * time.Second)
+	sm.DispatchEvent(&ReadyEvent{})
+	assert.Equal(t, []int{2}, ctx.handled)
+}
+
+func TestDeferredTTLExpiresBeforeReplay(t *testing.T) {
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithClock(&clock), WithObserver(&observer))
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	clock.now = clock.now.Add(2 * time.Minute)
+	sm.DispatchEvent(&ReadyEvent{})
+	assert.Empty(t, ctx.handled)
+	assert.Len(t, observer.dropped, 1)
+}
+
+func TestDeferredTTLRemovedByStateWithoutTTL(t *testing.T) {
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithClock(&clock))
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	// StillWaiting defers WorkEvent without a time to live
+	sm.DispatchEvent(&GoEvent{})
+	clock.now = clock.now.Add(time.Hour)
+	assert.Equal(t, []int{1}, deferredIds(sm.DeferredEvents()))
+	assert.Equal(t, 0, sm.impl.expiringEvents)
+}
+
+func TestDeferredTTLCount(t *testing.T) {
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	ctx := DeferralContext{handled: []int{}}
+	sm := makeExpiringStateMachine(&ctx, WithClock(&clock), WithMaxDeferredEvents(2, DROP_OLDEST))
+	sm.DispatchEvent(&WorkEvent{id: 1})
+	sm.DispatchEvent(&WorkEvent{id: 2})
+	sm.DispatchEvent(&WorkEvent{id: 3})
+	assert.Equal(t, 2, sm.impl.expiringEvents)
+	clock.now = clock.now.Add(time.Hour)
+	assert.Empty(t, sm.DeferredEvents())
+	assert.Equal(t, 0, sm.impl.expiringEvents)
+}
+
+func BenchmarkDispatchWithDeferredEvents(b *testing.B) {
+	ctx := DeferralContext{}
+	sm := makeDeferralStateMachine(&ctx)
+	for i := 0; i < 1000; i++ {
+		sm.DispatchEvent(&WorkEvent{id: i})
+	}
+	// not handled by Waiting, the deferred events stay in place
+	unhandled := &OffEvent{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.DispatchEvent(unhandled)
+	}
+}
+
+func TestDropReasonString(t *testing.T) {
+	assert.Equal(t, "DeferredOverflow", DROP_DEFERRED_OVERFLOW.String())
+	assert.Equal(t, "DeferredExpired", DROP_DEFERRED_EXPIRED.String())
+}
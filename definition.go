@@ -0,0 +1,187 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Definition is the structure of a state machine (states, reactions and initial state) built
+// and validated once, then instantiated many times with NewInstance.
+// All the instances share the states and their reaction tables, only the current state, the
+// event queues and the user context are kept per instance.
+// Because the state objects are shared, their Setup is called once with no user context, and
+// their proxies don't know the instances: the actions and the custom reactions reach their
+// instance with the proxy bound to it, from the context they receive (see StateProxy.Bind).
+// NewInstance panics if a state has an action that doesn't receive the context (an EntryAction
+// returned by Setup, an action of AddSimpleStateTransition, a custom reaction, ...), use the
+// Ctx variants (SetEntryActionCtx, AddSimpleStateTransitionCtx, AddCustomStateReactionCtx, ...).
+// Such a definition can still be mounted as a sub machine, its states are set up again by each
+// state machine it is mounted in.
+// The instances run independently, an action of an instance can dispatch to another one.
+type Definition[C any] struct {
+	impl       *definitionImpl[C]
+	setupMutex *sync.Mutex
+}
+
+// Creates an empty definition
+func MakeDefinition[C any]() Definition[C] {
+	return Definition[C]{impl: &definitionImpl[C]{}, setupMutex: &sync.Mutex{}}
+}
+
+// Adds a new State to the definition
+// `state` the new state object to add
+// returns the new stateId
+func (d Definition[C]) AddState(state State[C]) StateId {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.addState(state, "")
+}
+
+// Adds a new keyed State to the definition, see StateMachine.AddKeyedState
+// `state` the new state object to add
+// `key` the key of the state
+// returns the new stateId
+func (d Definition[C]) AddKeyedState(state State[C], key string) StateId {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.addState(state, key)
+}
+
+// Adds a Sub-State to the definition
+// `state` the new state object to add
+// `parentId` the parent (super state) ID
+func (d Definition[C]) AddSubState(state State[C], parentId StateId) StateId {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.addSubState(state, parentId, "")
+}
+
+// Adds a keyed Sub-State to the definition, see StateMachine.AddKeyedState
+// `state` the new state object to add
+// `parentId` the parent (super state) ID
+// `key` the key of the state
+func (d Definition[C]) AddKeyedSubState(state State[C], parentId StateId, key string) StateId {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.addSubState(state, parentId, key)
+}
+
+// Mounts a sub machine as a sub machine state, see StateMachine.AddSubMachine
+// `container` the sub machine state
+// `sub` the sub machine to mount
+// `parentId` the parent of the container (INVALID_STATE_ID for a top state)
+// returns the StateId of the container
+func (d Definition[C]) AddSubMachine(container State[C], sub SubMachine[C], parentId StateId) StateId {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return sub.mount(d.impl, container, parentId)
+}
+
+// Sets the error state, see StateMachine.SetErrorState
+func (d Definition[C]) SetErrorState(id StateId) {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	d.impl.setErrorState(id)
+}
+
+// Sets the event registry, see StateMachine.SetEventRegistry
+func (d Definition[C]) SetEventRegistry(registry *EventRegistry) {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	d.impl.setEventRegistry(registry)
+}
+
+// Builds the definition: calls Setup on every state and validates the initial state.
+// No state can be added after Build.
+// `initStateId` the initial starting state of every instance
+func (d Definition[C]) Build(initStateId StateId) {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	d.impl.build(initStateId)
+}
+
+// Returns true if Build was called
+func (d Definition[C]) IsBuilt() bool {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.built
+}
+
+// Returns the findings of the static analysis of the definition (after Build)
+func (d Definition[C]) Analyze() []Finding {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.analyze()
+}
+
+// Returns the model of the definition (after Build), see Model
+func (d Definition[C]) Model() Model {
+	d.setupMutex.Lock()
+	defer d.setupMutex.Unlock()
+	return d.impl.model()
+}
+
+// Creates a new initialized state machine from the definition, the entry actions of the
+// initial state are run before returning.
+// `userContext` the context of the new instance
+// `options` the optional settings of the instance
+func (d Definition[C]) NewInstance(userContext *C, options ...Option) *StateMachine[C] {
+	sm := &StateMachine[C]{impl: d.newInstanceImpl(userContext, options)}
+	sm.impl.start()
+	return sm
+}
+
+// Creates a new initialized async state machine from the definition
+// `userContext` the context of the new instance
+// `options` the optional settings of the instance
+func (d Definition[C]) NewAsyncInstance(userContext *C, options ...Option) *AsyncStateMachine[C] {
+	sm := &AsyncStateMachine[C]{impl: d.newInstanceImpl(userContext, options)}
+	sm.impl.start()
+	sm.startDispatcher()
+	return sm
+}
+
+func (d Definition[C]) newInstanceImpl(userContext *C, options []Option) stateMachineImpl[C] {
+	if !d.IsBuilt() {
+		panic("Definition not built")
+	}
+	if len(d.impl.unbound) != 0 {
+		panic(d.impl.unbound)
+	}
+	return stateMachineImpl[C]{definitionImpl: d.impl, machineOptions: makeOptions(options), userContext: userContext}
+}
+
+// Generates the UML diagram for the definition, see StateMachine.GenerateUml
+func (d Definition[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
+	d.impl.GenerateUml(w, umlSyntax, diagramType)
+}
+
+// Records an action of the state that doesn't receive the instance
+// `action` what the action is, for the message of checkBoundActions
+func (s *stateImpl[C]) setUnbound(action string) {
+	if len(s.unbound) == 0 {
+		s.unbound = action
+	}
+}
+
+// Returns why the definition can't be instantiated ("" if it can): a state has an action or a
+// custom reaction that doesn't receive the instance, it could only reach the instance through
+// the state, which is shared by the instances.
+func (d *definitionImpl[C]) checkBoundActions() string {
+	for _, state := range d.states {
+		unbound := state.unbound
+		for _, reaction := range state.events {
+			if len(unbound) == 0 && reaction.unbound {
+				unbound = "reaction to " + reaction.docEventName
+			}
+		}
+		if len(unbound) != 0 {
+			return fmt.Sprintf("The %s of state %s doesn't receive the instance, the states of a Definition use the Ctx actions (see StateProxy.Bind)", unbound, state.name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+package statechart
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type SetupCountContext struct {
+	enters int
+}
+
+type CountedState struct {
+	StateDefault[SetupCountContext]
+	setupCalls int
+}
+
+func (s *CountedState) Setup(proxy StateSetupProxy[SetupCountContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	s.setupCalls++
+	AddSimpleStateTransition[TestEvent, CountedState](proxy, nil)
+	// the state is shared by the instances of a definition, the action reaches its instance
+	// with the bound proxy
+	proxy.SetEntryActionCtx(func(ctx context.Context) { proxy.Bind(ctx).GetContext().enters++ })
+	return nil, nil
+}
+
+// The On state of the OnOff definition, the actions reach their instance with the bound proxy
+type SharedOn struct {
+	StateDefault[OnOffTestContext]
+}
+
+func (s *SharedOn) Setup(proxy StateSetupProxy[OnOffTestContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransitionCtx[OffEvent, SharedOff](proxy, func(ctx context.Context, e *OffEvent) { proxy.Bind(ctx).GetContext().OnToOffAction.Call(e) })
+	AddSimpleStateTransitionCtx[ToggleEvent, SharedOff](proxy, func(ctx context.Context, e *ToggleEvent) { proxy.Bind(ctx).GetContext().OnToOffAction.Call(e) })
+	proxy.SetEntryActionCtx(func(ctx context.Context) { proxy.Bind(ctx).GetContext().OnEnter.Call() })
+	proxy.SetExitActionCtx(func(ctx context.Context) { proxy.Bind(ctx).GetContext().OnExit.Call() })
+	return nil, nil
+}
+
+// The Off state of the OnOff definition
+type SharedOff struct {
+	StateDefault[OnOffTestContext]
+}
+
+func (s *SharedOff) Setup(proxy StateSetupProxy[OnOffTestContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[OnEvent, SharedOn](proxy, nil)
+	AddSimpleStateTransition[ToggleEvent, SharedOn](proxy, nil)
+	proxy.SetEntryActionCtx(func(ctx context.Context) { proxy.Bind(ctx).GetContext().OffEnter.Call() })
+	proxy.SetExitActionCtx(func(ctx context.Context) { proxy.Bind(ctx).GetContext().OffExit.Call() })
+	return nil, nil
+}
+
+// A state with a custom reaction that doesn't receive the instance
+type CustomOn struct {
+	StateDefault[OnOffTestContext]
+}
+
+func (s *CustomOn) Setup(proxy StateSetupProxy[OnOffTestContext]) (EntryAction, ExitAction) {
+	AddCustomStateReaction(proxy, func(e *OffEvent) ReactionResult { return Transit[OffDefault, OnOffTestContext](proxy) })
+	return nil, nil
+}
+
+func MakeOnOffDefinition(ctx *OnOffTestContext) Definition[OnOffTestContext] {
+	def := MakeDefinition[OnOffTestContext]()
+	ctx.OnId = def.AddState(&SharedOn{})
+	ctx.OffId = def.AddState(&SharedOff{})
+	def.Build(ctx.OffId)
+	return def
+}
+
+func TestDefinitionSetupOnce(t *testing.T) {
+	def := MakeDefinition[SetupCountContext]()
+	state := &CountedState{}
+	id := def.AddState(state)
+	def.Build(id)
+	assert.True(t, def.IsBuilt())
+
+	ctx1 := SetupCountContext{}
+	ctx2 := SetupCountContext{}
+	sm1 := def.NewInstance(&ctx1)
+	sm2 := def.NewInstance(&ctx2)
+	assert.Equal(t, 1, state.setupCalls)
+	assert.Equal(t, 1, ctx1.enters)
+	assert.Equal(t, 1, ctx2.enters)
+
+	sm1.DispatchEvent(&TestEvent{})
+	sm1.DispatchEvent(&TestEvent{})
+	sm2.DispatchEvent(&TestEvent{})
+	assert.Equal(t, 3, ctx1.enters)
+	assert.Equal(t, 2, ctx2.enters)
+	assert.Equal(t, 1, state.setupCalls)
+}
+
+func TestDefinitionIndependentInstances(t *testing.T) {
+	ids := OnOffTestContext{}
+	def := MakeOnOffDefinition(&ids)
+
+	ctx1 := OnOffTestContext{}
+	ctx1.OffEnter.ResetNoLimit(t)
+	ctx1.OffExit.ResetNoLimit(t)
+	ctx1.OnEnter.ResetNoLimit(t)
+	ctx1.OnExit.ResetNoLimit(t)
+	ctx1.OnToOffAction.ResetNoLimit(t)
+	ctx2 := ctx1
+	sm1 := def.NewInstance(&ctx1)
+	sm2 := def.NewInstance(&ctx2)
+
+	sm1.DispatchEvent(&OnEvent{})
+	sm1.DispatchEvent(&OffEvent{})
+	assert.Equal(t, ids.OffId, sm1.impl.currentState.id)
+	assert.Equal(t, ids.OffId, sm2.impl.currentState.id)
+	ctx1.OnEnter.Validate(1)
+	ctx1.OnToOffAction.Validate(1)
+	ctx1.OffEnter.Validate(2)
+	ctx2.OnEnter.Validate(0)
+	ctx2.OnToOffAction.Validate(0)
+	ctx2.OffEnter.Validate(1)
+
+	sm2.DispatchEvent(&OnEvent{})
+	assert.Equal(t, ids.OnId, sm2.impl.currentState.id)
+	assert.Equal(t, ids.OffId, sm1.impl.currentState.id)
+}
+
+func TestDefinitionUnboundActions(t *testing.T) {
+	// the plain actions of the OnOff state machine reach the context through the shared state
+	def := MakeDefinition[OnOffTestContext]()
+	offId := def.AddState(&Off{})
+	def.AddState(&On{})
+	def.AddSubState(&OffLockTag{}, offId)
+	def.AddSubState(&OffDefault{}, offId)
+	def.Build(offId)
+	assert.PanicsWithValue(t, "The entry action of state Off doesn't receive the instance, the states of a Definition use the Ctx actions (see StateProxy.Bind)", func() { def.NewInstance(&OnOffTestContext{}) })
+	assert.Panics(t, func() { def.NewAsyncInstance(&OnOffTestContext{}) })
+	// the definition can still be mounted, the states are set up again with the host proxies
+	host := OnOffTestContext{}
+	host.OffEnter.ResetNoLimit(t)
+	sm := MakeStateMachine(&host)
+	sm.Initialize(sm.AddSubMachine(&OffDefault{}, MakeSubMachine(def), INVALID_STATE_ID))
+	host.OffEnter.Validate(1)
+
+	custom := MakeDefinition[OnOffTestContext]()
+	customId := custom.AddState(&OffDefault{})
+	custom.AddState(&CustomOn{})
+	custom.Build(customId)
+	assert.Panics(t, func() { custom.NewInstance(&OnOffTestContext{}) })
+}
+
+func TestDefinitionAsyncInstance(t *testing.T) {
+	def := MakeDefinition[SetupCountContext]()
+	def.Build(def.AddState(&CountedState{}))
+	ctx := SetupCountContext{}
+	sm := def.NewAsyncInstance(&ctx)
+	sm.DispatchEvent(&TestEvent{})
+	sm.Close()
+	assert.Equal(t, 2, ctx.enters)
+}
+
+func TestDefinitionPanics(t *testing.T) {
+	def := MakeDefinition[SetupCountContext]()
+	id := def.AddState(&CountedState{})
+	assert.Panics(t, func() { def.NewInstance(&SetupCountContext{}) })
+	def.Build(id)
+	assert.Panics(t, func() { def.Build(id) })
+	assert.Panics(t, func() { def.AddState(&CountedState{}) })
+	sm := def.NewInstance(&SetupCountContext{})
+	assert.Panics(t, func() { sm.AddState(&CountedState{}) })
+	assert.Panics(t, func() { sm.Initialize(id) })
+}
+
+type RelayContext struct {
+	// the instance the relayed events are dispatched to, nil for the last one
+	next    *StateMachine[RelayContext]
+	relayed int
+}
+
+type RelayEvent struct {
+	EventDefault
+}
+
+type Relay struct {
+	StateDefault[RelayContext]
+}
+
+func (s *Relay) Setup(proxy StateSetupProxy[RelayContext]) (EntryAction, ExitAction) {
+	AddInStateReactionCtx(proxy, func(ctx context.Context, e *RelayEvent) {
+		context := proxy.Bind(ctx).GetContext()
+		context.relayed++
+		if context.next != nil {
+			context.next.DispatchEvent(&RelayEvent{})
+		}
+	})
+	return nil, nil
+}
+
+func TestDefinitionDispatchFromAction(t *testing.T) {
+	def := MakeDefinition[RelayContext]()
+	def.Build(def.AddState(&Relay{}))
+	last := RelayContext{}
+	first := RelayContext{next: def.NewInstance(&last)}
+
+	// the action of an instance dispatches to another instance of the same definition
+	def.NewInstance(&first).DispatchEvent(&RelayEvent{})
+	assert.Equal(t, 1, first.relayed)
+	assert.Equal(t, 1, last.relayed)
+}
+
+func TestDefinitionConcurrentInstances(t *testing.T) {
+	ids := OnOffTestContext{}
+	def := MakeOnOffDefinition(&ids)
+	contexts := make([]OnOffTestContext, 8)
+	wg := sync.WaitGroup{}
+	for i := range contexts {
+		contexts[i].OnEnter.ResetNoLimit(t)
+		contexts[i].OnExit.ResetNoLimit(t)
+		contexts[i].OffEnter.ResetNoLimit(t)
+		contexts[i].OffExit.ResetNoLimit(t)
+		contexts[i].OnToOffAction.ResetNoLimit(t)
+		sm := def.NewInstance(&contexts[i])
+		wg.Add(1)
+		// the instances run their steps at the same time
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sm.DispatchEvent(&ToggleEvent{})
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range contexts {
+		contexts[i].OnEnter.Validate(50)
+		contexts[i].OnToOffAction.Validate(50)
+		contexts[i].OffEnter.Validate(51)
+	}
+}
+
+func TestDefinitionSharedProxy(t *testing.T) {
+	def := MakeDefinition[RelayContext]()
+	id := def.AddState(&Relay{})
+	def.Build(id)
+	state := def.impl.getState(id)
+	// the proxy given to Setup doesn't know the instances
+	assert.Panics(t, func() { state.GetContext() })
+	assert.Panics(t, func() { state.DeferredEvents() })
+	assert.Panics(t, func() { state.PostEvent(&RelayEvent{}) })
+	assert.Equal(t, StateProxy[RelayContext](state), state.Bind(context.Background()))
+
+	ctx := RelayContext{}
+	sm := def.NewInstance(&ctx)
+	bound := state.Bind(sm.impl.Context())
+	assert.Equal(t, &ctx, bound.GetContext())
+	assert.Equal(t, id, bound.Id())
+}
+
+func BenchmarkNewInstance(b *testing.B) {
+	def := MakeDefinition[SetupCountContext]()
+	def.Build(def.AddState(&CountedState{}))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		def.NewInstance(&SetupCountContext{})
+	}
+}
+
+func BenchmarkMakeStateMachine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sm := MakeStateMachine(&SetupCountContext{})
+		sm.Initialize(sm.AddState(&CountedState{}))
+	}
+}
@@ -0,0 +1,196 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"reflect"
+	"time"
+)
+
+// A reaction resolved for an active state, `state` is the state (the active state or one
+// of its ancestors) that owns the reaction
+type reactionHandler[C any] struct {
+	state    *stateImpl[C]
+	reaction func(contextProvider, Event) ReactionResult
+	defers   bool
+	deferTTL time.Duration
+	umlDoc   []UmlDocReaction
+}
+
+// The precomputed path of a transition: the states to exit (innermost first), the states
+// to enter (outermost first, including the starting states) and the resulting active state
+// (a super state without a starting state when WithSuperStateLeaf is used)
+type transitionPath[C any] struct {
+	exits  []*stateImpl[C]
+	enters []*stateImpl[C]
+	leaf   *stateImpl[C]
+}
+
+type transitionKey[C any] struct {
+	from   *stateImpl[C]
+	to     *stateImpl[C]
+	source *stateImpl[C] // the source state of the transition (nil outside of a reaction)
+	local  bool
+}
+
+// Builds, for every state, the table (event type -> reactions of the state and its ancestors).
+// The reactions are ordered from the state up to the top state, so the dispatcher only has to
+// walk up the list when a reaction returns FORWARD. The table is filled with the event types
+// known from the reactions, the other types (matched by an interface or a wildcard) are added
+// the first time they are dispatched.
+func (d *definitionImpl[C]) buildDispatchTables() {
+	for _, state := range d.states {
+		state.level = calcHierarchyLevel(state)
+	}
+	for _, state := range d.states {
+		state.dispatch = make(map[reflect.Type][]reactionHandler[C])
+		for s := state; s != nil; s = s.parent {
+			for _, r := range s.events {
+				if r.match == matchExact {
+					if _, ok := state.dispatch[r.eventType]; !ok {
+						state.dispatch[r.eventType] = state.resolveHandlers(r.eventType)
+					}
+				}
+			}
+		}
+	}
+	d.transitions = make(map[transitionKey[C]]*transitionPath[C])
+}
+
+// Returns the reactions that handle the event type `eventType`, from the state up to the top state.
+// In each state the exact type reaction is selected first, then the first interface reaction,
+// then the first any event reaction.
+func (s *stateImpl[C]) resolveHandlers(eventType reflect.Type) []reactionHandler[C] {
+	handlers := []reactionHandler[C]{}
+	for state := s; state != nil; state = state.parent {
+		if i := state.selectReaction(eventType); i >= 0 && state.events[i].reaction != nil {
+			selected := &state.events[i]
+			handlers = append(handlers, reactionHandler[C]{state, selected.reaction, selected.deferred, selected.deferTTL, selected.umlDoc})
+		}
+	}
+	return handlers
+}
+
+// Returns the index of the reaction of the state (not of its ancestors) that handles the
+// event type `eventType`, -1 if there is none
+func (s *stateImpl[C]) selectReaction(eventType reflect.Type) int {
+	selected := -1
+	for i := range s.events {
+		r := &s.events[i]
+		matches := (r.match == matchExact && r.eventType == eventType) ||
+			(r.match == matchInterface && eventType.Implements(r.eventType)) ||
+			r.match == matchAny
+		if matches && (selected < 0 || r.match < s.events[selected].match) {
+			selected = i
+		}
+	}
+	return selected
+}
+
+// Returns the reactions that can handle `event` when `state` is active.
+// The instances of a definition fill the cache concurrently.
+func (s *stateImpl[C]) handlers(event Event) []reactionHandler[C] {
+	eventType := reflect.TypeOf(event)
+	s.definition.cacheMutex.RLock()
+	handlers, ok := s.dispatch[eventType]
+	s.definition.cacheMutex.RUnlock()
+	if !ok {
+		handlers = s.resolveHandlers(eventType)
+		s.definition.cacheMutex.Lock()
+		s.dispatch[eventType] = handlers
+		s.definition.cacheMutex.Unlock()
+	}
+	return handlers
+}
+
+// Returns the handler that defers `event` without running a reaction when `state` is active,
+// nil if the event is not known to be deferred
+func (s *stateImpl[C]) deferringHandler(event Event) *reactionHandler[C] {
+	handlers := s.handlers(event)
+	if len(handlers) > 0 && handlers[0].defers {
+		return &handlers[0]
+	}
+	return nil
+}
+
+// Returns the (cached) path from the active state `from` to the target state `to`.
+// `source` is the source state of the transition, the state owning the reaction (nil for the
+// initial transition and the abort to the error state, the path then goes from `from`)
+// `local` is true for a LOCAL transition
+// The instances of a definition fill the cache concurrently.
+func (d *definitionImpl[C]) transitionPath(from, to, source *stateImpl[C], local bool) *transitionPath[C] {
+	key := transitionKey[C]{from, to, source, local}
+	d.cacheMutex.RLock()
+	path, ok := d.transitions[key]
+	d.cacheMutex.RUnlock()
+	if ok {
+		return path
+	}
+	path = &transitionPath[C]{}
+	// an entry or exit point leads to its target
+	for to.pseudo != notPseudo {
+		if to.redirect == nil {
+			panic("Exit point not wired: " + to.name)
+		}
+		to = to.redirect
+	}
+	var lca *stateImpl[C]
+	switch {
+	case source == nil:
+		lca = findRoot(from, to)
+	case local && isAncestorOrSelf(source, to):
+		// a local transition stays in the source state
+		lca = source
+	case local && isAncestorOrSelf(to, source):
+		// a local transition to an ancestor of the source stays in the target
+		lca = to
+	default:
+		// an external transition exits and re-enters the source: the domain is the innermost
+		// state strictly containing the source and the target
+		lca = source.parent
+		for lca != nil && (lca == to || !isAncestorOrSelf(lca, to)) {
+			lca = lca.parent
+		}
+	}
+	for s := from; s != lca; s = s.parent {
+		path.exits = append(path.exits, s)
+	}
+	path.enters = appendEnters(path.enters, to, lca)
+	path.leaf = to
+	for path.leaf.isSuperState {
+		entry := path.leaf.startingState
+		if path.leaf.subMachineEntry != nil {
+			entry = path.leaf.subMachineEntry
+		}
+		if entry == nil {
+			// the super state is the active leaf, allowed by WithSuperStateLeaf only
+			break
+		}
+		path.enters = appendEnters(path.enters, entry, path.leaf)
+		path.leaf = entry
+	}
+	d.cacheMutex.Lock()
+	d.transitions[key] = path
+	d.cacheMutex.Unlock()
+	return path
+}
+
+// Returns true if `state` is `ancestor` or one of its sub-states
+func isAncestorOrSelf[C any](ancestor, state *stateImpl[C]) bool {
+	for ; state != nil; state = state.parent {
+		if state == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends the states from below `root` down to `state` (outermost first)
+func appendEnters[C any](enters []*stateImpl[C], state *stateImpl[C], root *stateImpl[C]) []*stateImpl[C] {
+	if state == root {
+		return enters
+	}
+	enters = appendEnters(enters, state.parent, root)
+	return append(enters, state)
+}
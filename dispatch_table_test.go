@@ -0,0 +1,201 @@
+package statechart
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ForwardContext struct {
+	calls string
+}
+
+type ForwardParent struct {
+	StateDefault[ForwardContext]
+}
+
+func (s *ForwardParent) Setup(proxy StateSetupProxy[ForwardContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	SetStartingState[ForwardChild](proxy)
+	AddInStateReaction(proxy, func(e *TestEvent) { s.GetContext().calls += "Parent " })
+	return nil, nil
+}
+
+type ForwardChild struct {
+	StateDefault[ForwardContext]
+}
+
+func (s *ForwardChild) Setup(proxy StateSetupProxy[ForwardContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *TestEvent) ReactionResult {
+		s.GetContext().calls += "Child "
+		return proxy.Forward()
+	})
+	return nil, nil
+}
+
+func TestDispatchTableForward(t *testing.T) {
+	ctx := ForwardContext{}
+	sm := stateMachineImpl[ForwardContext]{userContext: &ctx}
+	parentId := sm.AddState(&ForwardParent{})
+	childId := sm.AddSubState(&ForwardChild{}, parentId)
+	sm.Initialize(parentId)
+	assert.Equal(t, childId, sm.currentState.id)
+	assert.Len(t, sm.currentState.handlers(&TestEvent{}), 2)
+	assert.Len(t, sm.currentState.handlers(&OnEvent{}), 0)
+
+	sm.DispatchEvent(&TestEvent{})
+	assert.Equal(t, "Child Parent ", ctx.calls)
+	// unknown events are discarded
+	sm.DispatchEvent(&OnEvent{})
+	assert.Equal(t, childId, sm.currentState.id)
+}
+
+func TestTransitionPathCache(t *testing.T) {
+	ctx := OnOffTestContext{}
+	ctx.OffEnter.ResetNoLimit(t)
+	ctx.OffExit.ResetNoLimit(t)
+	ctx.OnEnter.ResetNoLimit(t)
+	ctx.OnExit.ResetNoLimit(t)
+	ctx.OnToOffAction.ResetNoLimit(t)
+	sm := MakeOnOffStateMachine(t, &ctx)
+	sm.Initialize(ctx.OffId)
+
+	assert.Equal(t, 1, sm.states[ctx.OnId].level)
+	assert.Equal(t, 2, sm.states[ctx.OffDefaultId].level)
+
+	sm.DispatchEvent(&OnEvent{})
+	sm.DispatchEvent(&OffEvent{})
+	sm.DispatchEvent(&OnEvent{})
+	// initial path, OffDefault -> On, On -> Off
+	assert.Len(t, sm.transitions, 3)
+
+	path := sm.transitionPath(sm.states[ctx.OnId], sm.states[ctx.OffId], sm.states[ctx.OnId], false)
+	assert.Equal(t, []*stateImpl[OnOffTestContext]{sm.states[ctx.OnId]}, path.exits)
+	assert.Equal(t, []*stateImpl[OnOffTestContext]{sm.states[ctx.OffId], sm.states[ctx.OffDefaultId]}, path.enters)
+	assert.Equal(t, sm.states[ctx.OffDefaultId], path.leaf)
+}
+
+type ToggleState1 struct {
+	StateDefault[int]
+}
+
+func (s *ToggleState1) Setup(proxy StateSetupProxy[int]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[ToggleEvent, ToggleState2](proxy, func(e *ToggleEvent) { *proxy.GetContext() += 1 })
+	return nil, nil
+}
+
+type ToggleState2 struct {
+	StateDefault[int]
+}
+
+func (s *ToggleState2) Setup(proxy StateSetupProxy[int]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[ToggleEvent, ToggleState1](proxy, nil)
+	AddInStateReaction(proxy, func(e *TestEvent) { *proxy.GetContext() += 1 })
+	return nil, nil
+}
+
+type ToggleSuper struct {
+	StateDefault[int]
+}
+
+func (s *ToggleSuper) Setup(proxy StateSetupProxy[int]) (EntryAction, ExitAction) {
+	SetStartingState[ToggleState1](proxy)
+	AddDiscard[OnEvent](proxy)
+	return nil, nil
+}
+
+func makeToggleStateMachine(ctx *int) *stateMachineImpl[int] {
+	sm := &stateMachineImpl[int]{userContext: ctx}
+	superId := sm.AddState(&ToggleSuper{})
+	sm.AddSubState(&ToggleState1{}, superId)
+	sm.AddSubState(&ToggleState2{}, superId)
+	sm.Initialize(superId)
+	return sm
+}
+
+func TestDispatchZeroAllocations(t *testing.T) {
+	ctx := 0
+	sm := makeToggleStateMachine(&ctx)
+	toggle := &ToggleEvent{}
+	test := &TestEvent{}
+	on := &OnEvent{}
+	allocs := testing.AllocsPerRun(100, func() {
+		sm.DispatchEvent(toggle)
+		sm.DispatchEvent(test)
+		sm.DispatchEvent(on)
+		sm.DispatchEvent(toggle)
+	})
+	assert.Equal(t, 0.0, allocs)
+	assert.Equal(t, 202, ctx)
+}
+
+func BenchmarkDispatchTransition(b *testing.B) {
+	ctx := 0
+	sm := makeToggleStateMachine(&ctx)
+	toggle := &ToggleEvent{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.DispatchEvent(toggle)
+	}
+}
+
+func BenchmarkDispatchForwardToParent(b *testing.B) {
+	ctx := 0
+	sm := makeToggleStateMachine(&ctx)
+	on := &OnEvent{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.DispatchEvent(on)
+	}
+}
+
+func BenchmarkDispatchUnhandled(b *testing.B) {
+	ctx := 0
+	sm := makeToggleStateMachine(&ctx)
+	off := &OffEvent{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.DispatchEvent(off)
+	}
+}
+
+// Records the actions and the state changes
+type ActionRecorder struct {
+	ObserverDefault
+	steps []string
+}
+
+func (o *ActionRecorder) OnAction(event Event, state StateId, action string) {
+	o.steps = append(o.steps, "action "+action)
+}
+
+func (o *ActionRecorder) OnStateExited(state StateId) {
+	o.steps = append(o.steps, "exit")
+}
+
+func (o *ActionRecorder) OnStateEntered(state StateId) {
+	o.steps = append(o.steps, "enter")
+}
+
+func TestObserverOnAction(t *testing.T) {
+	ctx := 0
+	sm := makeToggleStateMachine(&ctx)
+	observer := &ActionRecorder{}
+	sm.observers.add(observer)
+	// the transition action runs between the exit and the entry
+	sm.DispatchEvent(&ToggleEvent{})
+	assert.Equal(t, []string{"exit", "action WithAction", "enter"}, observer.steps)
+	// the in-state action
+	observer.steps = nil
+	sm.DispatchEvent(&TestEvent{})
+	assert.Equal(t, []string{"action WithAction"}, observer.steps)
+	// a transition without action
+	observer.steps = nil
+	sm.DispatchEvent(&ToggleEvent{})
+	assert.Equal(t, []string{"exit", "enter"}, observer.steps)
+	assert.Equal(t, 2, ctx)
+}
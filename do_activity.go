@@ -0,0 +1,112 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+	"time"
+)
+
+// The do-activity of a state: the work done while the state is active, e.g. polling a device.
+// It is started after the entry action of the state and canceled before its exit action (see
+// StateSetupProxy.SetDoActivity). It runs in its own goroutine and waits with Sleep, so in a
+// Simulation it runs on the virtual clock.
+// `ctx` the context of the activity, done when the state is exited or the machine is stopped.
+// It is bound to the instance (see StateProxy.Bind).
+// returns the event dispatched to the state machine when the activity completes (nil for none),
+// it is dropped if the state was exited
+type DoActivity func(ctx context.Context) Event
+
+func (s *stateImpl[C]) SetDoActivity(activity DoActivity) {
+	if s.doActivity != nil {
+		panic("The state has two do-activities")
+	}
+	s.doActivity = activity
+}
+
+// Runs the do-activities of a state machine, see Simulation. The default runs them in goroutines.
+type activityRunner interface {
+	// Runs `activity` with `ctx`, then calls `done` with the event it returned
+	run(ctx context.Context, activity DoActivity, done func(Event))
+}
+
+// the key of the sleeper of a do-activity in its context (see Sleep)
+type sleeperKey struct{}
+
+// Waits in a do-activity, on the virtual clock in a Simulation
+// `ctx` the context of the do-activity
+// `d` the duration to wait
+// returns ctx.Err() if the activity is canceled while waiting
+func Sleep(ctx context.Context, d time.Duration) error {
+	if sleeper, ok := ctx.Value(sleeperKey{}).(interface{ sleep(time.Duration) error }); ok {
+		return sleeper.sleep(d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Starts the do-activity of an entered state, the activities are not started while the event
+// log is replayed (see resumeActivities)
+func (sm *stateMachineImpl[C]) startActivity(state *stateImpl[C]) {
+	if state.doActivity == nil || sm.replaying || sm.stopped {
+		return
+	}
+	if sm.activities == nil {
+		sm.activities = make([]context.CancelFunc, len(sm.states))
+	} else if sm.activities[state.id] != nil {
+		return
+	}
+	// like the context of the actions, the context is bound to the instance
+	ctx := context.Background()
+	if sm.owner != sm {
+		ctx = context.WithValue(ctx, instanceKey{}, sm)
+	}
+	ctx, sm.activities[state.id] = context.WithCancel(ctx)
+	done := func(event Event) {
+		if event != nil {
+			sm.dispatch(queuedEvent{event: event, activity: ctx})
+		}
+	}
+	if sm.activityRunner != nil {
+		sm.activityRunner.run(ctx, state.doActivity, done)
+		return
+	}
+	go func(activity DoActivity) {
+		done(activity(ctx))
+	}(state.doActivity)
+}
+
+// Cancels the do-activity of a state that is exited
+func (sm *stateMachineImpl[C]) stopActivity(state *stateImpl[C]) {
+	if sm.activities != nil && sm.activities[state.id] != nil {
+		sm.activities[state.id]()
+		sm.activities[state.id] = nil
+	}
+}
+
+// Cancels all the do-activities, when the state machine is stopped
+func (sm *stateMachineImpl[C]) stopActivities() {
+	for _, state := range sm.states {
+		sm.stopActivity(state)
+	}
+}
+
+// Starts the do-activities of the active configuration, after it was restored from a snapshot
+// or rebuilt from the event log
+func (sm *stateMachineImpl[C]) resumeActivities() {
+	var active []*stateImpl[C]
+	for state := sm.currentState; state != nil; state = state.parent {
+		active = append(active, state)
+	}
+	// the outer states first, like their entry actions
+	for i := len(active) - 1; i >= 0; i-- {
+		sm.startActivity(active[i])
+	}
+}
@@ -0,0 +1,137 @@
+package statechart
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type PollContext struct {
+	interval time.Duration
+	limit    int32
+	polls    int32
+	// the time of the polls, in a simulation
+	sim *Simulation[PollContext]
+	log string
+}
+
+type PollStartEvent struct {
+	EventDefault
+}
+
+type PollCancelEvent struct {
+	EventDefault
+}
+
+type PollDoneEvent struct {
+	EventDefault
+}
+
+type PollIdle struct {
+	StateDefault[PollContext]
+}
+
+func (s *PollIdle) Setup(proxy StateSetupProxy[PollContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[PollStartEvent, PollRunning](proxy, nil)
+	return nil, nil
+}
+
+type PollRunning struct {
+	StateDefault[PollContext]
+}
+
+func (s *PollRunning) Setup(proxy StateSetupProxy[PollContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	ctx := s.GetContext()
+	proxy.SetDoActivity(func(activity context.Context) Event {
+		for {
+			if err := Sleep(activity, ctx.interval); err != nil {
+				return &PollDoneEvent{}
+			}
+			if ctx.sim != nil {
+				ctx.log += ctx.sim.Now().Format("15:04:05") + " poll\n"
+			}
+			if atomic.AddInt32(&ctx.polls, 1) == ctx.limit {
+				return &PollDoneEvent{}
+			}
+		}
+	})
+	AddSimpleStateTransition[PollDoneEvent, PollIdle](proxy, nil)
+	AddSimpleStateTransition[PollCancelEvent, PollIdle](proxy, nil)
+	return nil, nil
+}
+
+type ActivityObserver struct {
+	ObserverDefault
+	dropped chan DroppedEvent
+}
+
+func (o *ActivityObserver) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+	o.dropped <- DroppedEvent{event, reason}
+}
+
+// The machine is initialized by the test, after the simulation is created
+func makePollStateMachine(ctx *PollContext, options ...Option) *StateMachine[PollContext] {
+	sm := MakeStateMachine(ctx, options...)
+	sm.AddState(&PollIdle{})
+	sm.AddState(&PollRunning{})
+	return &sm
+}
+
+func TestDoActivity(t *testing.T) {
+	ctx := PollContext{interval: time.Millisecond, limit: 3}
+	sm := makePollStateMachine(&ctx)
+	sm.Initialize(FindState[PollIdle](sm))
+	sm.DispatchEvent(&PollStartEvent{})
+	// the event returned by the activity leaves the state
+	assert.Eventually(t, func() bool { return sm.Configuration()[0].Name == "PollIdle" }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ctx.polls))
+}
+
+func TestDoActivityCanceled(t *testing.T) {
+	ctx := PollContext{interval: time.Hour, limit: 3}
+	observer := &ActivityObserver{dropped: make(chan DroppedEvent, 1)}
+	sm := makePollStateMachine(&ctx, WithObserver(observer))
+	sm.Initialize(FindState[PollIdle](sm))
+	sm.DispatchEvent(&PollStartEvent{})
+	sm.DispatchEvent(&PollCancelEvent{})
+	// the activity is canceled on the exit, the event it returns is dropped
+	select {
+	case dropped := <-observer.dropped:
+		assert.IsType(t, &PollDoneEvent{}, dropped.event)
+		assert.Equal(t, DROP_CONTEXT_DONE, dropped.reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the activity was not canceled")
+	}
+	assert.Equal(t, "PollIdle", sm.Configuration()[0].Name)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ctx.polls))
+}
+
+func TestDoActivitySimulation(t *testing.T) {
+	ctx := PollContext{interval: 10 * time.Second, limit: 3}
+	sm := makePollStateMachine(&ctx)
+	ctx.sim = NewSimulation(sm, time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC))
+	sm.Initialize(FindState[PollIdle](sm))
+	sm.DispatchEvent(&PollStartEvent{})
+	// the activity runs on the virtual clock
+	assert.Equal(t, 0, ctx.sim.Advance(25*time.Second))
+	assert.Equal(t, int32(2), ctx.polls)
+	assert.Equal(t, 1, ctx.sim.Pending())
+	assert.Equal(t, "PollRunning", sm.Configuration()[0].Name)
+	ctx.sim.Advance(5 * time.Second)
+	assert.Equal(t, "PollIdle", sm.Configuration()[0].Name)
+	assert.Equal(t, "08:00:10 poll\n08:00:20 poll\n08:00:30 poll\n", ctx.log)
+
+	// the activity is canceled on the exit, and returns on the next Advance
+	sm.DispatchEvent(&PollStartEvent{})
+	ctx.sim.Advance(15 * time.Second)
+	sm.DispatchEvent(&PollCancelEvent{})
+	ctx.sim.Advance(time.Hour)
+	assert.Equal(t, int32(4), ctx.polls)
+	assert.Equal(t, 0, ctx.sim.Pending())
+	assert.Equal(t, "PollIdle", sm.Configuration()[0].Name)
+}
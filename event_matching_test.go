@@ -0,0 +1,152 @@
+package statechart
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ErrorEvent interface {
+	Event
+	Error() string
+}
+
+type TimeoutErrorEvent struct {
+	EventDefault
+}
+
+func (*TimeoutErrorEvent) Error() string {
+	return "timeout"
+}
+
+type IoErrorEvent struct {
+	EventDefault
+}
+
+func (*IoErrorEvent) Error() string {
+	return "io"
+}
+
+type OtherEvent struct {
+	EventDefault
+}
+
+type MatchingContext struct {
+	log string
+}
+
+type MatchingParent struct {
+	StateDefault[MatchingContext]
+}
+
+func (s *MatchingParent) Setup(proxy StateSetupProxy[MatchingContext]) (EntryAction, ExitAction) {
+	SetStartingState[MatchingChild](proxy)
+	AddAnyEventReaction(proxy, func(e Event) ReactionResult {
+		proxy.GetContext().log += "Parent(any) "
+		return proxy.Discard()
+	})
+	AddInterfaceReaction(proxy, func(e ErrorEvent) ReactionResult {
+		return TransitWithAction[MatchingFailed, MatchingContext](proxy, func(e *IoErrorEvent) {})
+	}, UmlDocReaction{TRANSIT, FindStateId[MatchingFailed, MatchingContext](proxy), "", ""})
+	return nil, nil
+}
+
+type MatchingChild struct {
+	StateDefault[MatchingContext]
+}
+
+func (s *MatchingChild) Setup(proxy StateSetupProxy[MatchingContext]) (EntryAction, ExitAction) {
+	// declared before the exact reaction, the exact reaction still takes precedence
+	AddInterfaceReaction(proxy, func(e ErrorEvent) ReactionResult {
+		proxy.GetContext().log += "Child(" + e.Error() + ") "
+		if _, ok := e.(*IoErrorEvent); ok {
+			return proxy.Forward()
+		}
+		return proxy.Discard()
+	})
+	AddInStateReaction(proxy, func(e *TimeoutErrorEvent) {
+		proxy.GetContext().log += "Child(exact) "
+	})
+	return nil, nil
+}
+
+type MatchingFailed struct {
+	StateDefault[MatchingContext]
+}
+
+func (s *MatchingFailed) Setup(proxy StateSetupProxy[MatchingContext]) (EntryAction, ExitAction) {
+	AddAnyEventReaction(proxy, func(e Event) ReactionResult {
+		proxy.GetContext().log += "Failed(any) "
+		return proxy.Discard()
+	})
+	return func() { proxy.GetContext().log += "Failed() " }, nil
+}
+
+func makeMatchingStateMachine(ctx *MatchingContext) *stateMachineImpl[MatchingContext] {
+	sm := &stateMachineImpl[MatchingContext]{userContext: ctx}
+	parentId := sm.AddState(&MatchingParent{})
+	sm.AddSubState(&MatchingChild{}, parentId)
+	sm.AddState(&MatchingFailed{})
+	sm.Initialize(parentId)
+	return sm
+}
+
+func TestEventMatchingPrecedence(t *testing.T) {
+	ctx := MatchingContext{}
+	sm := makeMatchingStateMachine(&ctx)
+	// exact before interface
+	sm.DispatchEvent(&TimeoutErrorEvent{})
+	assert.Equal(t, "Child(exact) ", ctx.log)
+	// no reaction in the child, wildcard in the parent
+	ctx.log = ""
+	sm.DispatchEvent(&OtherEvent{})
+	assert.Equal(t, "Parent(any) ", ctx.log)
+	// interface in the child, forwarded to the parent interface before the parent wildcard
+	ctx.log = ""
+	sm.DispatchEvent(&IoErrorEvent{})
+	assert.Equal(t, "Child(io) Failed() ", ctx.log)
+	assert.Equal(t, "MatchingFailed", sm.currentState.name)
+	ctx.log = ""
+	sm.DispatchEvent(&TimeoutErrorEvent{})
+	assert.Equal(t, "Failed(any) ", ctx.log)
+}
+
+func TestEventMatchingTableCache(t *testing.T) {
+	ctx := MatchingContext{}
+	sm := makeMatchingStateMachine(&ctx)
+	child := sm.currentState
+	_, known := child.dispatch[typeOfEvent(&TimeoutErrorEvent{})]
+	assert.True(t, known)
+	_, known = child.dispatch[typeOfEvent(&IoErrorEvent{})]
+	assert.False(t, known)
+	sm.DispatchEvent(&OtherEvent{})
+	handlers, known := child.dispatch[typeOfEvent(&OtherEvent{})]
+	assert.True(t, known)
+	assert.Len(t, handlers, 1)
+
+	allocs := testing.AllocsPerRun(10, func() { sm.DispatchEvent(&OtherEvent{}) })
+	// the event itself
+	assert.Equal(t, 1.0, allocs)
+}
+
+func TestInterfaceReactionRequiresInterface(t *testing.T) {
+	assert.Panics(t, func() {
+		MakeInterfaceEventReaction(func(e *OtherEvent) ReactionResult { return ReactionResult{} })
+	})
+}
+
+func TestEventMatchingUml(t *testing.T) {
+	ctx := MatchingContext{}
+	sm := makeMatchingStateMachine(&ctx)
+	buffer := bytes.Buffer{}
+	sm.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	assert.Contains(t, buffer.String(), "MatchingParent -> MatchingFailed : ErrorEvent\n")
+	assert.Contains(t, buffer.String(), "MatchingFailed: any[] / Custom(TODO) \n")
+	assert.Contains(t, buffer.String(), "MatchingChild: ErrorEvent[] / Custom(TODO) \n")
+}
+
+func typeOfEvent(e Event) reflect.Type {
+	return reflect.TypeOf(e)
+}
@@ -0,0 +1,81 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+	"time"
+)
+
+// The metadata of a dispatched or posted event.
+// The sender can set the ID, the correlation ID and the source in the context of the dispatch
+// (see ContextWithEventMetadata), the state machine fills the missing fields. The metadata is
+// kept with the queued event, not in the event object: an event can be dispatched again, or to
+// several machines at the same time. The reactions read the metadata of the event being
+// processed with StateProxy.EventMetadata, the observers receive it.
+type EventMetadata struct {
+	// the ID of the event (see WithEventIdGenerator)
+	ID string
+	// the ID shared by all the events of the same request, inherited by the posted events
+	CorrelationID string
+	// the ID of the event being processed when the event was posted
+	CausationID string
+	// the sender of the event, the name of the posting state for the posted events
+	Source string
+	// when the event was dispatched or posted
+	EnqueuedAt time.Time
+	// when the event was last processed (it is processed again after being deferred)
+	DispatchedAt time.Time
+}
+
+// Returns the metadata of the event being processed
+func (s *stateImpl[C]) EventMetadata() EventMetadata {
+	if sm := s.definition.owner; sm != nil {
+		return sm.currentMetadata
+	}
+	return EventMetadata{}
+}
+
+type eventMetadataKey struct{}
+
+// Returns a copy of the context carrying the metadata set by the sender of an event, for
+// DispatchEventContext. The state machine fills the missing IDs, and sets the times.
+// `ctx` the context of the dispatch
+// `metadata` the metadata of the event, e.g. EventMetadata{CorrelationID: requestId}
+func ContextWithEventMetadata(ctx context.Context, metadata EventMetadata) context.Context {
+	return context.WithValue(ctx, eventMetadataKey{}, metadata)
+}
+
+// Fills the metadata of a dispatched event: the fields set by the sender in the context of
+// the dispatch, then the missing ones
+func (sm *stateMachineImpl[C]) enqueued(event *queuedEvent) {
+	if event.enqueued {
+		return
+	}
+	if event.ctx != nil {
+		if metadata, ok := event.ctx.Value(eventMetadataKey{}).(EventMetadata); ok {
+			event.metadata = metadata
+		}
+	}
+	sm.stamp(event)
+}
+
+// Sets the enqueue time and the missing ID of an event that is dispatched or posted
+func (sm *stateMachineImpl[C]) stamp(event *queuedEvent) {
+	event.enqueued = true
+	event.metadata.EnqueuedAt = sm.now()
+	if event.metadata.ID == "" && sm.eventIdGenerator != nil {
+		event.metadata.ID = sm.eventIdGenerator()
+	}
+}
+
+// Fills the causation of a posted event from the event being processed
+func (sm *stateMachineImpl[C]) inheritMetadata(metadata *EventMetadata, cause *EventMetadata) {
+	if metadata.CausationID == "" {
+		metadata.CausationID = cause.ID
+	}
+	if metadata.CorrelationID == "" {
+		metadata.CorrelationID = cause.CorrelationID
+	}
+}
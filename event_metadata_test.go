@@ -0,0 +1,165 @@
+package statechart
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type TransitionRecorder struct {
+	ObserverDefault
+	transitions []EventMetadata
+}
+
+func (o *TransitionRecorder) OnTransition(event Event, metadata EventMetadata, from StateId, to StateId) {
+	o.transitions = append(o.transitions, metadata)
+}
+
+func sequenceIdGenerator() func() string {
+	next := 0
+	return func() string {
+		next++
+		return "evt-" + strconv.Itoa(next)
+	}
+}
+
+func TestEventMetadata(t *testing.T) {
+	ctx := RequestContext{}
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	observer := TransitionRecorder{}
+	sm := makeRequestStateMachine(&ctx, WithClock(&clock), WithObserver(&observer),
+		WithEventIdGenerator(sequenceIdGenerator()))
+	sender := ContextWithEventMetadata(context.Background(), EventMetadata{CorrelationID: "order-7", Source: "api"})
+	sm.DispatchEventContext(sender, &SubmitEvent{})
+
+	assert.Len(t, observer.transitions, 1)
+	assert.Equal(t, EventMetadata{ID: "evt-1", CorrelationID: "order-7", Source: "api",
+		EnqueuedAt: clock.now, DispatchedAt: clock.now}, observer.transitions[0])
+}
+
+type MetadataLog struct {
+	StateDefault[RequestContext]
+	posted []EventMetadata
+}
+
+func (s *MetadataLog) Setup(proxy StateSetupProxy[RequestContext]) (EntryAction, ExitAction) {
+	AddCustomStateReaction(proxy, func(e *SubmitEvent) ReactionResult {
+		s.posted = append(s.posted, proxy.EventMetadata())
+		proxy.PostEvent(&AuditEvent{})
+		return proxy.Discard()
+	})
+	AddCustomStateReaction(proxy, func(e *AuditEvent) ReactionResult {
+		s.posted = append(s.posted, proxy.EventMetadata())
+		return proxy.Discard()
+	})
+	return nil, nil
+}
+
+func TestPostedEventInheritsCausation(t *testing.T) {
+	ctx := RequestContext{}
+	sm := MakeStateMachine(&ctx, WithEventIdGenerator(sequenceIdGenerator()))
+	state := &MetadataLog{}
+	sm.Initialize(sm.AddState(state))
+	sender := ContextWithEventMetadata(context.Background(), EventMetadata{CorrelationID: "order-7"})
+	sm.DispatchEventContext(sender, &SubmitEvent{})
+
+	assert.Len(t, state.posted, 2)
+	assert.Equal(t, "evt-1", state.posted[0].ID)
+	posted := state.posted[1]
+	assert.Equal(t, "evt-2", posted.ID)
+	assert.Equal(t, "evt-1", posted.CausationID)
+	assert.Equal(t, "order-7", posted.CorrelationID)
+	assert.Equal(t, "MetadataLog", posted.Source)
+	assert.False(t, posted.DispatchedAt.IsZero())
+	// outside of a run-to-completion step
+	assert.Equal(t, EventMetadata{}, sm.impl.states[0].EventMetadata())
+}
+
+func TestEventMetadataWithoutGenerator(t *testing.T) {
+	ctx := RequestContext{}
+	observer := TransitionRecorder{}
+	sm := makeRequestStateMachine(&ctx, WithObserver(&observer))
+	sm.DispatchEvent(&SubmitEvent{})
+	assert.Len(t, observer.transitions, 1)
+	assert.Empty(t, observer.transitions[0].ID)
+	assert.False(t, observer.transitions[0].EnqueuedAt.IsZero())
+}
+
+func TestEventDispatchedAgain(t *testing.T) {
+	ctx := RequestContext{}
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	sm := MakeStateMachine(&ctx, WithClock(&clock), WithEventIdGenerator(sequenceIdGenerator()))
+	state := &MetadataLog{}
+	sm.Initialize(sm.AddState(state))
+	event := &SubmitEvent{}
+	sm.DispatchEvent(event)
+	clock.now = clock.now.Add(time.Second)
+	sm.DispatchEvent(event)
+
+	// each dispatch gets its own ID and times
+	assert.Len(t, state.posted, 4)
+	assert.Equal(t, "evt-1", state.posted[0].ID)
+	assert.Equal(t, "evt-3", state.posted[2].ID)
+	assert.Empty(t, state.posted[2].CausationID)
+	assert.Equal(t, clock.now, state.posted[2].EnqueuedAt)
+}
+
+type MetadataCount struct {
+	StateDefault[RequestContext]
+}
+
+func (s *MetadataCount) Setup(proxy StateSetupProxy[RequestContext]) (EntryAction, ExitAction) {
+	AddDiscard[SubmitEvent](proxy)
+	return nil, nil
+}
+
+type DroppedIds struct {
+	ObserverDefault
+	ids []string
+}
+
+func (o *DroppedIds) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+	o.ids = append(o.ids, metadata.ID)
+}
+
+func TestEventSharedByInstances(t *testing.T) {
+	def := MakeDefinition[RequestContext]()
+	def.Build(def.AddState(&MetadataCount{}))
+	event := &SubmitEvent{}
+	// the canceled dispatches are reported with their metadata
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan []string)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			observer := &DroppedIds{}
+			instance := def.NewInstance(&RequestContext{}, WithObserver(observer),
+				WithEventIdGenerator(func() string { return "evt-" + strconv.Itoa(i) }))
+			instance.DispatchEventContext(canceled, event)
+			done <- observer.ids
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		ids := <-done
+		assert.Len(t, ids, 1)
+		assert.NotEmpty(t, ids[0])
+	}
+}
+
+func TestEventMetadataDebugLogger(t *testing.T) {
+	ctx := RequestContext{}
+	sm := makeRequestStateMachine(&ctx, WithEventIdGenerator(sequenceIdGenerator()))
+	var logged []any
+	sm.impl.DebugLogger = func(msg string, args ...any) {
+		if msg == "Process Event" {
+			logged = args
+		}
+	}
+	sm.DispatchEvent(&SubmitEvent{})
+	assert.Contains(t, logged, "evt-2")
+	assert.Contains(t, logged, "evt-1")
+	assert.Contains(t, logged, "Submitted")
+}
@@ -0,0 +1,126 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+	"time"
+)
+
+// An event in a queue with its bookkeeping
+type queuedEvent struct {
+	event Event
+	// the context of the dispatch (nil for context.Background)
+	ctx context.Context
+	// true once the event was deferred, a replayed deferred event can be deferred again
+	deferred bool
+	// when the event was first deferred
+	deferredAt time.Time
+	// time to live while deferred (0 for no limit)
+	deferTTL time.Duration
+	// the metadata of this dispatch or post, the event object is not modified
+	metadata EventMetadata
+	// true once the metadata is filled (see enqueued)
+	enqueued bool
+	// true for a recorded event replayed: its enqueue time is the machine time during its step
+	replayed bool
+	// the context of the do-activity that returned the event (nil for the other events), the
+	// event is dropped if the activity was canceled
+	activity context.Context
+}
+
+// Returns true if the event is deferred for longer than its time to live
+func (e *queuedEvent) expired(now time.Time) bool {
+	return e.deferTTL > 0 && now.Sub(e.deferredAt) >= e.deferTTL
+}
+
+// A double-ended FIFO of events backed by a ring buffer.
+// The buffer doubles when full and is never shrunk, so once a machine has reached its
+// steady state, queuing events does not allocate.
+type eventQueue struct {
+	buffer []queuedEvent
+	head   int
+	size   int
+}
+
+const eventQueueMinCapacity = 8
+
+// Returns the number of queued events
+func (q *eventQueue) len() int {
+	return q.size
+}
+
+// Returns the i-th event from the front
+func (q *eventQueue) at(i int) queuedEvent {
+	if i < 0 || i >= q.size {
+		panic("eventQueue index out of range")
+	}
+	return q.buffer[(q.head+i)%len(q.buffer)]
+}
+
+// Adds an event at the back of the queue
+func (q *eventQueue) pushBack(event queuedEvent) {
+	if q.size == len(q.buffer) {
+		q.grow()
+	}
+	q.buffer[(q.head+q.size)%len(q.buffer)] = event
+	q.size++
+}
+
+// Adds an event at the front of the queue
+func (q *eventQueue) pushFront(event queuedEvent) {
+	if q.size == len(q.buffer) {
+		q.grow()
+	}
+	q.head = (q.head - 1 + len(q.buffer)) % len(q.buffer)
+	q.buffer[q.head] = event
+	q.size++
+}
+
+// Removes and returns the event at the front of the queue
+func (q *eventQueue) popFront() queuedEvent {
+	if q.size == 0 {
+		panic("eventQueue is empty")
+	}
+	event := q.buffer[q.head]
+	// release the reference for the GC
+	q.buffer[q.head] = queuedEvent{}
+	q.head = (q.head + 1) % len(q.buffer)
+	q.size--
+	return event
+}
+
+// Moves all the events of `other` in front of this queue, keeping their order.
+// `other` is empty after the call
+func (q *eventQueue) prependAll(other *eventQueue) {
+	for other.size > 0 {
+		last := (other.head + other.size - 1) % len(other.buffer)
+		q.pushFront(other.buffer[last])
+		other.buffer[last] = queuedEvent{}
+		other.size--
+	}
+	other.head = 0
+}
+
+// Returns a copy of the queued events, front first
+func (q *eventQueue) slice() []Event {
+	events := make([]Event, q.size)
+	for i := range events {
+		events[i] = q.at(i).event
+	}
+	return events
+}
+
+func (q *eventQueue) grow() {
+	newCapacity := 2 * len(q.buffer)
+	if newCapacity < eventQueueMinCapacity {
+		newCapacity = eventQueueMinCapacity
+	}
+	buffer := make([]queuedEvent, newCapacity)
+	for i := 0; i < q.size; i++ {
+		buffer[i] = q.at(i)
+	}
+	q.buffer = buffer
+	q.head = 0
+}
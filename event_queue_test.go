@@ -0,0 +1,208 @@
+package statechart
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type SeqEvent struct {
+	EventDefault
+	n int
+}
+
+type ReleaseEvent struct {
+	EventDefault
+}
+
+type QueueContext struct {
+	received []int
+	limit    int
+}
+
+// Holding defers the SeqEvents until ReleaseEvent
+type Holding struct {
+	StateDefault[QueueContext]
+}
+
+func (s *Holding) Setup(proxy StateSetupProxy[QueueContext]) (EntryAction, ExitAction) {
+	AddDefer[SeqEvent](proxy)
+	AddSimpleStateTransition[ReleaseEvent, Recording](proxy, func(e *ReleaseEvent) {
+		// posted during the transition, it is processed after the deferred events
+		proxy.PostEvent(&SeqEvent{n: -1})
+	})
+	return nil, nil
+}
+
+// Recording records the SeqEvents and posts the next one until the limit is reached
+type Recording struct {
+	StateDefault[QueueContext]
+}
+
+func (s *Recording) Setup(proxy StateSetupProxy[QueueContext]) (EntryAction, ExitAction) {
+	AddInStateReaction(proxy, func(e *SeqEvent) {
+		ctx := proxy.GetContext()
+		ctx.received = append(ctx.received, e.n)
+		if e.n > 0 && e.n < ctx.limit {
+			proxy.PostEvent(&SeqEvent{n: e.n + 1})
+		}
+	})
+	AddSimpleStateTransition[TagEvent, Holding](proxy, nil)
+	return nil, nil
+}
+
+func makeQueueStateMachine(ctx *QueueContext, initial State[QueueContext]) *stateMachineImpl[QueueContext] {
+	sm := &stateMachineImpl[QueueContext]{userContext: ctx}
+	holdingId := sm.AddState(&Holding{})
+	recordingId := sm.AddState(&Recording{})
+	if _, ok := initial.(*Holding); ok {
+		sm.Initialize(holdingId)
+	} else {
+		sm.Initialize(recordingId)
+	}
+	return sm
+}
+
+func TestEventQueueRing(t *testing.T) {
+	q := eventQueue{}
+	events := make([]Event, 20)
+	for i := range events {
+		events[i] = &SeqEvent{n: i}
+	}
+	// wrap around without growing
+	for i := 0; i < 6; i++ {
+		q.pushBack(queuedEvent{event: events[i]})
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, events[i], q.popFront().event)
+	}
+	for i := 6; i < 10; i++ {
+		q.pushBack(queuedEvent{event: events[i]})
+	}
+	assert.Equal(t, 6, q.len())
+	assert.Equal(t, eventQueueMinCapacity, len(q.buffer))
+	// grow while wrapped
+	for i := 10; i < 20; i++ {
+		q.pushBack(queuedEvent{event: events[i]})
+	}
+	assert.Equal(t, 16, q.len())
+	for i := 4; i < 20; i++ {
+		assert.Equal(t, events[i], q.popFront().event)
+	}
+	assert.Equal(t, 0, q.len())
+	assert.Panics(t, func() { q.popFront() })
+}
+
+func TestEventQueuePrepend(t *testing.T) {
+	q := eventQueue{}
+	deferred := eventQueue{}
+	events := make([]Event, 12)
+	for i := range events {
+		events[i] = &SeqEvent{n: i}
+	}
+	for i := 0; i < 5; i++ {
+		deferred.pushBack(queuedEvent{event: events[i]})
+	}
+	for i := 5; i < 12; i++ {
+		q.pushBack(queuedEvent{event: events[i]})
+	}
+	q.pushFront(queuedEvent{event: events[4]})
+	q.popFront()
+	q.prependAll(&deferred)
+	assert.Equal(t, 0, deferred.len())
+	assert.Equal(t, 12, q.len())
+	for i := range events {
+		assert.Equal(t, events[i], q.at(i).event)
+	}
+}
+
+func TestLongPostEventChain(t *testing.T) {
+	ctx := QueueContext{limit: 10000}
+	sm := makeQueueStateMachine(&ctx, &Recording{})
+	sm.DispatchEvent(&SeqEvent{n: 1})
+	assert.Len(t, ctx.received, 10000)
+	for i, n := range ctx.received {
+		assert.Equal(t, i+1, n)
+	}
+	assert.Equal(t, 0, sm.postedEvents.len())
+	// the queue never holds more than the current chain link
+	assert.Equal(t, eventQueueMinCapacity, len(sm.postedEvents.buffer))
+}
+
+func TestManyDeferrals(t *testing.T) {
+	ctx := QueueContext{}
+	sm := makeQueueStateMachine(&ctx, &Holding{})
+	for i := 1; i <= 1000; i++ {
+		sm.DispatchEvent(&SeqEvent{n: i})
+	}
+	assert.Equal(t, 1000, sm.deferredEvents.len())
+	assert.Empty(t, ctx.received)
+
+	sm.DispatchEvent(&ReleaseEvent{})
+	assert.Equal(t, 0, sm.deferredEvents.len())
+	// deferred events first, in the order they were deferred, then the posted event
+	assert.Len(t, ctx.received, 1001)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, i+1, ctx.received[i])
+	}
+	assert.Equal(t, -1, ctx.received[1000])
+}
+
+func TestQueueZeroAllocations(t *testing.T) {
+	ctx := QueueContext{}
+	sm := makeQueueStateMachine(&ctx, &Recording{})
+	events := make([]*SeqEvent, 100)
+	for i := range events {
+		events[i] = &SeqEvent{n: i}
+	}
+	tag := &TagEvent{}
+	release := &ReleaseEvent{}
+	ctx.received = make([]int, 0, 1000)
+	warmup := func() {
+		ctx.received = ctx.received[:0]
+		sm.DispatchEvent(tag)
+		for _, e := range events {
+			sm.DispatchEvent(e)
+		}
+		sm.DispatchEvent(release)
+	}
+	warmup()
+	// the posted event in Holding is the only allocation
+	allocs := testing.AllocsPerRun(10, warmup)
+	assert.Equal(t, 1.0, allocs)
+}
+
+// The allocations reported are the events created by the reaction, the queue does not allocate
+func BenchmarkPostEventChain(b *testing.B) {
+	ctx := QueueContext{limit: 100}
+	sm := makeQueueStateMachine(&ctx, &Recording{})
+	ctx.received = make([]int, 0, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.received = ctx.received[:0]
+		sm.DispatchEvent(&SeqEvent{n: 1})
+	}
+}
+
+func BenchmarkDeferAndReplay(b *testing.B) {
+	ctx := QueueContext{}
+	sm := makeQueueStateMachine(&ctx, &Recording{})
+	events := make([]*SeqEvent, 100)
+	for i := range events {
+		events[i] = &SeqEvent{n: 0}
+	}
+	tag := &TagEvent{}
+	release := &ReleaseEvent{}
+	ctx.received = make([]int, 0, 200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.received = ctx.received[:0]
+		sm.DispatchEvent(tag)
+		for _, e := range events {
+			sm.DispatchEvent(e)
+		}
+		sm.DispatchEvent(release)
+	}
+}
@@ -0,0 +1,181 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// The error returned when decoding an event whose name is not registered
+var ErrUnknownEvent = errors.New("Unknown event")
+
+// A registry of the event types by name, to serialize the events and to declare the event
+// alphabet of a state machine (see SetEventRegistry).
+// The zero value is an empty registry.
+type EventRegistry struct {
+	types map[string]reflect.Type // the event struct types by name
+	names map[reflect.Type]string // the names by event pointer type
+}
+
+// The serialized form of an event
+type eventEnvelope struct {
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Creates an empty event registry
+func MakeEventRegistry() EventRegistry {
+	return EventRegistry{types: map[string]reflect.Type{}, names: map[reflect.Type]string{}}
+}
+
+// Registers an event type under a name
+// `E` the event type
+// `registry` the registry
+// `name` the stable name of the event, used in the serialized events
+func RegisterEvent[E any, PE EventCst[E]](registry *EventRegistry, name string) {
+	if registry.types == nil {
+		*registry = MakeEventRegistry()
+	}
+	eventType := reflect.TypeOf(PE(nil))
+	if _, ok := registry.types[name]; ok {
+		panic("The event name is already registered: " + name)
+	}
+	if _, ok := registry.names[eventType]; ok {
+		panic("The event type is already registered: " + eventType.Elem().Name())
+	}
+	registry.types[name] = eventType.Elem()
+	registry.names[eventType] = name
+}
+
+// Returns the registered names, sorted
+func (r *EventRegistry) Names() []string {
+	names := make([]string, 0, len(r.types))
+	for name := range r.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the name of a registered event
+// `event` the event
+// returns the name, and false if the event type is not registered
+func (r *EventRegistry) Name(event Event) (string, bool) {
+	name, ok := r.names[reflect.TypeOf(event)]
+	return name, ok
+}
+
+// Returns a new event of a registered type
+// `name` the registered name
+// returns ErrUnknownEvent if the name is not registered
+func (r *EventRegistry) NewEvent(name string) (Event, error) {
+	eventType, ok := r.types[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+	}
+	return reflect.New(eventType).Interface().(Event), nil
+}
+
+// Serializes an event in JSON, with its name and its exported fields (the metadata is not
+// serialized)
+// `event` the event
+// returns an error if the event type is not registered
+func (r *EventRegistry) MarshalEvent(event Event) ([]byte, error) {
+	name, ok := r.Name(event)
+	if !ok {
+		return nil, fmt.Errorf("Event type not registered: %v", reflect.TypeOf(event))
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(eventEnvelope{Event: name, Payload: payload})
+}
+
+// Deserializes an event serialized by MarshalEvent
+// `data` the JSON event
+// returns ErrUnknownEvent if the name of the event is not registered
+func (r *EventRegistry) UnmarshalEvent(data []byte) (Event, error) {
+	envelope := eventEnvelope{}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	event, err := r.NewEvent(envelope.Event)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Payload) > 0 {
+		if err := json.Unmarshal(envelope.Payload, event); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+func (d *definitionImpl[C]) setEventRegistry(registry *EventRegistry) {
+	if d.built {
+		panic("Cannot set the event registry after the definition is built")
+	}
+	d.eventRegistry = registry
+}
+
+// The events posted by the state machine itself, they are part of every alphabet
+var machineEventTypes = map[reflect.Type]bool{
+	reflect.TypeOf(&CompletionEvent{}):   true,
+	reflect.TypeOf(&ActionFailedEvent{}): true,
+}
+
+// Returns the findings on the event alphabet: the events handled but not registered, and the
+// events registered but handled by no state
+func (d *definitionImpl[C]) analyzeEvents() []Finding {
+	registry := d.eventRegistry
+	if registry == nil {
+		return nil
+	}
+	var findings []Finding
+	var interfaces []reflect.Type
+	handled := map[reflect.Type]bool{}
+	matchesAny := false
+	for _, state := range d.states {
+		for _, r := range state.events {
+			switch r.match {
+			case matchAny:
+				matchesAny = true
+			case matchInterface:
+				interfaces = append(interfaces, r.eventType)
+			case matchExact:
+				if _, ok := registry.names[r.eventType]; !ok && !machineEventTypes[r.eventType] && !handled[r.eventType] {
+					findings = append(findings, Finding{
+						Kind:    UNDECLARED_EVENT,
+						State:   state.id,
+						Message: fmt.Sprintf("state %s handles the event %s which is not registered", state.name, r.docEventName),
+					})
+				}
+				handled[r.eventType] = true
+			}
+		}
+	}
+	if matchesAny {
+		return findings
+	}
+	for _, name := range registry.Names() {
+		eventType := reflect.PointerTo(registry.types[name])
+		used := handled[eventType]
+		for _, i := range interfaces {
+			used = used || eventType.Implements(i)
+		}
+		if !used {
+			findings = append(findings, Finding{
+				Kind:    UNUSED_EVENT,
+				State:   INVALID_STATE_ID,
+				Message: fmt.Sprintf("the registered event %s is handled by no state", name),
+			})
+		}
+	}
+	return findings
+}
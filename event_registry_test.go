@@ -0,0 +1,89 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeDoorEventRegistry() *EventRegistry {
+	registry := MakeEventRegistry()
+	RegisterEvent[LockEvent](&registry, "door.lock")
+	RegisterEvent[UnlockEvent](&registry, "door.unlock")
+	return &registry
+}
+
+func TestEventRegistryMarshal(t *testing.T) {
+	registry := makeDoorEventRegistry()
+	data, err := registry.MarshalEvent(&UnlockEvent{Code: "1234"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"event":"door.unlock","payload":{"Code":"1234"}}`, string(data))
+
+	event, err := registry.UnmarshalEvent(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &UnlockEvent{Code: "1234"}, event)
+	assert.Equal(t, []string{"door.lock", "door.unlock"}, registry.Names())
+}
+
+func TestEventRegistryErrors(t *testing.T) {
+	registry := makeDoorEventRegistry()
+	_, err := registry.UnmarshalEvent([]byte(`{"event":"door.open","payload":{}}`))
+	assert.ErrorIs(t, err, ErrUnknownEvent)
+	assert.EqualError(t, err, "Unknown event: door.open")
+
+	_, err = registry.MarshalEvent(&SubmitEvent{})
+	assert.EqualError(t, err, "Event type not registered: *statechart.SubmitEvent")
+
+	assert.Panics(t, func() { RegisterEvent[SubmitEvent](registry, "door.lock") })
+	assert.Panics(t, func() { RegisterEvent[LockEvent](registry, "door.lock.again") })
+
+	var empty EventRegistry
+	RegisterEvent[LockEvent](&empty, "door.lock")
+	assert.Equal(t, []string{"door.lock"}, empty.Names())
+}
+
+func TestEventRegistryAnalyze(t *testing.T) {
+	registry := makeDoorEventRegistry()
+	RegisterEvent[SubmitEvent](registry, "request.submit")
+	def := MakeDefinition[DoorContext]()
+	def.SetEventRegistry(registry)
+	def.AddState(&Unlocked{})
+	def.AddState(&Locked{})
+	def.Build(0)
+	findings := def.Analyze()
+	assert.Len(t, findings, 1)
+	assert.Equal(t, UNUSED_EVENT, findings[0].Kind)
+	assert.Equal(t, "UNUSED_EVENT: the registered event request.submit is handled by no state", findings[0].String())
+
+	partial := EventRegistry{}
+	RegisterEvent[LockEvent](&partial, "door.lock")
+	sm := MakeStateMachine(&DoorContext{})
+	sm.SetEventRegistry(&partial)
+	sm.AddState(&Unlocked{})
+	lockedId := sm.AddState(&Locked{})
+	sm.Initialize(0)
+	findings = sm.Analyze()
+	assert.Len(t, findings, 1)
+	assert.Equal(t, UNDECLARED_EVENT, findings[0].Kind)
+	assert.Equal(t, lockedId, findings[0].State)
+}
+
+func makeRegisteredDoorStateMachine(code string) *StateMachine[DoorContext] {
+	sm := MakeStateMachine(&DoorContext{code: code})
+	sm.SetEventRegistry(makeDoorEventRegistry())
+	unlockedId := sm.AddState(&Unlocked{})
+	sm.AddState(&Locked{})
+	sm.Initialize(unlockedId)
+	return &sm
+}
+
+func TestJournalWithEventRegistry(t *testing.T) {
+	journal := &bytes.Buffer{}
+	recorder := NewRecorder(makeRegisteredDoorStateMachine("1234"), journal)
+	assert.NoError(t, recorder.DispatchEvent(&LockEvent{}))
+	assert.NoError(t, recorder.DispatchEvent(&UnlockEvent{Code: "1234"}))
+	assert.Contains(t, journal.String(), `"event":"door.unlock"`)
+	// the events are rebuilt from the registry
+	assert.NoError(t, Replay(journal, makeRegisteredDoorStateMachine("1234")))
+}
@@ -0,0 +1,318 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// The EventLog interface keeps the append-only event logs of the event-sourced state machines
+// (see NewEventSourcedStateMachine)
+type EventLog interface {
+	// Appends a record at the end of a log, the record is durable when Append returns
+	// `key` the key of the state machine
+	// `record` the record, without new line
+	Append(key string, record []byte) error
+	// Reads the records of a log, in the order they were appended
+	// `key` the key of the state machine
+	// `after` the number of records to skip
+	Read(key string, after int) ([][]byte, error)
+}
+
+// An EventLog keeping the records in memory
+type MemoryEventLog struct {
+	records map[string][][]byte
+	mutex   sync.Mutex
+}
+
+// Creates an empty memory event log
+func MakeMemoryEventLog() MemoryEventLog {
+	return MemoryEventLog{records: map[string][][]byte{}}
+}
+
+func (l *MemoryEventLog) Append(key string, record []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.records == nil {
+		l.records = map[string][][]byte{}
+	}
+	l.records[key] = append(l.records[key], append([]byte(nil), record...))
+	return nil
+}
+
+func (l *MemoryEventLog) Read(key string, after int) ([][]byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	records := l.records[key]
+	if after >= len(records) {
+		return nil, nil
+	}
+	return append([][]byte(nil), records[after:]...), nil
+}
+
+// An EventLog keeping each log in a file of a directory, one record per line.
+// A record is synced before Append returns. A last line without new line is the record of an
+// interrupted Append: it is ignored by Read and removed by the next Append.
+type FileEventLog struct {
+	dir string
+}
+
+// Creates a file event log
+// `dir` the directory of the logs, it must exist
+func MakeFileEventLog(dir string) FileEventLog {
+	return FileEventLog{dir: dir}
+}
+
+func (l FileEventLog) path(key string) (string, error) {
+	path, err := FileStore{dir: l.dir}.path(key)
+	if err != nil {
+		return "", err
+	}
+	return path[:len(path)-len(".snapshot")] + ".log", nil
+}
+
+func (l FileEventLog) Append(key string, record []byte) error {
+	if bytes.IndexByte(record, '\n') >= 0 {
+		return errors.New("An event log record cannot contain a new line")
+	}
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := truncateTornRecord(file); err != nil {
+		return err
+	}
+	if _, err := file.Write(append(append([]byte(nil), record...), '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Removes the last line of a log file if it has no new line
+func truncateTornRecord(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := []byte{0}
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	data := make([]byte, info.Size())
+	if _, err := file.ReadAt(data, 0); err != nil {
+		return err
+	}
+	return file.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+}
+
+func (l FileEventLog) Read(key string, after int) ([][]byte, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records [][]byte
+	reader := bufio.NewReader(file)
+	for n := 0; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// the torn record of an interrupted Append is ignored
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if n >= after {
+			records = append(records, line[:len(line)-1])
+		}
+	}
+}
+
+// Returns true while the event log is replayed
+func (s *stateImpl[C]) IsReplaying() bool {
+	sm := s.definition.owner
+	return sm != nil && sm.replaying
+}
+
+// A record of the event log
+type eventLogRecord struct {
+	// the event serialized by the event registry (see EventRegistry.MarshalEvent)
+	Event    json.RawMessage `json:"event"`
+	Metadata EventMetadata   `json:"metadata"`
+}
+
+// A state machine appending each event to an EventLog before processing it, and rebuilt from
+// its log by replaying the events: the state is never saved, except in the optional snapshots
+// that shorten the replay (see SetSnapshots).
+// During the replay, StateProxy.IsReplaying returns true, the actions should then skip their
+// external effects. The machine time during the step of a replayed event is its enqueue time,
+// so the deferral TTLs expire as they did. The events are serialized with the event registry (see SetEventRegistry),
+// and must all be dispatched through the event-sourced state machine.
+type EventSourcedStateMachine[C any] struct {
+	machine       *StateMachine[C]
+	log           EventLog
+	key           string
+	seq           int
+	snapshots     snapshotConfig[C]
+	snapshotEvery int
+	mutex         sync.Mutex
+}
+
+// Creates an event-sourced state machine
+// `machine` the state machine, with its states and event registry added but not initialized
+// `log` the event log
+// `key` the key of the event log (and of the snapshots) of the machine
+func NewEventSourcedStateMachine[C any](machine *StateMachine[C], log EventLog, key string) *EventSourcedStateMachine[C] {
+	return &EventSourcedStateMachine[C]{machine: machine, log: log, key: key, snapshots: snapshotConfig[C]{key: key}}
+}
+
+// Enables the periodic snapshots, the replay then starts from the last snapshot. It must be
+// called before Start.
+// `store` the store of the snapshots
+// `codec` the user context codec, the context must be saved unless it is rebuilt otherwise
+// `every` the number of events between two snapshots
+func (e *EventSourcedStateMachine[C]) SetSnapshots(store Store, codec ContextCodec[C], every int) {
+	if every <= 0 {
+		panic("The number of events between two snapshots must be positive")
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.snapshots.store = store
+	e.snapshots.codec = codec
+	e.snapshotEvery = every
+}
+
+// Sets the schema of the snapshots, see PersistentStateMachine.SetSnapshotSchema
+func (e *EventSourcedStateMachine[C]) SetSnapshotSchema(schema *SnapshotSchema) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.snapshots.schema = schema
+}
+
+// Returns the wrapped state machine
+func (e *EventSourcedStateMachine[C]) Machine() *StateMachine[C] {
+	return e.machine
+}
+
+// Starts the state machine: restores the last snapshot or initializes the machine, then replays
+// the events of the log appended after the snapshot
+// `initStateId` the initial starting state
+// returns the number of events replayed
+func (e *EventSourcedStateMachine[C]) Start(initStateId StateId) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	impl := &e.machine.impl
+	if impl.eventRegistry == nil {
+		return 0, errors.New("An event-sourced state machine requires an event registry (see SetEventRegistry)")
+	}
+	var snapshot *Snapshot
+	var err error
+	if e.snapshots.store != nil {
+		if snapshot, err = e.snapshots.load(); err != nil {
+			return 0, err
+		}
+	}
+	if snapshot != nil {
+		e.seq = snapshot.LogSeq
+	}
+	records, err := e.log.Read(e.key, e.seq)
+	if err != nil {
+		return 0, err
+	}
+	// the initial transition was already run if the log has events
+	impl.replaying = e.seq > 0 || len(records) > 0
+	defer func() { impl.replaying = false }()
+	if snapshot != nil {
+		if err := e.snapshots.restore(e.machine, snapshot, initStateId); err != nil {
+			return 0, err
+		}
+	} else {
+		e.machine.Initialize(initStateId)
+	}
+	e.machine.dispatchMutex.Lock()
+	defer e.machine.dispatchMutex.Unlock()
+	for i, data := range records {
+		record := eventLogRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return i, err
+		}
+		event, err := impl.eventRegistry.UnmarshalEvent(record.Event)
+		if err != nil {
+			return i, err
+		}
+		impl.dispatch(queuedEvent{event: event, metadata: record.Metadata, enqueued: true, replayed: true})
+		e.seq++
+	}
+	// the do-activities are not started during the replay, only those of the active
+	// configuration are
+	impl.replaying = false
+	impl.runMutex.Lock()
+	defer impl.runMutex.Unlock()
+	impl.resumeActivities()
+	return len(records), nil
+}
+
+// Appends an event to the log, then dispatches it. An event that cannot be appended is not
+// dispatched.
+// `event` The Event to dispatch
+// returns the error appending the event or saving the snapshot
+func (e *EventSourcedStateMachine[C]) DispatchEvent(event Event) error {
+	return e.dispatch(queuedEvent{event: event})
+}
+
+// Appends an event to the log, then dispatches it with a context (the context is not logged)
+// `ctx` the context of the event (see StateMachine.DispatchEventContext)
+// `event` The Event to dispatch
+// returns the error appending the event or saving the snapshot
+func (e *EventSourcedStateMachine[C]) DispatchEventContext(ctx context.Context, event Event) error {
+	return e.dispatch(queuedEvent{event: event, ctx: ctx})
+}
+
+func (e *EventSourcedStateMachine[C]) dispatch(event queuedEvent) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.machine.dispatchMutex.Lock()
+	defer e.machine.dispatchMutex.Unlock()
+	impl := &e.machine.impl
+	// the ID and the enqueue time are logged with the event
+	impl.enqueued(&event)
+	data, err := impl.eventRegistry.MarshalEvent(event.event)
+	if err != nil {
+		return err
+	}
+	record, err := json.Marshal(eventLogRecord{Event: data, Metadata: event.metadata})
+	if err != nil {
+		return err
+	}
+	if err := e.log.Append(e.key, record); err != nil {
+		return err
+	}
+	e.seq++
+	impl.dispatch(event)
+	if e.snapshots.store != nil && e.seq%e.snapshotEvery == 0 {
+		return e.snapshots.save(e.machine, e.seq)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package statechart
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type AccountContext struct {
+	Balance  int
+	notified []string
+}
+
+type DepositEvent struct {
+	EventDefault
+	Amount int
+}
+
+type CloseEvent struct {
+	EventDefault
+}
+
+type AccountOpen struct {
+	StateDefault[AccountContext]
+}
+
+func (s *AccountOpen) Setup(proxy StateSetupProxy[AccountContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *DepositEvent) ReactionResult {
+		s.GetContext().Balance += e.Amount
+		return proxy.Discard()
+	})
+	AddSimpleStateTransition[CloseEvent, AccountClosed](proxy, nil)
+	return func() {
+		if !proxy.IsReplaying() {
+			s.GetContext().notified = append(s.GetContext().notified, "opened")
+		}
+	}, nil
+}
+
+type AccountClosed struct {
+	StateDefault[AccountContext]
+}
+
+func (s *AccountClosed) Setup(proxy StateSetupProxy[AccountContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	return func() {
+		if !proxy.IsReplaying() {
+			s.GetContext().notified = append(s.GetContext().notified, "closed")
+		}
+	}, nil
+}
+
+func makeAccountStateMachine(ctx *AccountContext, log EventLog) *EventSourcedStateMachine[AccountContext] {
+	registry := MakeEventRegistry()
+	RegisterEvent[DepositEvent](&registry, "account.deposit")
+	RegisterEvent[CloseEvent](&registry, "account.close")
+	sm := MakeStateMachine(ctx)
+	sm.SetEventRegistry(&registry)
+	sm.AddState(&AccountOpen{})
+	sm.AddState(&AccountClosed{})
+	return NewEventSourcedStateMachine(&sm, log, "account-1")
+}
+
+func runAccount(t *testing.T, account *EventSourcedStateMachine[AccountContext]) {
+	replayed, err := account.Start(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.NoError(t, account.DispatchEvent(&DepositEvent{Amount: 10}))
+	assert.NoError(t, account.DispatchEvent(&DepositEvent{Amount: 5}))
+	assert.NoError(t, account.DispatchEvent(&CloseEvent{}))
+}
+
+func TestEventSourcedStateMachine(t *testing.T) {
+	log := MakeMemoryEventLog()
+	ctx := AccountContext{}
+	runAccount(t, makeAccountStateMachine(&ctx, &log))
+	assert.Equal(t, []string{"opened", "closed"}, ctx.notified)
+
+	// the process restarts, the machine is rebuilt from its log without side effects
+	rebuiltCtx := AccountContext{}
+	rebuilt := makeAccountStateMachine(&rebuiltCtx, &log)
+	replayed, err := rebuilt.Start(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, 15, rebuiltCtx.Balance)
+	assert.Empty(t, rebuiltCtx.notified)
+	assert.Equal(t, "AccountClosed", rebuilt.Machine().Configuration()[0].Name)
+	assert.False(t, rebuilt.Machine().impl.replaying)
+}
+
+func TestEventSourcedStateMachineSnapshots(t *testing.T) {
+	log := MakeMemoryEventLog()
+	store := MakeMemoryStore()
+	account := makeAccountStateMachine(&AccountContext{}, &log)
+	account.SetSnapshots(&store, JsonContextCodec[AccountContext]{}, 2)
+	runAccount(t, account)
+
+	rebuiltCtx := AccountContext{}
+	rebuilt := makeAccountStateMachine(&rebuiltCtx, &log)
+	rebuilt.SetSnapshots(&store, JsonContextCodec[AccountContext]{}, 2)
+	replayed, err := rebuilt.Start(0)
+	assert.NoError(t, err)
+	// the snapshot was taken after the second event
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 15, rebuiltCtx.Balance)
+	assert.Empty(t, rebuiltCtx.notified)
+	assert.Equal(t, "AccountClosed", rebuilt.Machine().Configuration()[0].Name)
+}
+
+func TestEventSourcedStateMachineRequiresRegistry(t *testing.T) {
+	log := MakeMemoryEventLog()
+	sm := MakeStateMachine(&AccountContext{})
+	sm.AddState(&AccountOpen{})
+	sm.AddState(&AccountClosed{})
+	_, err := NewEventSourcedStateMachine(&sm, &log, "account-1").Start(0)
+	assert.Error(t, err)
+}
+
+func TestFileEventLog(t *testing.T) {
+	dir := t.TempDir()
+	log := MakeFileEventLog(dir)
+	records, err := log.Read("account-1", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+	assert.NoError(t, log.Append("account-1", []byte("first")))
+	assert.NoError(t, log.Append("account-1", []byte("second")))
+	assert.Error(t, log.Append("account-1", []byte("multi\nline")))
+
+	// an interrupted append leaves a torn record
+	file, err := os.OpenFile(filepath.Join(dir, "account-1.log"), os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("tor"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	records, err = log.Read("account-1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("first"), []byte("second")}, records)
+
+	assert.NoError(t, log.Append("account-1", []byte("third")))
+	records, err = log.Read("account-1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("second"), []byte("third")}, records)
+}
+
+func TestEventSourcedStateMachineFileLog(t *testing.T) {
+	log := MakeFileEventLog(t.TempDir())
+	runAccount(t, makeAccountStateMachine(&AccountContext{}, log))
+	rebuiltCtx := AccountContext{}
+	replayed, err := makeAccountStateMachine(&rebuiltCtx, log).Start(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, 15, rebuiltCtx.Balance)
+}
+
+func makeExpiringEventSourcedMachine(ctx *DeferralContext, log EventLog, options ...Option) *EventSourcedStateMachine[DeferralContext] {
+	registry := MakeEventRegistry()
+	RegisterEvent[WorkEvent](&registry, "work")
+	RegisterEvent[ReadyEvent](&registry, "ready")
+	sm := MakeStateMachine(ctx, options...)
+	sm.SetEventRegistry(&registry)
+	sm.AddState(&Expiring{})
+	sm.AddState(&StillWaiting{})
+	sm.AddState(&Released{})
+	return NewEventSourcedStateMachine(&sm, log, "expiring-1")
+}
+
+func TestEventSourcedStateMachineRecordedTime(t *testing.T) {
+	log := MakeMemoryEventLog()
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	recorded := makeExpiringEventSourcedMachine(&DeferralContext{}, &log, WithClock(&clock))
+	_, err := recorded.Start(0)
+	assert.NoError(t, err)
+	assert.NoError(t, recorded.DispatchEvent(&WorkEvent{}))
+	clock.now = clock.now.Add(2 * time.Minute)
+	assert.NoError(t, recorded.DispatchEvent(&ReadyEvent{}))
+
+	// the deferred event expires at the recorded time, not at the time of the replay
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{}
+	replayed, err := makeExpiringEventSourcedMachine(&ctx, &log, WithObserver(&observer)).Start(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Empty(t, ctx.handled)
+	assert.Len(t, observer.dropped, 1)
+	assert.Equal(t, DROP_DEFERRED_EXPIRED, observer.dropped[0].reason)
+}
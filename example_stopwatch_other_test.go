@@ -4,6 +4,9 @@
 package statechart_test
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/hhassoubi/go-statechart"
 )
 
@@ -38,3 +41,52 @@ func ExampleAsyncStateMachine() {
 	// Reset Counter
 
 }
+
+type ConnectionContext struct {
+	Name string
+}
+
+// /// Offline State of ExampleDefinition
+type Offline struct {
+	statechart.StateDefault[ConnectionContext]
+}
+
+func (self *Offline) Setup(proxy statechart.StateSetupProxy[ConnectionContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[ActivateEv, Online](proxy, nil)
+	return nil, nil
+}
+
+// /// Online State of ExampleDefinition
+type Online struct {
+	statechart.StateDefault[ConnectionContext]
+}
+
+func (self *Online) Setup(proxy statechart.StateSetupProxy[ConnectionContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[DeactivateEv, Offline](proxy, nil)
+	// the state is shared by the instances, the entry action reaches its instance with the bound proxy
+	proxy.SetEntryActionCtx(func(ctx context.Context) {
+		fmt.Println(proxy.Bind(ctx).GetContext().Name, "online")
+	})
+	return nil, nil
+}
+
+// This Example builds a Definition once and creates two independent instances from it.
+func ExampleDefinition() {
+	def := statechart.MakeDefinition[ConnectionContext]()
+	offlineState := def.AddState(&Offline{})
+	def.AddState(&Online{})
+	def.Build(offlineState)
+
+	first := def.NewInstance(&ConnectionContext{Name: "first"})
+	second := def.NewInstance(&ConnectionContext{Name: "second"})
+
+	first.DispatchEvent(&ActivateEv{})   // go from Offline to Online
+	second.DispatchEvent(&ActivateEv{})  // go from Offline to Online
+	first.DispatchEvent(&DeactivateEv{}) // go from Online to Offline
+	first.DispatchEvent(&ActivateEv{})   // go from Offline to Online
+
+	// output:
+	// first online
+	// second online
+	// first online
+}
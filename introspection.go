@@ -0,0 +1,72 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+// The description of a state of the active configuration
+type StateInfo struct {
+	Id   StateId
+	Name string
+	Key  string
+	// true if the state has sub-states
+	IsSuperState bool
+	// true if the state is a super state active without an active sub-state (see WithSuperStateLeaf)
+	IsSuperStateLeaf bool
+}
+
+// Returns the active configuration, from the top state down to the active state
+// (nil before Initialize)
+func (sm *stateMachineImpl[C]) Configuration() []StateInfo {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	if sm.currentState == nil {
+		return nil
+	}
+	configuration := make([]StateInfo, sm.currentState.level)
+	for s := sm.currentState; s != nil; s = s.parent {
+		configuration[s.level-1] = StateInfo{
+			Id:               s.id,
+			Name:             s.name,
+			Key:              s.key,
+			IsSuperState:     s.isSuperState,
+			IsSuperStateLeaf: s == sm.currentState && s.isSuperState,
+		}
+	}
+	return configuration
+}
+
+// Returns the active state (INVALID_STATE_ID before Initialize)
+func (sm *stateMachineImpl[C]) CurrentStateId() StateId {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	if sm.currentState == nil {
+		return INVALID_STATE_ID
+	}
+	return sm.currentState.id
+}
+
+// Returns true if the state is the active state or one of its ancestors
+func (sm *stateMachineImpl[C]) IsInState(id StateId) bool {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	for s := sm.currentState; s != nil; s = s.parent {
+		if s.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the active state or one of its ancestors has a reaction to the event
+func (sm *stateMachineImpl[C]) HasReaction(event Event) bool {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	return sm.currentState != nil && len(sm.currentState.handlers(event)) != 0
+}
+
+// Returns true if the state machine was stopped by an action failure (see STOP_ON_FAILURE)
+func (sm *stateMachineImpl[C]) IsStopped() bool {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	return sm.stopped
+}
@@ -0,0 +1,89 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// What the state machine does with the state invariants (see StateSetupProxy.SetInvariant)
+type InvariantPolicy int16
+
+const (
+	// The invariants are not checked
+	IGNORE_INVARIANTS InvariantPolicy = iota
+	// The invariants are checked, the violations are reported to the observers
+	REPORT_VIOLATIONS
+	// The invariants are checked, a violation is reported to the observers then panics
+	PANIC_ON_VIOLATION
+)
+
+func (p InvariantPolicy) String() string {
+	switch p {
+	case IGNORE_INVARIANTS:
+		return "Ignore"
+	case REPORT_VIOLATIONS:
+		return "Report"
+	case PANIC_ON_VIOLATION:
+		return "Panic"
+	}
+	return "Unknown"
+}
+
+// The violation of a state invariant, it is also an error wrapping the invariant error
+type InvariantViolation struct {
+	// the error returned by the invariant
+	Err error
+	// the state of the invariant
+	State StateId
+	// the event of the run-to-completion step (nil after the initial transition)
+	Event Event
+	// the name of State, for the error message
+	stateName string
+}
+
+func (v *InvariantViolation) Error() string {
+	return fmt.Sprintf("Invariant of state %s violated (event %v): %v", failedStateName(v.State, v.stateName), reflect.TypeOf(v.Event), v.Err)
+}
+
+func (v *InvariantViolation) Unwrap() error {
+	return v.Err
+}
+
+func (s *stateImpl[C]) SetInvariant(invariant func() error) {
+	if s.invariant != nil {
+		panic("The state has two invariants")
+	}
+	s.invariant = invariant
+	s.setUnbound("invariant")
+}
+
+// Checks the invariants of the active configuration, from the active state up to the top state,
+// after a run-to-completion step
+// `event` the event of the step (nil after the initial transition)
+func (sm *stateMachineImpl[C]) checkInvariants(event Event) {
+	if sm.invariantPolicy == IGNORE_INVARIANTS {
+		return
+	}
+	for s := sm.currentState; s != nil; s = s.parent {
+		if s.invariant == nil {
+			continue
+		}
+		err := s.invariant()
+		if err == nil {
+			continue
+		}
+		violation := &InvariantViolation{Err: err, State: s.id, Event: event, stateName: s.name}
+		if sm.DebugLogger != nil {
+			sm.DebugLogger("Invariant Violated", "error", violation.Error(), "policy", sm.invariantPolicy)
+		}
+		for _, o := range sm.observers.invariants {
+			o.OnInvariantViolated(violation)
+		}
+		if sm.invariantPolicy == PANIC_ON_VIOLATION {
+			panic(violation)
+		}
+	}
+}
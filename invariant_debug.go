@@ -0,0 +1,10 @@
+//go:build statechart_debug
+
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+// With the build tag statechart_debug (e.g. go test -tags statechart_debug), the invariants are
+// checked and a violation panics unless the option WithInvariantChecks says otherwise
+const defaultInvariantPolicy = PANIC_ON_VIOLATION
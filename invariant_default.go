@@ -0,0 +1,9 @@
+//go:build !statechart_debug
+
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+// The invariants are only checked with the option WithInvariantChecks
+const defaultInvariantPolicy = IGNORE_INVARIANTS
@@ -0,0 +1,100 @@
+package statechart
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCounterStopped = errors.New("counter stopped")
+
+type CounterContext struct {
+	started bool
+	// starts the counter on the entry of CounterRunning
+	startOnEntry bool
+}
+
+type CounterStartEvent struct {
+	EventDefault
+}
+
+type CounterStopEvent struct {
+	EventDefault
+}
+
+type ViolationRecorder struct {
+	ObserverDefault
+	violations []*InvariantViolation
+}
+
+func (o *ViolationRecorder) OnInvariantViolated(violation *InvariantViolation) {
+	o.violations = append(o.violations, violation)
+}
+
+type CounterIdle struct {
+	StateDefault[CounterContext]
+}
+
+func (s *CounterIdle) Setup(proxy StateSetupProxy[CounterContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[CounterStartEvent, CounterRunning](proxy, nil)
+	return nil, nil
+}
+
+type CounterRunning struct {
+	StateDefault[CounterContext]
+}
+
+func (s *CounterRunning) Setup(proxy StateSetupProxy[CounterContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.SetInvariant(func() error {
+		if !s.GetContext().started {
+			return errCounterStopped
+		}
+		return nil
+	})
+	AddCustomStateReaction(proxy, func(e *CounterStopEvent) ReactionResult {
+		s.GetContext().started = false
+		return proxy.Discard()
+	})
+	return func() { s.GetContext().started = s.GetContext().startOnEntry }, nil
+}
+
+func makeCounterStateMachine(ctx *CounterContext, options ...Option) *StateMachine[CounterContext] {
+	sm := MakeStateMachine(ctx, options...)
+	idleId := sm.AddState(&CounterIdle{})
+	sm.AddState(&CounterRunning{})
+	sm.Initialize(idleId)
+	return &sm
+}
+
+func TestInvariantReported(t *testing.T) {
+	observer := &ViolationRecorder{}
+	sm := makeCounterStateMachine(&CounterContext{startOnEntry: true}, WithInvariantChecks(REPORT_VIOLATIONS), WithObserver(observer))
+	sm.DispatchEvent(&CounterStartEvent{})
+	assert.Empty(t, observer.violations)
+
+	stop := &CounterStopEvent{}
+	sm.DispatchEvent(stop)
+	assert.Len(t, observer.violations, 1)
+	violation := observer.violations[0]
+	assert.ErrorIs(t, violation, errCounterStopped)
+	assert.Equal(t, FindState[CounterRunning](sm), violation.State)
+	assert.Same(t, stop, violation.Event)
+	assert.EqualError(t, violation, "Invariant of state CounterRunning violated (event *statechart.CounterStopEvent): counter stopped")
+}
+
+func TestInvariantPanics(t *testing.T) {
+	sm := makeCounterStateMachine(&CounterContext{}, WithInvariantChecks(PANIC_ON_VIOLATION))
+	assert.PanicsWithError(t, "Invariant of state CounterRunning violated (event *statechart.CounterStartEvent): counter stopped", func() {
+		sm.DispatchEvent(&CounterStartEvent{})
+	})
+}
+
+func TestInvariantNotChecked(t *testing.T) {
+	observer := &ViolationRecorder{}
+	sm := makeCounterStateMachine(&CounterContext{}, WithInvariantChecks(IGNORE_INVARIANTS), WithObserver(observer))
+	sm.DispatchEvent(&CounterStartEvent{})
+	assert.Empty(t, observer.violations)
+}
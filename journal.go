@@ -0,0 +1,172 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A transition of a journal entry, the states are identified by their names
+type JournalTransition struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// An entry of the event journal, one JSON line per dispatched event
+type JournalEntry struct {
+	// the position of the event in the journal, starting at 1
+	Seq int `json:"seq"`
+	// the type of the event (see Replay)
+	Event string `json:"event"`
+	// the exported fields of the event, as JSON
+	Payload json.RawMessage `json:"payload"`
+	// when the event was dispatched
+	Time time.Time `json:"time"`
+	// the transitions of the run-to-completion step, including the ones of the posted events
+	Transitions []JournalTransition `json:"transitions"`
+}
+
+// The error returned by Replay when the replayed machine doesn't make the recorded transitions
+type ReplayDivergence struct {
+	// the journal entry that diverged
+	Entry JournalEntry
+	// the transitions made by the replayed machine
+	Actual []JournalTransition
+}
+
+func (d *ReplayDivergence) Error() string {
+	return fmt.Sprintf("Replay diverged at event %d (%s): expected %v, got %v",
+		d.Entry.Seq, d.Entry.Event, d.Entry.Transitions, d.Actual)
+}
+
+// Collects the transitions of the run-to-completion steps
+type transitionCollector[C any] struct {
+	ObserverDefault
+	machine     *StateMachine[C]
+	transitions []JournalTransition
+}
+
+func (c *transitionCollector[C]) OnTransition(event Event, metadata EventMetadata, from StateId, to StateId) {
+	states := c.machine.impl.states
+	c.transitions = append(c.transitions, JournalTransition{From: states[from].name, To: states[to].name})
+}
+
+func (c *transitionCollector[C]) attach(machine *StateMachine[C]) {
+	c.machine = machine
+	machine.AddObserver(c)
+}
+
+// Runs a run-to-completion step and returns its transitions
+func (c *transitionCollector[C]) dispatch(event queuedEvent) []JournalTransition {
+	c.machine.dispatchMutex.Lock()
+	defer c.machine.dispatchMutex.Unlock()
+	c.transitions = nil
+	c.machine.impl.dispatch(event)
+	return c.transitions
+}
+
+// Records the events dispatched to a state machine in a journal, to reproduce them with Replay.
+// The events must all be dispatched through the recorder, the transitions of the events
+// dispatched directly to the machine are not recorded.
+type Recorder[C any] struct {
+	collector transitionCollector[C]
+	encoder   *json.Encoder
+	seq       int
+	mutex     sync.Mutex
+}
+
+// Creates a recorder writing the journal of a state machine, one JSON line per event
+// `machine` the recorded state machine
+// `w` the journal writer
+func NewRecorder[C any](machine *StateMachine[C], w io.Writer) *Recorder[C] {
+	r := &Recorder[C]{encoder: json.NewEncoder(w)}
+	r.collector.attach(machine)
+	return r
+}
+
+// Dispatches an event to the state machine and writes it to the journal.
+// An event that cannot be serialized is not dispatched.
+// `event` The Event to dispatch
+// returns the serialization or write error
+func (r *Recorder[C]) DispatchEvent(event Event) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	impl := &r.collector.machine.impl
+	entry := JournalEntry{Event: eventTypeName(impl.eventRegistry, event), Payload: payload, Time: impl.now()}
+	entry.Transitions = r.collector.dispatch(queuedEvent{event: event})
+	r.seq++
+	entry.Seq = r.seq
+	return r.encoder.Encode(entry)
+}
+
+// Replays a journal on a fresh state machine, initialized like the recorded one.
+// The events are rebuilt from their payload. The machine time during the step of an event is
+// its recorded time: it is the enqueue time of the event, and it is used for the deferral TTLs.
+// `journal` the journal written by a Recorder
+// `machine` the fresh state machine
+// `events` a sample of each event type of the journal, e.g. &MyEvent{}, not needed for the
+// events of the machine's event registry (see SetEventRegistry)
+// returns a *ReplayDivergence for the first event whose transitions differ from the recorded ones,
+// or the error reading the journal
+func Replay[C any](journal io.Reader, machine *StateMachine[C], events ...Event) error {
+	registry := machine.impl.eventRegistry
+	types := map[string]reflect.Type{}
+	for _, event := range events {
+		types[eventTypeName(registry, event)] = reflect.TypeOf(event).Elem()
+	}
+	collector := transitionCollector[C]{}
+	collector.attach(machine)
+	decoder := json.NewDecoder(journal)
+	for {
+		entry := JournalEntry{}
+		if err := decoder.Decode(&entry); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		event, err := newJournalEvent(registry, types, entry.Event)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(entry.Payload, event); err != nil {
+			return err
+		}
+		// the recorded time is the machine time during the step
+		replayed := queuedEvent{event: event, metadata: EventMetadata{EnqueuedAt: entry.Time}, replayed: true}
+		actual := collector.dispatch(replayed)
+		if !reflect.DeepEqual(actual, entry.Transitions) && (len(actual) > 0 || len(entry.Transitions) > 0) {
+			return &ReplayDivergence{Entry: entry, Actual: actual}
+		}
+	}
+}
+
+// Returns the journal name of an event: its registered name, or its Go type
+func eventTypeName(registry *EventRegistry, event Event) string {
+	if registry != nil {
+		if name, ok := registry.Name(event); ok {
+			return name
+		}
+	}
+	return reflect.TypeOf(event).Elem().String()
+}
+
+func newJournalEvent(registry *EventRegistry, types map[string]reflect.Type, name string) (Event, error) {
+	if eventType, ok := types[name]; ok {
+		return reflect.New(eventType).Interface().(Event), nil
+	}
+	if registry != nil {
+		return registry.NewEvent(name)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+}
@@ -0,0 +1,121 @@
+package statechart
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type DoorContext struct {
+	code string
+}
+
+type LockEvent struct {
+	EventDefault
+}
+
+type UnlockEvent struct {
+	EventDefault
+	Code string
+}
+
+type Unlocked struct {
+	StateDefault[DoorContext]
+}
+
+func (s *Unlocked) Setup(proxy StateSetupProxy[DoorContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[LockEvent, Locked](proxy, nil)
+	return nil, nil
+}
+
+type Locked struct {
+	StateDefault[DoorContext]
+}
+
+func (s *Locked) Setup(proxy StateSetupProxy[DoorContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *UnlockEvent) ReactionResult {
+		if e.Code != s.GetContext().code {
+			return proxy.Discard()
+		}
+		return Transit[Unlocked, DoorContext](proxy)
+	})
+	return nil, nil
+}
+
+func makeDoorStateMachine(code string) *StateMachine[DoorContext] {
+	sm := MakeStateMachine(&DoorContext{code: code})
+	unlockedId := sm.AddState(&Unlocked{})
+	sm.AddState(&Locked{})
+	sm.Initialize(unlockedId)
+	return &sm
+}
+
+func recordDoorJournal(t *testing.T) *bytes.Buffer {
+	journal := &bytes.Buffer{}
+	recorder := NewRecorder(makeDoorStateMachine("1234"), journal)
+	assert.NoError(t, recorder.DispatchEvent(&LockEvent{}))
+	assert.NoError(t, recorder.DispatchEvent(&UnlockEvent{Code: "0000"}))
+	assert.NoError(t, recorder.DispatchEvent(&UnlockEvent{Code: "1234"}))
+	return journal
+}
+
+func TestRecorder(t *testing.T) {
+	journal := recordDoorJournal(t)
+	lines := strings.Split(strings.TrimSpace(journal.String()), "\n")
+	assert.Len(t, lines, 3)
+	entry := JournalEntry{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &entry))
+	assert.Equal(t, 3, entry.Seq)
+	assert.Equal(t, "statechart.UnlockEvent", entry.Event)
+	assert.JSONEq(t, `{"Code":"1234"}`, string(entry.Payload))
+	assert.False(t, entry.Time.IsZero())
+	assert.Equal(t, []JournalTransition{{From: "Locked", To: "Unlocked"}}, entry.Transitions)
+}
+
+func TestReplay(t *testing.T) {
+	journal := recordDoorJournal(t)
+	sm := makeDoorStateMachine("1234")
+	assert.NoError(t, Replay(journal, sm, &LockEvent{}, &UnlockEvent{}))
+	assert.Equal(t, "Unlocked", sm.Configuration()[0].Name)
+}
+
+func TestReplayDivergence(t *testing.T) {
+	journal := recordDoorJournal(t)
+	err := Replay(journal, makeDoorStateMachine("0000"), &LockEvent{}, &UnlockEvent{})
+	divergence := &ReplayDivergence{}
+	assert.True(t, errors.As(err, &divergence))
+	assert.Equal(t, 2, divergence.Entry.Seq)
+	assert.Equal(t, []JournalTransition{{From: "Locked", To: "Unlocked"}}, divergence.Actual)
+	assert.Equal(t, "Replay diverged at event 2 (statechart.UnlockEvent): expected [], got [{Locked Unlocked}]", err.Error())
+}
+
+func TestReplayUnknownEvent(t *testing.T) {
+	journal := recordDoorJournal(t)
+	err := Replay(journal, makeDoorStateMachine("1234"), &LockEvent{})
+	assert.ErrorIs(t, err, ErrUnknownEvent)
+	assert.EqualError(t, err, "Unknown event: statechart.UnlockEvent")
+}
+
+func TestReplayRecordedTime(t *testing.T) {
+	clock := FakeClock{now: time.Unix(1000, 0)}
+	journal := &bytes.Buffer{}
+	recorder := NewRecorder(makeExpiringStateMachine(&DeferralContext{}, WithClock(&clock)), journal)
+	assert.NoError(t, recorder.DispatchEvent(&WorkEvent{}))
+	clock.now = clock.now.Add(2 * time.Minute)
+	assert.NoError(t, recorder.DispatchEvent(&ReadyEvent{}))
+
+	// the deferred event expires at the recorded time, not at the time of the replay
+	observer := DeadLetterObserver{}
+	ctx := DeferralContext{}
+	sm := makeExpiringStateMachine(&ctx, WithObserver(&observer))
+	assert.NoError(t, Replay(journal, sm, &WorkEvent{}, &ReadyEvent{}))
+	assert.Empty(t, ctx.handled)
+	assert.Len(t, observer.dropped, 1)
+	assert.Equal(t, DROP_DEFERRED_EXPIRED, observer.dropped[0].reason)
+}
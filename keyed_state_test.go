@@ -0,0 +1,132 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type RetryContext struct {
+	attempts map[string]int
+	log      string
+}
+
+type FailEvent struct {
+	EventDefault
+}
+
+type NextEvent struct {
+	EventDefault
+}
+
+// Retrying is a parameterised state used under several parents
+type Retrying struct {
+	StateDefault[RetryContext]
+	maxAttempts int
+	giveUpKey   string
+}
+
+func (s *Retrying) Setup(proxy StateSetupProxy[RetryContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *FailEvent) ReactionResult {
+		ctx := s.GetContext()
+		ctx.attempts[proxy.Key()]++
+		if ctx.attempts[proxy.Key()] < s.maxAttempts {
+			return proxy.Discard()
+		}
+		return TransitTo[Retrying, RetryContext](proxy, s.giveUpKey)
+	})
+	return func() { s.GetContext().log += proxy.Name() + " " }, nil
+}
+
+type Connecting struct {
+	StateDefault[RetryContext]
+}
+
+func (s *Connecting) Setup(proxy StateSetupProxy[RetryContext]) (EntryAction, ExitAction) {
+	SetStartingStateByKey[Retrying](proxy, "connect")
+	AddSimpleStateTransitionByKey[NextEvent, Retrying](proxy, "send", nil)
+	return nil, nil
+}
+
+type Sending struct {
+	StateDefault[RetryContext]
+}
+
+func (s *Sending) Setup(proxy StateSetupProxy[RetryContext]) (EntryAction, ExitAction) {
+	SetStartingStateByKey[Retrying](proxy, "send")
+	AddSimpleStateTransitionByKey[NextEvent, Retrying](proxy, "close", nil)
+	return nil, nil
+}
+
+type Closing struct {
+	StateDefault[RetryContext]
+}
+
+func (s *Closing) Setup(proxy StateSetupProxy[RetryContext]) (EntryAction, ExitAction) {
+	SetStartingStateByKey[Retrying](proxy, "close")
+	return nil, nil
+}
+
+func makeRetryStateMachine(ctx *RetryContext) *stateMachineImpl[RetryContext] {
+	sm := &stateMachineImpl[RetryContext]{userContext: ctx}
+	connectingId := sm.AddState(&Connecting{})
+	sendingId := sm.AddState(&Sending{})
+	closingId := sm.AddState(&Closing{})
+	sm.AddKeyedSubState(&Retrying{maxAttempts: 3, giveUpKey: "close"}, connectingId, "connect")
+	sm.AddKeyedSubState(&Retrying{maxAttempts: 2, giveUpKey: "close"}, sendingId, "send")
+	sm.AddKeyedSubState(&Retrying{maxAttempts: 1, giveUpKey: "close"}, closingId, "close")
+	sm.Initialize(connectingId)
+	return sm
+}
+
+func TestKeyedStates(t *testing.T) {
+	ctx := RetryContext{attempts: map[string]int{}}
+	sm := makeRetryStateMachine(&ctx)
+	assert.Equal(t, "Retrying_connect", sm.currentState.name)
+	assert.Equal(t, "connect", sm.currentState.key)
+
+	sm.DispatchEvent(&FailEvent{})
+	sm.DispatchEvent(&FailEvent{})
+	assert.Equal(t, "Retrying_connect", sm.currentState.name)
+	sm.DispatchEvent(&NextEvent{})
+	assert.Equal(t, "Retrying_send", sm.currentState.name)
+	sm.DispatchEvent(&FailEvent{})
+	sm.DispatchEvent(&FailEvent{})
+	assert.Equal(t, "Retrying_close", sm.currentState.name)
+	assert.Equal(t, map[string]int{"connect": 2, "send": 2}, ctx.attempts)
+	assert.Equal(t, "Retrying_connect Retrying_send Retrying_close ", ctx.log)
+}
+
+func TestKeyedStateLookup(t *testing.T) {
+	ctx := RetryContext{attempts: map[string]int{}}
+	sm := makeRetryStateMachine(&ctx)
+	var proxy StateProxy[RetryContext] = sm.states[0]
+	sendId := FindStateIdByKey[Retrying](proxy, "send")
+	assert.Equal(t, "send", sm.states[sendId].Key())
+	assert.Equal(t, "Sending", sm.states[sendId].parent.name)
+	assert.Panics(t, func() { FindStateIdByKey[Retrying](proxy, "unknown") })
+	// the keyed states are not found by type only
+	assert.Panics(t, func() { FindStateId[Retrying](proxy) })
+	assert.Equal(t, StateId(0), FindStateId[Connecting](proxy))
+}
+
+func TestKeyedStateDuplicate(t *testing.T) {
+	sm := stateMachineImpl[RetryContext]{}
+	parentId := sm.AddState(&Connecting{})
+	sm.AddKeyedSubState(&Retrying{}, parentId, "a")
+	sm.AddSubState(&Retrying{}, parentId)
+	assert.Panics(t, func() { sm.AddKeyedSubState(&Retrying{}, parentId, "a") })
+	assert.Panics(t, func() { sm.AddState(&Retrying{}) })
+	assert.NotPanics(t, func() { sm.AddKeyedState(&Retrying{}, "b") })
+}
+
+func TestKeyedStateUml(t *testing.T) {
+	ctx := RetryContext{attempts: map[string]int{}}
+	sm := makeRetryStateMachine(&ctx)
+	buffer := bytes.Buffer{}
+	sm.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	assert.Contains(t, buffer.String(), "Connecting -> Retrying_send : NextEvent\n")
+	assert.Contains(t, buffer.String(), "[*] -> Retrying_close \n")
+}
@@ -0,0 +1,83 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+// The model of a state machine: its state tree and its documented reactions (see
+// UmlDocReaction), exported to JSON for the tools, e.g. the simulator cmd/statechart-sim.
+// The states are identified by their paths (see StateMachine.StatePath).
+type Model struct {
+	// the path of the initial active state
+	Initial string       `json:"initial"`
+	States  []ModelState `json:"states"`
+}
+
+// A state of a Model, the entry and exit points are not states of the model: the transitions
+// to a point target the state it leads to
+type ModelState struct {
+	Path string `json:"path"`
+	// the path of the sub-state entered with the state, empty if there is none
+	Starting string `json:"starting,omitempty"`
+	Final    bool   `json:"final,omitempty"`
+	// the reactions in the order they were added
+	Reactions []ModelReaction `json:"reactions,omitempty"`
+}
+
+// A documented reaction of a ModelState
+type ModelReaction struct {
+	// the event name in the event registry (see SetEventRegistry), else the event type name
+	Event string `json:"event"`
+	// the result: Discard, Transit or Defer
+	Result string `json:"result"`
+	// the path of the target state of a Transit result
+	Target string `json:"target,omitempty"`
+	// true for a LOCAL transition
+	Local  bool   `json:"local,omitempty"`
+	Guard  string `json:"guard,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// Returns the model of the definition
+func (d *definitionImpl[C]) model() Model {
+	if !d.built {
+		panic("State Machine not Initialized")
+	}
+	model := Model{Initial: d.initialState.path(), States: []ModelState{}}
+	for _, state := range d.states {
+		if state.pseudo != notPseudo {
+			continue
+		}
+		modelState := ModelState{Path: state.path(), Final: isFinalState(state.userState)}
+		if state.startingState != nil {
+			modelState.Starting = state.startingState.path()
+		} else if state.subMachineEntry != nil {
+			modelState.Starting = modelTarget(state.subMachineEntry).path()
+		}
+		for _, ev := range state.events {
+			event := ev.docEventName
+			if d.eventRegistry != nil && ev.match == matchExact {
+				if name, ok := d.eventRegistry.names[ev.eventType]; ok {
+					event = name
+				}
+			}
+			for _, doc := range ev.umlDoc {
+				reaction := ModelReaction{Event: event, Result: doc.ReactionResult.String(), Guard: doc.GuardText, Action: doc.ActionText}
+				if doc.ReactionResult == TRANSIT && doc.TargetState != INVALID_STATE_ID {
+					reaction.Target = modelTarget(d.getState(doc.TargetState)).path()
+					reaction.Local = ev.local
+				}
+				modelState.Reactions = append(modelState.Reactions, reaction)
+			}
+		}
+		model.States = append(model.States, modelState)
+	}
+	return model
+}
+
+// Returns the state a transition to `state` leads to, following the entry and exit points
+func modelTarget[C any](state *stateImpl[C]) *stateImpl[C] {
+	for state.pseudo != notPseudo && state.redirect != nil {
+		state = state.redirect
+	}
+	return state
+}
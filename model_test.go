@@ -0,0 +1,41 @@
+package statechart
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModel(t *testing.T) {
+	sm := MakeStateMachine(&OrderContext{})
+	sm.SetEventRegistry(makeOrderEventRegistry())
+	cartId := sm.AddState(&OrderCart{})
+	sm.AddState(&OrderPaying{})
+	sm.AddState(&OrderShipping{})
+	sm.AddState(&OrderShipped{})
+	sm.Initialize(cartId)
+
+	model := sm.Model()
+	assert.Equal(t, Model{
+		Initial: "OrderCart",
+		States: []ModelState{
+			{Path: "OrderCart", Reactions: []ModelReaction{
+				{Event: "order.add-item", Result: "Discard", Action: "Custom(TODO)"},
+				{Event: "order.checkout", Result: "Transit", Target: "OrderPaying"},
+			}},
+			{Path: "OrderPaying", Reactions: []ModelReaction{
+				{Event: "order.ship", Result: "Defer"},
+				{Event: "order.pay", Result: "Transit", Target: "OrderShipping"},
+			}},
+			{Path: "OrderShipping", Reactions: []ModelReaction{
+				{Event: "order.ship", Result: "Transit", Target: "OrderShipped"},
+			}},
+			{Path: "OrderShipped"},
+		},
+	}, model)
+
+	data, err := json.Marshal(model)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `{"path":"OrderShipping","reactions":[{"event":"order.ship","result":"Transit","target":"OrderShipped"}]}`)
+}
@@ -0,0 +1,222 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"reflect"
+)
+
+// The reason an event was dropped
+type DropReason int16
+
+const (
+	// The deferred queue was full (see WithMaxDeferredEvents)
+	DROP_DEFERRED_OVERFLOW DropReason = iota
+	// The event was deferred for longer than its time to live (see AddDeferWithTTL)
+	DROP_DEFERRED_EXPIRED
+	// The state machine is stopped (see STOP_ON_FAILURE)
+	DROP_MACHINE_STOPPED
+	// The context of the event is canceled or its deadline is exceeded (see DispatchEventContext)
+	DROP_CONTEXT_DONE
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DROP_DEFERRED_OVERFLOW:
+		return "DeferredOverflow"
+	case DROP_DEFERRED_EXPIRED:
+		return "DeferredExpired"
+	case DROP_MACHINE_STOPPED:
+		return "MachineStopped"
+	case DROP_CONTEXT_DONE:
+		return "ContextDone"
+	}
+	return "Unknown"
+}
+
+// The Observer interface receives the notifications of a state machine, an observer also
+// receives the notifications of the optional interfaces it implements (ActionFailureObserver,
+// TransitionObserver, ReactionObserver, ActionObserver, InvariantObserver and StateObserver).
+// The callbacks are called from the dispatching goroutine, during the run-to-completion step.
+// Embed ObserverDefault to implement only the callbacks you need.
+type Observer interface {
+	// Called when an event is dropped without being processed (dead letter)
+	// `event` the dropped event
+	// `metadata` the metadata of the event (see EventMetadata)
+	// `reason` why the event was dropped
+	OnEventDropped(event Event, metadata EventMetadata, reason DropReason)
+}
+
+// An Observer notified of the failed actions
+type ActionFailureObserver interface {
+	// Called when an action returns an error, before the failure policy is applied
+	// `failure` the failed action and its transition
+	OnActionFailed(failure *ActionFailedEvent)
+}
+
+// An Observer notified of the transitions
+type TransitionObserver interface {
+	// Called after a transition triggered by an event
+	// `event` the event that triggered the transition
+	// `metadata` the metadata of the event, it ties the transition to its origin
+	// `from` the active state before the transition
+	// `to` the active state after the transition
+	OnTransition(event Event, metadata EventMetadata, from StateId, to StateId)
+}
+
+// An Observer notified of the reactions, see Coverage
+type ReactionObserver interface {
+	// Called after a reaction of a state handled an event (a FORWARD result included)
+	// `event` the event
+	// `state` the state owning the reaction (the active state or one of its ancestors)
+	// `result` the result of the reaction
+	// `target` the target state of a TRANSIT result, INVALID_STATE_ID otherwise
+	OnReaction(event Event, state StateId, result ResultType, target StateId)
+}
+
+// An Observer notified of the documented actions
+type ActionObserver interface {
+	// Called before the action of a transition runs (after the exits), and after the reaction of
+	// a DISCARD result documenting an action (e.g. AddInStateReaction)
+	// `event` the event
+	// `state` the state owning the reaction
+	// `action` the documented action (see UmlDocReaction.ActionText), may be empty
+	OnAction(event Event, state StateId, action string)
+}
+
+// An Observer notified of the invariant violations
+type InvariantObserver interface {
+	// Called when a state invariant is violated (see WithInvariantChecks)
+	OnInvariantViolated(violation *InvariantViolation)
+}
+
+// An Observer notified of the states entered and exited
+type StateObserver interface {
+	// Called after a state is entered (after its entry action, unless it failed)
+	// `state` the entered state
+	OnStateEntered(state StateId)
+	// Called after a state is exited (after its exit action)
+	// `state` the exited state
+	OnStateExited(state StateId)
+}
+
+// The observers of a state machine, by notification
+type observerSet struct {
+	dropped     []Observer
+	failures    []ActionFailureObserver
+	transitions []TransitionObserver
+	reactions   []ReactionObserver
+	actions     []ActionObserver
+	invariants  []InvariantObserver
+	states      []StateObserver
+}
+
+// Adds an observer to the notifications it implements
+func (s *observerSet) add(observer Observer) {
+	s.dropped = append(s.dropped, observer)
+	if o, ok := observer.(ActionFailureObserver); ok {
+		s.failures = append(s.failures, o)
+	}
+	if o, ok := observer.(TransitionObserver); ok {
+		s.transitions = append(s.transitions, o)
+	}
+	if o, ok := observer.(ReactionObserver); ok {
+		s.reactions = append(s.reactions, o)
+	}
+	if o, ok := observer.(ActionObserver); ok {
+		s.actions = append(s.actions, o)
+	}
+	if o, ok := observer.(InvariantObserver); ok {
+		s.invariants = append(s.invariants, o)
+	}
+	if o, ok := observer.(StateObserver); ok {
+		s.states = append(s.states, o)
+	}
+}
+
+// Default implementation of Observer, all the callbacks do nothing
+type ObserverDefault struct {
+}
+
+func (ObserverDefault) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+}
+
+func (ObserverDefault) OnActionFailed(failure *ActionFailedEvent) {
+}
+
+func (ObserverDefault) OnTransition(event Event, metadata EventMetadata, from StateId, to StateId) {
+}
+
+func (ObserverDefault) OnReaction(event Event, state StateId, result ResultType, target StateId) {
+}
+
+func (ObserverDefault) OnAction(event Event, state StateId, action string) {
+}
+
+func (ObserverDefault) OnInvariantViolated(violation *InvariantViolation) {
+}
+
+func (ObserverDefault) OnStateEntered(state StateId) {
+}
+
+func (ObserverDefault) OnStateExited(state StateId) {
+}
+
+// Adds an observer, between two run-to-completion steps
+func (sm *stateMachineImpl[C]) addObserver(observer Observer) {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	sm.observers.add(observer)
+}
+
+func (sm *stateMachineImpl[C]) dropEvent(event *queuedEvent, reason DropReason) {
+	if sm.DebugLogger != nil {
+		sm.DebugLogger("Drop Event", "event", reflect.TypeOf(event.event), "reason", reason, "id", event.metadata.ID)
+	}
+	for _, o := range sm.observers.dropped {
+		o.OnEventDropped(event.event, event.metadata, reason)
+	}
+}
+
+func (sm *stateMachineImpl[C]) stateEntered(state *stateImpl[C]) {
+	for _, o := range sm.observers.states {
+		o.OnStateEntered(state.id)
+	}
+}
+
+func (sm *stateMachineImpl[C]) stateExited(state *stateImpl[C]) {
+	for _, o := range sm.observers.states {
+		o.OnStateExited(state.id)
+	}
+}
+
+func (sm *stateMachineImpl[C]) reacted(event Event, state *stateImpl[C], result ReactionResult) {
+	target := INVALID_STATE_ID
+	if result.status == TRANSIT && result.targetState != nil {
+		target = result.targetState.(*stateImpl[C]).id
+	}
+	for _, o := range sm.observers.reactions {
+		o.OnReaction(event, state.id, result.status, target)
+	}
+}
+
+// Reports the documented action of a reaction to the observers
+func (sm *stateMachineImpl[C]) actionRun(event Event, handler *reactionHandler[C], action string) {
+	for _, o := range sm.observers.actions {
+		o.OnAction(event, handler.state.id, action)
+	}
+}
+
+// Returns the documented action of the reaction that produced `result`, empty if none
+func documentedAction[C any](handler *reactionHandler[C], result ReactionResult) string {
+	for _, doc := range handler.umlDoc {
+		if doc.ReactionResult != result.status {
+			continue
+		}
+		if result.status != TRANSIT || doc.TargetState == result.targetState.(*stateImpl[C]).id {
+			return doc.ActionText
+		}
+	}
+	return ""
+}
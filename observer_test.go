@@ -0,0 +1,41 @@
+package statechart
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Implements Observer and StateObserver only, without ObserverDefault
+type StateTracer struct {
+	log string
+}
+
+func (o *StateTracer) OnEventDropped(event Event, metadata EventMetadata, reason DropReason) {
+	o.log += "dropped "
+}
+
+func (o *StateTracer) OnStateEntered(state StateId) {
+	o.log += fmt.Sprintf("+%d ", state)
+}
+
+func (o *StateTracer) OnStateExited(state StateId) {
+	o.log += fmt.Sprintf("-%d ", state)
+}
+
+func TestObserverOptionalHooks(t *testing.T) {
+	tracer := &StateTracer{}
+	sm := makeCounterStateMachine(&CounterContext{}, WithObserver(tracer))
+	sm.DispatchEvent(&CounterStartEvent{})
+	assert.Equal(t, "+0 -0 +1 ", tracer.log)
+	set := observerSet{}
+	set.add(tracer)
+	assert.Len(t, set.states, 1)
+	assert.Empty(t, set.transitions)
+	assert.Empty(t, set.reactions)
+	assert.Empty(t, set.actions)
+	set.add(&ObserverDefault{})
+	assert.Len(t, set.transitions, 1)
+	assert.Len(t, set.dropped, 2)
+}
@@ -0,0 +1,136 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"time"
+)
+
+// The policy applied when an event is deferred while the deferred queue is full
+type OverflowPolicy int16
+
+const (
+	// Drops the oldest deferred event to make room for the new one
+	DROP_OLDEST OverflowPolicy = iota
+	// Drops the event being deferred
+	DROP_NEWEST
+	// Panics
+	PANIC_ON_OVERFLOW
+)
+
+// The Clock interface is the time source of a state machine
+type Clock interface {
+	Now() time.Time
+}
+
+// The options of a state machine instance
+type machineOptions struct {
+	maxDeferredEvents int
+	overflowPolicy    OverflowPolicy
+	clock             Clock
+	observers         observerSet
+	// a super state without a starting state can be the active state
+	allowSuperStateLeaf bool
+	actionFailurePolicy ActionFailurePolicy
+	// generates the IDs of the events dispatched or posted without an ID
+	eventIdGenerator func() string
+	invariantPolicy  InvariantPolicy
+}
+
+// Option configures a state machine instance, see MakeStateMachine
+type Option func(*machineOptions)
+
+// Limits the number of deferred events
+// `max` the maximum size of the deferred queue (0 for no limit)
+// `policy` what to do when an event is deferred while the queue is full
+func WithMaxDeferredEvents(max int, policy OverflowPolicy) Option {
+	return func(o *machineOptions) {
+		o.maxDeferredEvents = max
+		o.overflowPolicy = policy
+	}
+}
+
+// Sets the time source of the state machine (the default is the system clock)
+func WithClock(clock Clock) Option {
+	return func(o *machineOptions) {
+		o.clock = clock
+	}
+}
+
+// Adds an observer to the state machine
+func WithObserver(observer Observer) Option {
+	return func(o *machineOptions) {
+		o.observers.add(observer)
+	}
+}
+
+// Allows a super state without a starting state to be the active state (the leaf of the
+// active configuration), for example while a sub-state is selected asynchronously.
+// Without this option entering such a super state panics.
+// A LOCAL transition from the super state to one of its sub-states enters the sub-state
+// without exiting the super state.
+func WithSuperStateLeaf() Option {
+	return func(o *machineOptions) {
+		o.allowSuperStateLeaf = true
+	}
+}
+
+// Sets what the state machine does when an action returns an error (CONTINUE_ON_FAILURE by
+// default). The failure is reported to the observers and posted as an ActionFailedEvent.
+// `policy` the failure policy, ABORT_TO_ERROR_STATE requires an error state (see SetErrorState)
+func WithActionFailurePolicy(policy ActionFailurePolicy) Option {
+	return func(o *machineOptions) {
+		o.actionFailurePolicy = policy
+	}
+}
+
+// Sets the generator of the event IDs, used for the events dispatched or posted without an ID
+// (see EventMetadata). Without a generator only the IDs set by the sender are used.
+func WithEventIdGenerator(generator func() string) Option {
+	return func(o *machineOptions) {
+		o.eventIdGenerator = generator
+	}
+}
+
+// Enables the checks of the state invariants (see StateSetupProxy.SetInvariant): after each
+// run-to-completion step, the invariants of the active state and its ancestors are evaluated.
+// The checks are disabled by default, except with the build tag statechart_debug where the
+// violations panic.
+// `policy` what to do with the violations
+func WithInvariantChecks(policy InvariantPolicy) Option {
+	return func(o *machineOptions) {
+		o.invariantPolicy = policy
+	}
+}
+
+// Returns the current time of the state machine clock, see also stateMachineImpl.now
+func (o *machineOptions) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock.Now()
+}
+
+// Returns the current time of the state machine: the recorded time during the step of a replayed
+// event (see Replay), the clock time otherwise
+func (sm *stateMachineImpl[C]) now() time.Time {
+	if sm.replayStep {
+		return sm.replayTime
+	}
+	return sm.machineOptions.now()
+}
+
+// Returns the settings made by the options
+func makeOptions(options []Option) machineOptions {
+	o := machineOptions{}
+	o.apply(options)
+	return o
+}
+
+func (o *machineOptions) apply(options []Option) {
+	o.invariantPolicy = defaultInvariantPolicy
+	for _, option := range options {
+		option(o)
+	}
+}
@@ -0,0 +1,315 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The ContextCodec interface serializes the user context in the snapshots
+type ContextCodec[C any] interface {
+	// Serializes the user context
+	EncodeContext(userContext *C) ([]byte, error)
+	// Restores the user context from its serialized form
+	DecodeContext(data []byte, userContext *C) error
+}
+
+// A ContextCodec serializing the exported fields of the user context in JSON
+type JsonContextCodec[C any] struct {
+}
+
+func (JsonContextCodec[C]) EncodeContext(userContext *C) ([]byte, error) {
+	return json.Marshal(userContext)
+}
+
+func (JsonContextCodec[C]) DecodeContext(data []byte, userContext *C) error {
+	return json.Unmarshal(data, userContext)
+}
+
+// A queued event of a snapshot
+type SnapshotEvent struct {
+	// the event serialized by the event registry (see EventRegistry.MarshalEvent)
+	Event    json.RawMessage `json:"event"`
+	Metadata EventMetadata   `json:"metadata"`
+	// when the event was first deferred (zero if it is not deferred)
+	DeferredAt time.Time `json:"deferredAt"`
+	// the time to live of the deferred event (0 for no limit)
+	DeferTTL time.Duration `json:"deferTTL,omitempty"`
+}
+
+// The snapshot of a state machine between two run-to-completion steps
+type Snapshot struct {
+	// the version of the snapshot schema (see SnapshotSchema)
+	Version int `json:"version"`
+	// the path of the active state (see StatePath), its ancestors are the rest of the active
+	// configuration. It is empty if the state machine is stopped.
+	State string `json:"state"`
+	// true if the state machine is stopped (see STOP_ON_FAILURE)
+	Stopped bool `json:"stopped,omitempty"`
+	// the deferred events, in the order they were deferred
+	Deferred []SnapshotEvent `json:"deferred,omitempty"`
+	// the events posted but not processed yet, they are processed when the snapshot is restored
+	Posted []SnapshotEvent `json:"posted,omitempty"`
+	// the user context serialized by the ContextCodec
+	Context []byte `json:"context,omitempty"`
+	// when the snapshot was taken
+	Time time.Time `json:"time"`
+	// the number of records of the event log included in the snapshot (see
+	// NewEventSourcedStateMachine)
+	LogSeq int `json:"logSeq,omitempty"`
+}
+
+// Returns the snapshot of the state machine, the queued events are serialized with the event
+// registry (see SetEventRegistry)
+func (sm *stateMachineImpl[C]) snapshot() (Snapshot, error) {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	if !sm.initialized {
+		panic("State Machine not Initialized")
+	}
+	snapshot := Snapshot{Stopped: sm.stopped, Time: sm.now()}
+	if sm.currentState != nil {
+		snapshot.State = sm.currentState.path()
+	}
+	var err error
+	if snapshot.Deferred, err = sm.snapshotEvents(&sm.deferredEvents); err != nil {
+		return snapshot, err
+	}
+	snapshot.Posted, err = sm.snapshotEvents(&sm.postedEvents)
+	return snapshot, err
+}
+
+func (sm *stateMachineImpl[C]) snapshotEvents(queue *eventQueue) ([]SnapshotEvent, error) {
+	if queue.len() == 0 {
+		return nil, nil
+	}
+	if sm.eventRegistry == nil {
+		return nil, errors.New("Queued events require an event registry (see SetEventRegistry)")
+	}
+	events := make([]SnapshotEvent, 0, queue.len())
+	for i := 0; i < queue.len(); i++ {
+		queued := queue.at(i)
+		data, err := sm.eventRegistry.MarshalEvent(queued.event)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, SnapshotEvent{Event: data, Metadata: queued.metadata,
+			DeferredAt: queued.deferredAt, DeferTTL: queued.deferTTL})
+	}
+	return events, nil
+}
+
+// Restores a snapshot in place of the initial transition, the entry actions are not run and the
+// do-activities of the active configuration are started. Like Initialize, it processes the posted
+// events of the snapshot before it returns.
+// The definition must be built and the state machine not started. The user context is decoded
+// after the snapshot is validated, so the machine and its context are unchanged if it fails.
+// `codec` the user context codec, nil to not restore the user context
+func (sm *stateMachineImpl[C]) restore(snapshot *Snapshot, codec ContextCodec[C]) error {
+	if sm.initialized {
+		panic("Cannot restore a snapshot after calling Initialize")
+	}
+	var state *stateImpl[C]
+	if snapshot.State != "" {
+		if state = sm.findStatePath(snapshot.State); state == nil {
+			return fmt.Errorf("Unknown state in snapshot (version %d): %s", snapshot.Version, snapshot.State)
+		}
+		if state.isSuperState && !sm.allowSuperStateLeaf {
+			return fmt.Errorf("The snapshot state is a super state: %s (see WithSuperStateLeaf)", state.name)
+		}
+	} else if !snapshot.Stopped {
+		return errors.New("Invalid state in snapshot: only a stopped machine has no state")
+	}
+	deferred, err := sm.restoreEvents(snapshot.Deferred, true)
+	if err != nil {
+		return err
+	}
+	posted, err := sm.restoreEvents(snapshot.Posted, false)
+	if err != nil {
+		return err
+	}
+	if codec != nil && snapshot.Context != nil {
+		if err := codec.DecodeContext(snapshot.Context, sm.userContext); err != nil {
+			return err
+		}
+	}
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	sm.initialized = true
+	sm.currentState = state
+	sm.stopped = snapshot.Stopped
+	for _, event := range deferred {
+		sm.pushDeferred(event)
+	}
+	for _, event := range posted {
+		sm.postedEvents.pushBack(event)
+	}
+	// the entry actions are not run again, but the do-activities are started and the posted
+	// events are processed
+	sm.resumeActivities()
+	if !sm.stopped {
+		sm.runPostedEvents()
+	}
+	return nil
+}
+
+// Rebuilds the queued events of a snapshot
+// `deferred` true for the deferred events
+func (sm *stateMachineImpl[C]) restoreEvents(events []SnapshotEvent, deferred bool) ([]queuedEvent, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	if sm.eventRegistry == nil {
+		return nil, errors.New("Queued events require an event registry (see SetEventRegistry)")
+	}
+	queued := make([]queuedEvent, 0, len(events))
+	for _, e := range events {
+		event, err := sm.eventRegistry.UnmarshalEvent(e.Event)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, queuedEvent{event: event, deferred: deferred, deferredAt: e.DeferredAt,
+			deferTTL: e.DeferTTL, metadata: e.Metadata, enqueued: true})
+	}
+	return queued, nil
+}
+
+// The snapshot settings of the persistent and event-sourced state machines
+type snapshotConfig[C any] struct {
+	store  Store
+	key    string
+	codec  ContextCodec[C]
+	schema *SnapshotSchema
+}
+
+// Loads the snapshot and migrates it to the current version of the schema
+// returns nil if the store has no snapshot for the key
+func (c *snapshotConfig[C]) load() (*Snapshot, error) {
+	data, err := c.store.Load(c.key)
+	if errors.Is(err, ErrSnapshotNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, c.schema.Migrate(snapshot)
+}
+
+// Builds a state machine and restores a snapshot with its user context
+func (c *snapshotConfig[C]) restore(machine *StateMachine[C], snapshot *Snapshot, initStateId StateId) error {
+	machine.setupMutex.Lock()
+	defer machine.setupMutex.Unlock()
+	impl := &machine.impl
+	if impl.initialized {
+		panic("Cannot restore a snapshot after calling Initialize")
+	}
+	// the definition is built to find the snapshot state, the machine can still be initialized
+	// if restoring fails
+	impl.buildDefinition(initStateId)
+	return impl.restore(snapshot, c.codec)
+}
+
+// Saves the snapshot of a state machine with its user context
+func (c *snapshotConfig[C]) save(machine *StateMachine[C], logSeq int) error {
+	snapshot, err := machine.impl.snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.Version = c.schema.Version()
+	snapshot.LogSeq = logSeq
+	if c.codec != nil {
+		if snapshot.Context, err = c.codec.EncodeContext(machine.impl.userContext); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return c.store.Save(c.key, data)
+}
+
+// A state machine saving a snapshot to a Store after each run-to-completion step, to survive
+// the restart of the process. The snapshot holds the active state, the deferred and posted
+// events (serialized with the event registry, see SetEventRegistry) and the user context
+// (serialized with the ContextCodec).
+// The events must all be dispatched through the persistent state machine.
+type PersistentStateMachine[C any] struct {
+	machine   *StateMachine[C]
+	snapshots snapshotConfig[C]
+}
+
+// Creates a persistent state machine
+// `machine` the state machine, with its states added but not initialized
+// `store` the store of the snapshots
+// `key` the key of the snapshots of the machine in the store
+// `codec` the user context codec, nil to not save the user context
+func NewPersistentStateMachine[C any](machine *StateMachine[C], store Store, key string, codec ContextCodec[C]) *PersistentStateMachine[C] {
+	return &PersistentStateMachine[C]{machine: machine, snapshots: snapshotConfig[C]{store: store, key: key, codec: codec}}
+}
+
+// Returns the wrapped state machine
+func (p *PersistentStateMachine[C]) Machine() *StateMachine[C] {
+	return p.machine
+}
+
+// Sets the schema of the snapshots: their version and the migrations of the snapshots of the
+// previous versions. It must be called before Start.
+// `schema` the snapshot schema
+func (p *PersistentStateMachine[C]) SetSnapshotSchema(schema *SnapshotSchema) {
+	p.snapshots.schema = schema
+}
+
+// Starts the state machine from its last snapshot, or initializes it (and saves its first
+// snapshot) when the store has no snapshot for the key
+// `initStateId` the initial starting state
+// returns true if the machine was restored from a snapshot, ErrNoMigrationPath if the snapshot
+// version cannot be migrated
+func (p *PersistentStateMachine[C]) Start(initStateId StateId) (bool, error) {
+	snapshot, err := p.snapshots.load()
+	if err != nil {
+		return false, err
+	}
+	if snapshot == nil {
+		p.machine.Initialize(initStateId)
+		return false, p.Checkpoint()
+	}
+	return true, p.snapshots.restore(p.machine, snapshot, initStateId)
+}
+
+// Dispatches an event, then saves the snapshot
+// `event` The Event to dispatch
+// returns the error saving the snapshot
+func (p *PersistentStateMachine[C]) DispatchEvent(event Event) error {
+	return p.dispatch(queuedEvent{event: event})
+}
+
+// Dispatches an event with a context, then saves the snapshot
+// `ctx` the context of the event (see StateMachine.DispatchEventContext)
+// `event` The Event to dispatch
+// returns the error saving the snapshot
+func (p *PersistentStateMachine[C]) DispatchEventContext(ctx context.Context, event Event) error {
+	return p.dispatch(queuedEvent{event: event, ctx: ctx})
+}
+
+func (p *PersistentStateMachine[C]) dispatch(event queuedEvent) error {
+	p.machine.dispatchMutex.Lock()
+	defer p.machine.dispatchMutex.Unlock()
+	p.machine.impl.dispatch(event)
+	return p.snapshots.save(p.machine, 0)
+}
+
+// Saves the snapshot of the state machine
+func (p *PersistentStateMachine[C]) Checkpoint() error {
+	p.machine.dispatchMutex.Lock()
+	defer p.machine.dispatchMutex.Unlock()
+	return p.snapshots.save(p.machine, 0)
+}
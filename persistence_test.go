@@ -0,0 +1,231 @@
+package statechart
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type OrderContext struct {
+	Items int
+	log   string
+}
+
+type AddItemEvent struct {
+	EventDefault
+	Count int
+}
+
+type CheckoutEvent struct {
+	EventDefault
+}
+
+type PayEvent struct {
+	EventDefault
+}
+
+type ShipEvent struct {
+	EventDefault
+}
+
+type OrderCart struct {
+	StateDefault[OrderContext]
+}
+
+func (s *OrderCart) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *AddItemEvent) ReactionResult {
+		s.GetContext().Items += e.Count
+		return proxy.Discard()
+	})
+	AddSimpleStateTransition[CheckoutEvent, OrderPaying](proxy, nil)
+	return func() { s.GetContext().log += "+Cart " }, nil
+}
+
+type OrderPaying struct {
+	StateDefault[OrderContext]
+}
+
+func (s *OrderPaying) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddDefer[ShipEvent](proxy)
+	AddSimpleStateTransition[PayEvent, OrderShipping](proxy, nil)
+	return func() { s.GetContext().log += "+Paying " }, nil
+}
+
+type OrderShipping struct {
+	StateDefault[OrderContext]
+}
+
+func (s *OrderShipping) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[ShipEvent, OrderShipped](proxy, nil)
+	return func() { s.GetContext().log += "+Shipping " }, nil
+}
+
+type OrderShipped struct {
+	StateDefault[OrderContext]
+}
+
+func (s *OrderShipped) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	return func() { s.GetContext().log += "+Shipped " }, nil
+}
+
+func makeOrderEventRegistry() *EventRegistry {
+	registry := MakeEventRegistry()
+	RegisterEvent[AddItemEvent](&registry, "order.add-item")
+	RegisterEvent[CheckoutEvent](&registry, "order.checkout")
+	RegisterEvent[PayEvent](&registry, "order.pay")
+	RegisterEvent[ShipEvent](&registry, "order.ship")
+	return &registry
+}
+
+func makePersistentOrder(ctx *OrderContext, store Store, registry *EventRegistry) *PersistentStateMachine[OrderContext] {
+	sm := MakeStateMachine(ctx)
+	if registry != nil {
+		sm.SetEventRegistry(registry)
+	}
+	sm.AddState(&OrderCart{})
+	sm.AddState(&OrderPaying{})
+	sm.AddState(&OrderShipping{})
+	sm.AddState(&OrderShipped{})
+	return NewPersistentStateMachine[OrderContext](&sm, store, "order-1", JsonContextCodec[OrderContext]{})
+}
+
+func TestPersistentStateMachine(t *testing.T) {
+	store := MakeMemoryStore()
+	ctx := OrderContext{}
+	order := makePersistentOrder(&ctx, &store, makeOrderEventRegistry())
+	restored, err := order.Start(0)
+	assert.NoError(t, err)
+	assert.False(t, restored)
+	assert.NoError(t, order.DispatchEvent(&AddItemEvent{Count: 2}))
+	assert.NoError(t, order.DispatchEvent(&CheckoutEvent{}))
+	ship := ContextWithEventMetadata(context.Background(), EventMetadata{ID: "ship-1"})
+	assert.NoError(t, order.DispatchEventContext(ship, &ShipEvent{}))
+
+	// the process restarts
+	restartedCtx := OrderContext{}
+	restarted := makePersistentOrder(&restartedCtx, &store, makeOrderEventRegistry())
+	restored, err = restarted.Start(0)
+	assert.NoError(t, err)
+	assert.True(t, restored)
+	assert.Equal(t, 2, restartedCtx.Items)
+	// the entry actions are not run again
+	assert.Empty(t, restartedCtx.log)
+	assert.Equal(t, "OrderPaying", restarted.Machine().Configuration()[0].Name)
+	deferred := restarted.Machine().DeferredEvents()
+	assert.Len(t, deferred, 1)
+	// the metadata of the dispatch is restored with the event
+	assert.Equal(t, "ship-1", restarted.Machine().impl.deferredEvents.at(0).metadata.ID)
+
+	assert.NoError(t, restarted.DispatchEvent(&PayEvent{}))
+	assert.Equal(t, "+Shipping +Shipped ", restartedCtx.log)
+	assert.Equal(t, "OrderShipped", restarted.Machine().Configuration()[0].Name)
+}
+
+func TestPersistentStateMachineWithoutRegistry(t *testing.T) {
+	store := MakeMemoryStore()
+	order := makePersistentOrder(&OrderContext{}, &store, nil)
+	_, err := order.Start(0)
+	assert.NoError(t, err)
+	assert.NoError(t, order.DispatchEvent(&CheckoutEvent{}))
+	err = order.DispatchEvent(&ShipEvent{})
+	assert.EqualError(t, err, "Queued events require an event registry (see SetEventRegistry)")
+}
+
+func TestPersistentStateMachineInvalidSnapshot(t *testing.T) {
+	store := MakeMemoryStore()
+	data, err := json.Marshal(Snapshot{State: "OrderGone", Context: []byte(`{"Items":5}`)})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Save("order-1", data))
+
+	ctx := OrderContext{}
+	order := makePersistentOrder(&ctx, &store, makeOrderEventRegistry())
+	_, err = order.Start(0)
+	assert.EqualError(t, err, "Unknown state in snapshot (version 0): OrderGone")
+	// the context is not decoded, and the machine can still be initialized
+	assert.Equal(t, 0, ctx.Items)
+	order.Machine().Initialize(0)
+	assert.Equal(t, "+Cart ", ctx.log)
+	assert.NoError(t, order.DispatchEvent(&CheckoutEvent{}))
+	assert.Equal(t, "OrderPaying", order.Machine().Configuration()[0].Name)
+}
+
+func TestPersistentStateMachinePostedEvents(t *testing.T) {
+	store := MakeMemoryStore()
+	registry := makeOrderEventRegistry()
+	pay, err := registry.MarshalEvent(&PayEvent{})
+	assert.NoError(t, err)
+	ship, err := registry.MarshalEvent(&ShipEvent{})
+	assert.NoError(t, err)
+	data, err := json.Marshal(Snapshot{
+		State:    "OrderPaying",
+		Deferred: []SnapshotEvent{{Event: ship}},
+		Posted:   []SnapshotEvent{{Event: pay}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Save("order-1", data))
+
+	// the posted events of the snapshot are processed before Start returns
+	ctx := OrderContext{}
+	order := makePersistentOrder(&ctx, &store, registry)
+	restored, err := order.Start(0)
+	assert.NoError(t, err)
+	assert.True(t, restored)
+	assert.Equal(t, "+Shipping +Shipped ", ctx.log)
+	assert.Equal(t, "OrderShipped", order.Machine().Configuration()[0].Name)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := MemoryStore{}
+	_, err := store.Load("order-1")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	data := []byte("snapshot")
+	assert.NoError(t, store.Save("order-1", data))
+	data[0] = 'S'
+	loaded, err := store.Load("order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("snapshot"), loaded)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := MakeFileStore(dir)
+	_, err := store.Load("order-1")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	assert.NoError(t, store.Save("order-1", []byte("first")))
+	assert.NoError(t, store.Save("order-1", []byte("second")))
+	loaded, err := store.Load("order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), loaded)
+	// no temporary file is left
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "order-1.snapshot", files[0].Name())
+
+	assert.Error(t, store.Save(filepath.Join("..", "order-1"), []byte("escape")))
+	_, err = store.Load("")
+	assert.Error(t, err)
+}
+
+func TestPersistentStateMachineFileStore(t *testing.T) {
+	store := MakeFileStore(t.TempDir())
+	ctx := OrderContext{}
+	order := makePersistentOrder(&ctx, store, makeOrderEventRegistry())
+	_, err := order.Start(0)
+	assert.NoError(t, err)
+	assert.NoError(t, order.DispatchEvent(&AddItemEvent{Count: 3}))
+
+	restartedCtx := OrderContext{}
+	restored, err := makePersistentOrder(&restartedCtx, store, makeOrderEventRegistry()).Start(0)
+	assert.NoError(t, err)
+	assert.True(t, restored)
+	assert.Equal(t, 3, restartedCtx.Items)
+}
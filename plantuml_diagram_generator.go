@@ -3,6 +3,7 @@ package statechart
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 // struct to inverse the tree from (child -> parent) to (parent -> children)
@@ -47,12 +48,35 @@ func makeStateTree[C any](states []*stateImpl[C]) stateNode[C] {
 	return root
 }
 
+// Returns the stereotype of the state (the sub machine states and the final states)
+func plantUmlStereotype[C any](state *stateImpl[C]) string {
+	if state.isSubMachine {
+		return " <<submachine>>"
+	}
+	if isFinalState(state.userState) {
+		return " <<end>>"
+	}
+	return ""
+}
+
+// Prints an entry or exit point and the transition to its target
+func plantUmlPrintPseudoState[C any](w io.Writer, state *stateImpl[C], tab string) {
+	stereotype := "<<entryPoint>>"
+	if state.pseudo == exitPoint {
+		stereotype = "<<exitPoint>>"
+	}
+	fmt.Fprintf(w, "%sstate %s %s\n", tab, state.name, stereotype)
+	if state.redirect != nil {
+		fmt.Fprintf(w, "%s%s -> %s \n", tab, state.name, state.redirect.name)
+	}
+}
+
 // Prints the header of the state
 func plantUmlPrintStateHeader[C any](w io.Writer, node *stateNode[C], withParentName bool, tab string) {
 	if withParentName && node.self.parent != nil {
-		fmt.Fprintf(w, "%sstate \"%s : %s\" as %s {\n", tab, node.self.name, node.self.parent.name, node.self.name)
+		fmt.Fprintf(w, "%sstate \"%s : %s\" as %s%s {\n", tab, node.self.name, node.self.parent.name, node.self.name, plantUmlStereotype(node.self))
 	} else {
-		fmt.Fprintf(w, "%sstate %s {\n", tab, node.self.name)
+		fmt.Fprintf(w, "%sstate %s%s {\n", tab, node.self.name, plantUmlStereotype(node.self))
 	}
 }
 
@@ -61,7 +85,20 @@ func plantUmlPrintStateFooter[C any](w io.Writer, node *stateNode[C], tab string
 	fmt.Fprintf(w, "%s}\n", tab)
 }
 
-func plantUmlPrintStateInnerActions[C any](w io.Writer, node *stateNode[C], tab string) {
+// Returns true if a documented reaction of a state is not covered (see Coverage)
+// `reaction` the index of the reaction in the state
+// `doc` the index of the UmlDocReaction in the reaction
+type plantUmlUncovered[C any] func(state *stateImpl[C], reaction int, doc int) bool
+
+// Returns the color of a documented reaction: red if it is not covered
+func plantUmlColor[C any](uncovered plantUmlUncovered[C], state *stateImpl[C], reaction int, doc int) (string, string) {
+	if uncovered != nil && uncovered(state, reaction, doc) {
+		return "<color:red>", "</color>"
+	}
+	return "", ""
+}
+
+func plantUmlPrintStateInnerActions[C any](w io.Writer, node *stateNode[C], tab string, uncovered plantUmlUncovered[C]) {
 
 	if node.self.enterAction != nil {
 		fmt.Fprintf(w, "%s%s: entry / With Action \n", tab, node.self.name)
@@ -70,18 +107,27 @@ func plantUmlPrintStateInnerActions[C any](w io.Writer, node *stateNode[C], tab
 	if node.self.exitAction != nil {
 		fmt.Fprintf(w, "%s%s: exit / With Action \n", tab, node.self.name)
 	}
+	// do-activity
+	if node.self.doActivity != nil {
+		fmt.Fprintf(w, "%s%s: do / Activity \n", tab, node.self.name)
+	}
 	// in state events
-	for _, ev := range node.self.events {
-		for _, umlDoc := range ev.umlDoc {
+	for i, ev := range node.self.events {
+		for j, umlDoc := range ev.umlDoc {
+			begin, end := plantUmlColor(uncovered, node.self, i, j)
 			switch umlDoc.ReactionResult {
 			case DISCARD:
 				if len(umlDoc.ActionText) == 0 {
-					fmt.Fprintf(w, "%s%s: %s[%s] / DISCARD \n", tab, node.self.name, ev.docEventName, umlDoc.GuardText)
+					fmt.Fprintf(w, "%s%s: %s%s[%s] / DISCARD%s \n", tab, node.self.name, begin, ev.docEventName, umlDoc.GuardText, end)
 				} else {
-					fmt.Fprintf(w, "%s%s: %s[%s] / %s \n", tab, node.self.name, ev.docEventName, umlDoc.GuardText, umlDoc.ActionText)
+					fmt.Fprintf(w, "%s%s: %s%s[%s] / %s%s \n", tab, node.self.name, begin, ev.docEventName, umlDoc.GuardText, umlDoc.ActionText, end)
 				}
 			case DEFER:
-				fmt.Fprintf(w, "%s%s: %s[%s] / DEFER \n", tab, node.self.name, ev.docEventName, umlDoc.GuardText)
+				if len(umlDoc.ActionText) == 0 {
+					fmt.Fprintf(w, "%s%s: %s%s[%s] / DEFER%s \n", tab, node.self.name, begin, ev.docEventName, umlDoc.GuardText, end)
+				} else {
+					fmt.Fprintf(w, "%s%s: %s%s[%s] / DEFER (%s)%s \n", tab, node.self.name, begin, ev.docEventName, umlDoc.GuardText, umlDoc.ActionText, end)
+				}
 			}
 		}
 	}
@@ -89,29 +135,42 @@ func plantUmlPrintStateInnerActions[C any](w io.Writer, node *stateNode[C], tab
 }
 
 // Print the body of the state, and recursively print the sub states
-func plantUmlPrintStateBody[C any](w io.Writer, node *stateNode[C], tab string) {
+func plantUmlPrintStateBody[C any](w io.Writer, node *stateNode[C], tab string, uncovered plantUmlUncovered[C]) {
 
 	// the root node has no state element just children
 	if node.self != nil {
-		plantUmlPrintStateInnerActions(w, node, tab)
+		plantUmlPrintStateInnerActions(w, node, tab, uncovered)
 		// starting state
 		if node.self.isSuperState && node.self.startingState != nil {
 			fmt.Fprintf(w, "%s[*] -> %s \n", tab, node.self.startingState.name)
+		} else if node.self.subMachineEntry != nil {
+			fmt.Fprintf(w, "%s[*] -> %s \n", tab, node.self.subMachineEntry.name)
 		}
 	}
 	// children
 	for _, n := range node.children {
+		if n.self.pseudo != notPseudo {
+			plantUmlPrintPseudoState(w, n.self, tab)
+			continue
+		}
+		if isFinalState(n.self.userState) && len(n.children) == 0 {
+			// a final state has no body
+			fmt.Fprintf(w, "%sstate %s <<end>>\n", tab, n.self.name)
+			continue
+		}
 		plantUmlPrintStateHeader(w, n, false, tab)
-		plantUmlPrintStateBody(w, n, tab+"  ")
+		plantUmlPrintStateBody(w, n, tab+"  ", uncovered)
 		plantUmlPrintStateFooter(w, n, tab)
 	}
 }
 
 // Print the body of the state, and recursively print the sub states
-func plantUmlPrintStateBodyFlat[C any](w io.Writer, node *stateNode[C], tab string) {
+func plantUmlPrintStateBodyFlat[C any](w io.Writer, node *stateNode[C], tab string, uncovered plantUmlUncovered[C]) {
 
 	// the root node has no state element just children
-	if node.self != nil {
+	if node.self != nil && node.self.pseudo != notPseudo {
+		plantUmlPrintPseudoState(w, node.self, tab)
+	} else if node.self != nil {
 		plantUmlPrintStateHeader(w, node, true, tab)
 		// starting state
 		if node.self.isSuperState {
@@ -120,38 +179,52 @@ func plantUmlPrintStateBodyFlat[C any](w io.Writer, node *stateNode[C], tab stri
 				fmt.Fprintf(w, "%s%s: Starting-State = %s \n", tab+"  ", node.self.name, node.self.startingState.name)
 			}
 		}
-		plantUmlPrintStateInnerActions(w, node, tab+"  ")
+		plantUmlPrintStateInnerActions(w, node, tab+"  ", uncovered)
 
 		plantUmlPrintStateFooter(w, node, tab)
 	}
 	// children
 	for _, n := range node.children {
-		plantUmlPrintStateBodyFlat(w, n, tab)
+		plantUmlPrintStateBodyFlat(w, n, tab, uncovered)
 	}
 }
 
-func plantUmlPrint[C any](w io.Writer, sm *stateMachineImpl[C], diagramType UmlDiagramType) {
+// Prints the diagram of a definition
+// `uncovered` highlights the uncovered reactions in red, nil to print the plain diagram
+func plantUmlPrint[C any](w io.Writer, sm *definitionImpl[C], diagramType UmlDiagramType, uncovered plantUmlUncovered[C]) {
 
 	fmt.Fprintf(w, "@startuml\n")
 	root := makeStateTree(sm.states)
 	if diagramType == HIERARCHY_ONLY || diagramType == HIERARCHY_WITH_TRANSITION {
-		plantUmlPrintStateBody(w, &root, "")
+		plantUmlPrintStateBody(w, &root, "", uncovered)
 	} else if diagramType == FLAT_WITH_TRANSITION {
-		plantUmlPrintStateBodyFlat(w, &root, "")
+		plantUmlPrintStateBodyFlat(w, &root, "", uncovered)
 	}
 
 	if diagramType == HIERARCHY_WITH_TRANSITION || diagramType == FLAT_WITH_TRANSITION {
 		// print Transitions
 		for _, s := range sm.states {
-			for _, ev := range s.events {
-				for _, umlDoc := range ev.umlDoc {
+			for i, ev := range s.events {
+				for j, umlDoc := range ev.umlDoc {
 					switch umlDoc.ReactionResult {
 					case TRANSIT:
 						toStateName := "Unknown"
 						if umlDoc.TargetState != INVALID_STATE_ID {
 							toStateName = sm.getState(umlDoc.TargetState).name
 						}
-						fmt.Fprintf(w, "%s -> %s : %s", s.name, toStateName, ev.docEventName)
+						// a local transition is drawn with a dashed arrow, an uncovered one in red
+						style := []string{}
+						if ev.local {
+							style = append(style, "dashed")
+						}
+						if uncovered != nil && uncovered(s, i, j) {
+							style = append(style, "#red")
+						}
+						arrow := "->"
+						if len(style) != 0 {
+							arrow = "-[" + strings.Join(style, ",") + "]->"
+						}
+						fmt.Fprintf(w, "%s %s %s : %s", s.name, arrow, toStateName, ev.docEventName)
 						if len(umlDoc.GuardText) != 0 {
 							fmt.Fprintf(w, "[%s]", umlDoc.GuardText)
 						}
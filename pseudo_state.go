@@ -0,0 +1,127 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+type pseudoKind int
+
+const (
+	notPseudo pseudoKind = iota
+	entryPoint
+	exitPoint
+)
+
+// Returns the entry or exit point `name` of `parent` (nil for the top points of the machine),
+// the point is created if it doesn't exist yet
+func (d *definitionImpl[C]) pseudoState(parent *stateImpl[C], scope *stateImpl[C], kind pseudoKind, name string) *stateImpl[C] {
+	for _, state := range d.states {
+		if state.pseudo == kind && state.parent == parent && state.scope == scope && state.key == name {
+			return state
+		}
+	}
+	if d.built {
+		panic("Entry or exit point not found: " + name)
+	}
+	point := &stateImpl[C]{id: StateId(len(d.states)), key: name, definition: d, parent: parent, scope: scope, pseudo: kind}
+	d.states = append(d.states, point)
+	return point
+}
+
+// Finds an existing exit point of the state or its ancestors
+func (s *stateImpl[C]) findExitPoint(name string) *stateImpl[C] {
+	for ancestor := s; ancestor != nil; ancestor = ancestor.parent {
+		for _, state := range s.definition.states {
+			if state.pseudo == exitPoint && state.parent == ancestor && state.key == name {
+				return state
+			}
+		}
+	}
+	return nil
+}
+
+func (s *stateImpl[C]) AddEntryPoint(name string) {
+	scope := s.scope
+	if s.parent != nil {
+		scope = s.parent.scope
+	}
+	point := s.definition.pseudoState(s.parent, scope, entryPoint, name)
+	if point.redirect != nil {
+		panic("Entry point already has a target: " + name)
+	}
+	point.redirect = s
+}
+
+func (s *stateImpl[C]) AddExitPoint(name string, target StateId) {
+	point := s.definition.pseudoState(s, s.scope, exitPoint, name)
+	if point.redirect != nil {
+		panic("Exit point already has a target: " + name)
+	}
+	point.redirect = s.definition.getState(target)
+}
+
+func (s *stateImpl[C]) EntryPointId(superState StateId, name string) StateId {
+	parent := s.definition.getState(superState)
+	return s.definition.pseudoState(parent, parent.scope, entryPoint, name).id
+}
+
+func (s *stateImpl[C]) ExitPointId(name string) StateId {
+	if point := s.findExitPoint(name); point != nil {
+		return point.id
+	}
+	if s.scope != nil {
+		// the exit points of a mounted sub machine are added by the sub machine state
+		panic("Exit point not found: " + name)
+	}
+	// an exit point of the definition, wired when it is mounted as a sub machine
+	return s.definition.pseudoState(nil, nil, exitPoint, name).id
+}
+
+// Names the entry and exit points and checks that every entry point has a target
+func (d *definitionImpl[C]) buildPseudoStates() {
+	for _, state := range d.states {
+		if state.pseudo == notPseudo {
+			continue
+		}
+		if state.pseudo == entryPoint && state.redirect == nil {
+			panic("Entry point has no target: " + state.key)
+		}
+		state.name = state.key
+		if state.parent != nil {
+			state.name = state.parent.name + "_" + state.key
+		}
+	}
+}
+
+// Finds the entry point `name` of the super state `S`
+// `S` is the actual user state (the super state)
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `proxy` is the proxy to the internal state in the machine
+// `name` the name of the entry point
+func FindEntryPointId[S any, C any, PS StateCst[S, C]](proxy StateProxy[C], name string) StateId {
+	return proxy.EntryPointId(FindStateId[S, C, PS](proxy), name)
+}
+
+// Add a simple transition to the entry point of a super state
+// `E` is the event type
+// `S` is the actual user state (the super state) that we are going to
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `name` is the name of the entry point
+// `action` is the action associated with the transition (optional)
+func AddSimpleEntryPointTransition[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], name string, action Action[E, PE]) {
+	addSimpleTransition(from, FindEntryPointId[S, C, PS](from, name), action)
+}
+
+// Add a simple transition to an exit point of the state or one of its ancestors
+// `E` is the event type
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `from` is the proxy of the current state
+// `name` is the name of the exit point
+// `action` is the action associated with the transition (optional)
+func AddSimpleExitPointTransition[E any, C any, PE EventCst[E]](from StateSetupProxy[C], name string, action Action[E, PE]) {
+	addSimpleTransition(from, from.ExitPointId(name), action)
+}
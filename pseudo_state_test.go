@@ -0,0 +1,174 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type SessionContext struct {
+	log string
+}
+
+type LoginEvent struct {
+	EventDefault
+}
+
+type ResumeEvent struct {
+	EventDefault
+}
+
+type LogoutEvent struct {
+	EventDefault
+}
+
+type LoggedOut struct {
+	StateDefault[SessionContext]
+}
+
+func (s *LoggedOut) Setup(proxy StateSetupProxy[SessionContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleEntryPointTransition[LoginEvent, Session](proxy, "fresh", nil)
+	AddSimpleEntryPointTransition[ResumeEvent, Session](proxy, "resume", nil)
+	return func() { s.GetContext().log += "LoggedOut " }, nil
+}
+
+// Session is entered through its entry points, and left through its exit point
+type Session struct {
+	StateDefault[SessionContext]
+}
+
+func (s *Session) Setup(proxy StateSetupProxy[SessionContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.AddExitPoint("logout", FindStateId[LoggedOut, SessionContext](proxy))
+	SetStartingState[Browsing](proxy)
+	return func() { s.GetContext().log += "Session " }, nil
+}
+
+type Browsing struct {
+	StateDefault[SessionContext]
+}
+
+func (s *Browsing) Setup(proxy StateSetupProxy[SessionContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.AddEntryPoint("fresh")
+	AddSimpleExitPointTransition[LogoutEvent](proxy, "logout", nil)
+	return func() { s.GetContext().log += "Browsing " }, nil
+}
+
+type Restoring struct {
+	StateDefault[SessionContext]
+}
+
+func (s *Restoring) Setup(proxy StateSetupProxy[SessionContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.AddEntryPoint("resume")
+	AddSimpleExitPointTransition[LogoutEvent](proxy, "logout", nil)
+	return func() { s.GetContext().log += "Restoring " }, nil
+}
+
+func makeSessionStateMachine(ctx *SessionContext) *stateMachineImpl[SessionContext] {
+	sm := &stateMachineImpl[SessionContext]{userContext: ctx}
+	loggedOutId := sm.AddState(&LoggedOut{})
+	sessionId := sm.AddState(&Session{})
+	sm.AddSubState(&Browsing{}, sessionId)
+	sm.AddSubState(&Restoring{}, sessionId)
+	sm.Initialize(loggedOutId)
+	return sm
+}
+
+func TestEntryAndExitPoints(t *testing.T) {
+	ctx := SessionContext{}
+	sm := makeSessionStateMachine(&ctx)
+	sm.DispatchEvent(&ResumeEvent{})
+	assert.Equal(t, "Restoring", sm.currentState.name)
+	sm.DispatchEvent(&LogoutEvent{})
+	assert.Equal(t, "LoggedOut", sm.currentState.name)
+	sm.DispatchEvent(&LoginEvent{})
+	assert.Equal(t, "Browsing", sm.currentState.name)
+	assert.Equal(t, "LoggedOut Session Restoring LoggedOut Session Browsing ", ctx.log)
+}
+
+func TestEntryPointLookup(t *testing.T) {
+	ctx := SessionContext{}
+	sm := makeSessionStateMachine(&ctx)
+	var proxy StateProxy[SessionContext] = sm.states[0]
+	resumeId := FindEntryPointId[Session](proxy, "resume")
+	assert.Equal(t, "Session_resume", sm.states[resumeId].name)
+	assert.Panics(t, func() { FindEntryPointId[Session](proxy, "unknown") })
+}
+
+func TestEntryPointWithoutTarget(t *testing.T) {
+	sm := stateMachineImpl[SessionContext]{}
+	loggedOutId := sm.AddState(&LoggedOut{})
+	sessionId := sm.AddState(&Session{})
+	sm.AddSubState(&Browsing{}, sessionId)
+	assert.PanicsWithValue(t, "Entry point has no target: resume", func() { sm.Initialize(loggedOutId) })
+}
+
+func TestEntryAndExitPointsUml(t *testing.T) {
+	ctx := SessionContext{}
+	sm := makeSessionStateMachine(&ctx)
+	buffer := bytes.Buffer{}
+	sm.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	assert.Contains(t, buffer.String(), "  state Session_logout <<exitPoint>>\n  Session_logout -> LoggedOut \n")
+	assert.Contains(t, buffer.String(), "  state Session_fresh <<entryPoint>>\n  Session_fresh -> Browsing \n")
+	assert.Contains(t, buffer.String(), "LoggedOut -> Session_resume : ResumeEvent\n")
+	assert.Contains(t, buffer.String(), "Browsing -> Session_logout : LogoutEvent\n")
+}
+
+// Redialing is a sub machine entered through its "redial" entry point, and left through its
+// "give-up" exit point
+type Redialing struct {
+	StateDefault[DialContext]
+}
+
+func (s *Redialing) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	proxy.AddEntryPoint("redial")
+	AddSimpleExitPointTransition[DialFailedEvent](proxy, "give-up", nil)
+	AddSimpleStateTransition[DialOkEvent, Dialing](proxy, nil)
+	return func() { s.GetContext().log += proxy.Name() + " " }, nil
+}
+
+type Dialer struct {
+	StateDefault[DialContext]
+}
+
+func (s *Dialer) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	proxy.AddExitPoint("give-up", FindStateId[Offline, DialContext](proxy))
+	return nil, nil
+}
+
+type Offline struct {
+	StateDefault[DialContext]
+}
+
+func (s *Offline) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleEntryPointTransition[LinkEvent, Dialer](proxy, "redial", nil)
+	return func() { s.GetContext().log += "Offline " }, nil
+}
+
+func TestSubMachineEntryAndExitPoints(t *testing.T) {
+	def := MakeDefinition[DialContext]()
+	dialingId := def.AddState(&Dialing{})
+	def.AddState(&Redialing{})
+	def.Build(dialingId)
+
+	ctx := DialContext{}
+	sm := MakeStateMachine(&ctx)
+	offlineId := sm.AddState(&Offline{})
+	sm.AddSubMachine(&Dialer{}, MakeSubMachine(def), INVALID_STATE_ID)
+	sm.Initialize(offlineId)
+
+	sm.DispatchEvent(&LinkEvent{})
+	assert.Equal(t, "Dialer_Redialing", sm.impl.currentState.name)
+	sm.DispatchEvent(&DialFailedEvent{})
+	assert.Equal(t, "Offline", sm.impl.currentState.name)
+	sm.DispatchEvent(&LinkEvent{})
+	sm.DispatchEvent(&DialOkEvent{})
+	assert.Equal(t, "Dialer_Dialing", sm.impl.currentState.name)
+	assert.Equal(t, "Offline Dialer_Redialing Offline Dialer_Redialing Dialer_Dialing ", ctx.log)
+}
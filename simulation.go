@@ -0,0 +1,270 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// A Clock whose time only moves when it is advanced, see Simulation
+type VirtualClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+// Creates a virtual clock
+// `start` the initial time
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+// The identifier of a timer of a simulation
+type TimerId int64
+
+// A timer scheduled on the virtual clock, it dispatches a delayed event or resumes a do-activity
+type simulationTimer struct {
+	id       TimerId
+	due      time.Time
+	event    Event
+	activity *simulationActivity
+}
+
+// A do-activity run by a simulation: it runs in its own goroutine, but only while Advance waits
+// for it, so the activities and the machine never run at the same time
+type simulationActivity struct {
+	ctx      context.Context
+	activity DoActivity
+	done     func(Event)
+	started  bool
+	// the activity waits on resume, and reports on yield if it returned
+	resume chan struct{}
+	yield  chan bool
+	event  Event
+	// schedules the wake-up of the activity
+	schedule func(d time.Duration)
+}
+
+// Waits on the virtual clock (see Sleep)
+func (a *simulationActivity) sleep(d time.Duration) error {
+	if err := a.ctx.Err(); err != nil {
+		return err
+	}
+	a.schedule(d)
+	a.yield <- false
+	<-a.resume
+	return a.ctx.Err()
+}
+
+// Runs the activity until it sleeps or returns, the event it returned is dispatched
+func (a *simulationActivity) step() {
+	if !a.started {
+		a.started = true
+		go func() {
+			a.event = a.activity(a.ctx)
+			a.yield <- true
+		}()
+	} else {
+		a.resume <- struct{}{}
+	}
+	if returned := <-a.yield; returned && a.event != nil {
+		a.done(a.event)
+	}
+}
+
+// The timers ordered by due time, then by scheduling order
+type simulationTimers []*simulationTimer
+
+func (t simulationTimers) Len() int {
+	return len(t)
+}
+
+func (t simulationTimers) Less(i, j int) bool {
+	if t[i].due.Equal(t[j].due) {
+		return t[i].id < t[j].id
+	}
+	return t[i].due.Before(t[j].due)
+}
+
+func (t simulationTimers) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+func (t *simulationTimers) Push(x any) {
+	*t = append(*t, x.(*simulationTimer))
+}
+
+func (t *simulationTimers) Pop() any {
+	old := *t
+	timer := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return timer
+}
+
+// A Simulation runs a state machine on a virtual clock: the timers (delayed events, see After)
+// fire when the clock is advanced (see Advance), in the order of their due time then in the
+// order they were scheduled. An hour of timeouts runs in milliseconds, and every run is the
+// same. The machine clock (event metadata, deferral TTL) is the virtual clock.
+// The do-activities (see DoActivity) only run in Advance, one at a time, and wait on the virtual
+// clock with Sleep: an activity must not wait in another way (e.g. time.Sleep or a channel).
+//
+//	sim := statechart.NewSimulation(&sm, time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC))
+//	sim.After(30*time.Second, &TimeoutEvent{})
+//	sim.Advance(time.Hour)
+type Simulation[C any] struct {
+	machine *StateMachine[C]
+	clock   *VirtualClock
+	timers  simulationTimers
+	nextId  TimerId
+	mutex   sync.Mutex
+	// serializes the calls to Advance
+	advanceMutex sync.Mutex
+}
+
+// Creates a simulation, the machine clock is replaced by the virtual clock
+// `machine` the state machine
+// `start` the initial time of the virtual clock, it cannot be the zero time
+func NewSimulation[C any](machine *StateMachine[C], start time.Time) *Simulation[C] {
+	if start.IsZero() {
+		panic("The start time of a simulation cannot be the zero time")
+	}
+	sim := &Simulation[C]{machine: machine, clock: NewVirtualClock(start)}
+	machine.setupMutex.Lock()
+	defer machine.setupMutex.Unlock()
+	machine.dispatchMutex.Lock()
+	defer machine.dispatchMutex.Unlock()
+	machine.impl.clock = sim.clock
+	machine.impl.activityRunner = sim
+	return sim
+}
+
+// Returns the simulated state machine
+func (s *Simulation[C]) Machine() *StateMachine[C] {
+	return s.machine
+}
+
+// Returns the current time of the virtual clock
+func (s *Simulation[C]) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Schedules a delayed event, it can be called from an action (e.g. to start a timeout in an
+// entry action)
+// `delay` the delay from the current time of the virtual clock
+// `event` the event dispatched when the timer fires
+// returns the timer, see Cancel
+func (s *Simulation[C]) After(delay time.Duration, event Event) TimerId {
+	return s.schedule(delay, &simulationTimer{event: event})
+}
+
+func (s *Simulation[C]) schedule(delay time.Duration, timer *simulationTimer) TimerId {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextId++
+	timer.id = s.nextId
+	timer.due = s.clock.Now().Add(delay)
+	heap.Push(&s.timers, timer)
+	return s.nextId
+}
+
+// Starts a do-activity at the current time of the virtual clock, see activityRunner
+func (s *Simulation[C]) run(ctx context.Context, activity DoActivity, done func(Event)) {
+	a := &simulationActivity{activity: activity, done: done, resume: make(chan struct{}), yield: make(chan bool)}
+	a.ctx = context.WithValue(ctx, sleeperKey{}, a)
+	a.schedule = func(d time.Duration) {
+		s.schedule(d, &simulationTimer{activity: a})
+	}
+	a.schedule(0)
+}
+
+// Cancels a timer, it can be called from an action (e.g. to stop a timeout in an exit action)
+// `id` the timer
+// returns false if the timer already fired or was canceled
+func (s *Simulation[C]) Cancel(id TimerId) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, timer := range s.timers {
+		if timer.id == id && timer.activity == nil {
+			heap.Remove(&s.timers, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of timers not fired yet, including the wake-ups of the do-activities
+func (s *Simulation[C]) Pending() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.timers)
+}
+
+// Advances the virtual clock, the timers due in the window fire one by one: the clock is set to
+// the due time of the timer, then its event is dispatched. The timers scheduled by the actions
+// fire in the same call if they are due in the window. The do-activities run when they are
+// due, and a canceled activity is resumed at once so that it returns.
+// It must not be called from an action
+// `d` the duration of the window
+// returns the number of delayed events fired
+func (s *Simulation[C]) Advance(d time.Duration) int {
+	s.advanceMutex.Lock()
+	defer s.advanceMutex.Unlock()
+	end := s.clock.Now().Add(d)
+	fired := 0
+	for {
+		s.mutex.Lock()
+		timer := s.popCanceled()
+		if timer == nil {
+			if len(s.timers) == 0 || s.timers[0].due.After(end) {
+				s.clock.set(end)
+				s.mutex.Unlock()
+				return fired
+			}
+			timer = heap.Pop(&s.timers).(*simulationTimer)
+			s.clock.set(timer.due)
+		}
+		s.mutex.Unlock()
+		if timer.activity != nil {
+			timer.activity.step()
+			continue
+		}
+		s.machine.DispatchEvent(timer.event)
+		fired++
+	}
+}
+
+// Removes the wake-up of a canceled do-activity, a canceled activity that did not start yet is
+// dropped
+// returns the timer to resume (nil for none)
+func (s *Simulation[C]) popCanceled() *simulationTimer {
+	for {
+		found := -1
+		for i, timer := range s.timers {
+			if timer.activity != nil && timer.activity.ctx.Err() != nil && (found < 0 || timer.id < s.timers[found].id) {
+				found = i
+			}
+		}
+		if found < 0 {
+			return nil
+		}
+		timer := heap.Remove(&s.timers, found).(*simulationTimer)
+		if timer.activity.started {
+			return timer
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package statechart
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type TrafficContext struct {
+	sim     *Simulation[TrafficContext]
+	timeout TimerId
+	cycles  int
+	log     string
+}
+
+type LightTimeoutEvent struct {
+	EventDefault
+}
+
+type PedestrianEvent struct {
+	EventDefault
+}
+
+// Starts a timeout on the entry of a light, and cancels it on the exit
+func lightTimer(ctx *TrafficContext, name string, delay time.Duration) (EntryAction, ExitAction) {
+	entry := func() {
+		ctx.log += ctx.sim.Now().Format("15:04:05") + " " + name + "\n"
+		ctx.timeout = ctx.sim.After(delay, &LightTimeoutEvent{})
+	}
+	exit := func() {
+		ctx.sim.Cancel(ctx.timeout)
+	}
+	return entry, exit
+}
+
+type LightRed struct {
+	StateDefault[TrafficContext]
+}
+
+func (s *LightRed) Setup(proxy StateSetupProxy[TrafficContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[LightTimeoutEvent, LightGreen](proxy, func(e *LightTimeoutEvent) {
+		s.GetContext().cycles++
+	})
+	return lightTimer(s.GetContext(), "Red", 30*time.Second)
+}
+
+type LightGreen struct {
+	StateDefault[TrafficContext]
+}
+
+func (s *LightGreen) Setup(proxy StateSetupProxy[TrafficContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[LightTimeoutEvent, LightYellow](proxy, nil)
+	AddSimpleStateTransition[PedestrianEvent, LightYellow](proxy, nil)
+	return lightTimer(s.GetContext(), "Green", 25*time.Second)
+}
+
+type LightYellow struct {
+	StateDefault[TrafficContext]
+}
+
+func (s *LightYellow) Setup(proxy StateSetupProxy[TrafficContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[LightTimeoutEvent, LightRed](proxy, nil)
+	return lightTimer(s.GetContext(), "Yellow", 5*time.Second)
+}
+
+func makeTrafficSimulation(ctx *TrafficContext) *Simulation[TrafficContext] {
+	sm := MakeStateMachine(ctx)
+	redId := sm.AddState(&LightRed{})
+	sm.AddState(&LightGreen{})
+	sm.AddState(&LightYellow{})
+	ctx.sim = NewSimulation(&sm, time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC))
+	sm.Initialize(redId)
+	return ctx.sim
+}
+
+func TestSimulation(t *testing.T) {
+	ctx := TrafficContext{}
+	sim := makeTrafficSimulation(&ctx)
+	assert.Equal(t, 0, sim.Advance(29*time.Second))
+	assert.Equal(t, 3, sim.Advance(time.Minute))
+	assert.Equal(t, "08:00:00 Red\n08:00:30 Green\n08:00:55 Yellow\n08:01:00 Red\n", ctx.log)
+	assert.Equal(t, time.Date(2023, 1, 1, 8, 1, 29, 0, time.UTC), sim.Now())
+
+	// the timeout of Green is canceled by the pedestrian
+	sim.Advance(6 * time.Second)
+	assert.True(t, sim.Machine().IsInState(FindState[LightGreen](sim.Machine())))
+	sim.Machine().DispatchEvent(&PedestrianEvent{})
+	assert.Equal(t, 1, sim.Pending())
+	sim.Advance(5 * time.Second)
+	assert.Equal(t, "08:00:00 Red\n08:00:30 Green\n08:00:55 Yellow\n08:01:00 Red\n08:01:30 Green\n08:01:35 Yellow\n08:01:40 Red\n", ctx.log)
+
+	// an hour of cycles of 60 seconds
+	sim.Advance(time.Hour)
+	assert.Equal(t, 62, ctx.cycles)
+	assert.Equal(t, 1, sim.Pending())
+}
+
+func TestSimulationOrder(t *testing.T) {
+	sm := MakeStateMachine(&OrderContext{})
+	cartId := sm.AddState(&OrderCart{})
+	sm.AddState(&OrderPaying{})
+	sm.AddState(&OrderShipping{})
+	sm.AddState(&OrderShipped{})
+	assert.Panics(t, func() { NewSimulation(&sm, time.Time{}) })
+	start := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	sim := NewSimulation(&sm, start)
+	sm.Initialize(cartId)
+	// the timers due at the same time fire in the order they were scheduled
+	sim.After(time.Second, &CheckoutEvent{})
+	ship := sim.After(time.Second, &ShipEvent{})
+	sim.After(time.Second, &PayEvent{})
+	sim.After(2*time.Second, &ShipEvent{})
+	assert.True(t, sim.Cancel(ship))
+	assert.False(t, sim.Cancel(ship))
+	assert.Equal(t, 3, sim.Advance(2*time.Second))
+	assert.Equal(t, "OrderShipped", sm.Configuration()[0].Name)
+	assert.Equal(t, start.Add(2*time.Second), sim.Now())
+}
@@ -0,0 +1,155 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The error returned when restoring a snapshot whose version cannot be migrated to the current
+// version of the schema
+var ErrNoMigrationPath = errors.New("No snapshot migration path")
+
+// A migration of a snapshot to a newer version of the schema, e.g. to map the path of a renamed
+// state onto the new state tree (see StateRenames)
+type SnapshotMigration func(snapshot *Snapshot) error
+
+type snapshotMigration struct {
+	to      int
+	migrate SnapshotMigration
+}
+
+// The schema of the snapshots: the current version of the state tree and the migrations of the
+// snapshots of the previous versions. A nil schema is the version 0, without migrations.
+type SnapshotSchema struct {
+	version    int
+	migrations map[int]snapshotMigration
+}
+
+// Creates a snapshot schema
+// `version` the current version, saved in the snapshots
+func MakeSnapshotSchema(version int) SnapshotSchema {
+	return SnapshotSchema{version: version, migrations: map[int]snapshotMigration{}}
+}
+
+// Adds the migration of the snapshots from a version to a newer one
+// `from` the version of the migrated snapshots
+// `to` the version after the migration, at most the current version
+// `migration` the migration
+func (s *SnapshotSchema) AddMigration(from int, to int, migration SnapshotMigration) {
+	if from >= to || to > s.version {
+		panic(fmt.Sprintf("Invalid snapshot migration from version %d to %d (current version %d)", from, to, s.version))
+	}
+	if _, ok := s.migrations[from]; ok {
+		panic(fmt.Sprintf("The snapshot migration from version %d is already added", from))
+	}
+	if s.migrations == nil {
+		s.migrations = map[int]snapshotMigration{}
+	}
+	s.migrations[from] = snapshotMigration{to: to, migrate: migration}
+}
+
+// Returns the current version
+func (s *SnapshotSchema) Version() int {
+	if s == nil {
+		return 0
+	}
+	return s.version
+}
+
+// Migrates a snapshot to the current version, by chaining the migrations from its version
+// `snapshot` the snapshot, updated in place
+// returns ErrNoMigrationPath if no chain of migrations leads to the current version
+func (s *SnapshotSchema) Migrate(snapshot *Snapshot) error {
+	version := s.Version()
+	for snapshot.Version != version {
+		var migration snapshotMigration
+		ok := false
+		if s != nil && snapshot.Version < version {
+			migration, ok = s.migrations[snapshot.Version]
+		}
+		if !ok {
+			return fmt.Errorf("%w from version %d to %d", ErrNoMigrationPath, snapshot.Version, version)
+		}
+		if err := migration.migrate(snapshot); err != nil {
+			return fmt.Errorf("Snapshot migration from version %d to %d failed: %w", snapshot.Version, migration.to, err)
+		}
+		snapshot.Version = migration.to
+	}
+	return nil
+}
+
+// Returns a migration renaming the paths of the states. A renamed super state renames the
+// paths of its sub-states.
+// `renames` the new paths by old path
+func StateRenames(renames map[string]string) SnapshotMigration {
+	return func(snapshot *Snapshot) error {
+		path := snapshot.State
+		// the longest renamed prefix wins
+		for prefix := path; prefix != ""; prefix = parentPath(prefix) {
+			if renamed, ok := renames[prefix]; ok {
+				snapshot.State = renamed + path[len(prefix):]
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// Returns the path of the parent state, empty for a top state
+func parentPath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// Returns the stable identifier of the state: the names of its ancestors and its name, separated
+// by '/'. Unlike the StateId, it doesn't depend on the order the states are added.
+func (s *stateImpl[C]) path() string {
+	if s.parent == nil {
+		return s.name
+	}
+	return s.parent.path() + "/" + s.name
+}
+
+// Panics if a state name contains '/' or if two states have the same path, a path must identify
+// a single state
+func (d *definitionImpl[C]) checkStatePaths() {
+	paths := make(map[string]bool, len(d.states))
+	for _, state := range d.states {
+		if state.pseudo != notPseudo {
+			continue
+		}
+		if strings.ContainsRune(state.name, '/') {
+			panic("State name contains '/': " + state.name)
+		}
+		path := state.path()
+		if paths[path] {
+			panic("State path already exist: " + path)
+		}
+		paths[path] = true
+	}
+}
+
+// Returns the state of a path, nil if there is none
+func (d *definitionImpl[C]) findStatePath(path string) *stateImpl[C] {
+	for _, state := range d.states {
+		if state.pseudo == notPseudo && state.path() == path {
+			return state
+		}
+	}
+	return nil
+}
+
+// Returns the path of a state (see Snapshot)
+func (d *definitionImpl[C]) statePath(id StateId) string {
+	if !d.built {
+		panic("State Machine not Initialized")
+	}
+	return d.getState(id).path()
+}
@@ -0,0 +1,186 @@
+package statechart
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// OrderCheckout groups the payment and the shipping in the version 1 of the order machine
+type OrderCheckout struct {
+	StateDefault[OrderContext]
+}
+
+func (s *OrderCheckout) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	SetStartingState[OrderPaying](proxy)
+	return nil, nil
+}
+
+// The version 1 adds a super state and the states in another order
+func makeOrderV1(ctx *OrderContext, store Store) *PersistentStateMachine[OrderContext] {
+	sm := MakeStateMachine(ctx)
+	sm.SetEventRegistry(makeOrderEventRegistry())
+	sm.AddState(&OrderShipped{})
+	checkoutId := sm.AddState(&OrderCheckout{})
+	sm.AddSubState(&OrderShipping{}, checkoutId)
+	sm.AddSubState(&OrderPaying{}, checkoutId)
+	sm.AddState(&OrderCart{})
+	return NewPersistentStateMachine[OrderContext](&sm, store, "order-1", JsonContextCodec[OrderContext]{})
+}
+
+func makeOrderSchemaV1() *SnapshotSchema {
+	schema := MakeSnapshotSchema(1)
+	schema.AddMigration(0, 1, StateRenames(map[string]string{
+		"OrderPaying":   "OrderCheckout/OrderPaying",
+		"OrderShipping": "OrderCheckout/OrderShipping",
+	}))
+	return &schema
+}
+
+// Saves the snapshot of the version 0 of the order machine, waiting for the payment
+func saveOrderV0(t *testing.T, store Store) {
+	order := makePersistentOrder(&OrderContext{}, store, makeOrderEventRegistry())
+	_, err := order.Start(0)
+	assert.NoError(t, err)
+	assert.NoError(t, order.DispatchEvent(&AddItemEvent{Count: 1}))
+	assert.NoError(t, order.DispatchEvent(&CheckoutEvent{}))
+	assert.NoError(t, order.DispatchEvent(&ShipEvent{}))
+}
+
+func TestSnapshotMigration(t *testing.T) {
+	store := MakeMemoryStore()
+	saveOrderV0(t, &store)
+
+	ctx := OrderContext{}
+	order := makeOrderV1(&ctx, &store)
+	order.SetSnapshotSchema(makeOrderSchemaV1())
+	restored, err := order.Start(4)
+	assert.NoError(t, err)
+	assert.True(t, restored)
+	configuration := order.Machine().Configuration()
+	assert.Equal(t, "OrderCheckout", configuration[0].Name)
+	assert.Equal(t, "OrderPaying", configuration[1].Name)
+	assert.Equal(t, "OrderCheckout/OrderPaying", order.Machine().StatePath(configuration[1].Id))
+
+	assert.NoError(t, order.DispatchEvent(&PayEvent{}))
+	assert.Equal(t, "OrderShipped", order.Machine().Configuration()[0].Name)
+	// the new snapshot has the current version
+	snapshot, err := order.snapshots.load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, snapshot.Version)
+	assert.Equal(t, "OrderShipped", snapshot.State)
+}
+
+func TestSnapshotWithoutMigration(t *testing.T) {
+	store := MakeMemoryStore()
+	saveOrderV0(t, &store)
+	// the state paths don't depend on the order the states are added
+	sm := MakeStateMachine(&OrderContext{})
+	sm.SetEventRegistry(makeOrderEventRegistry())
+	sm.AddState(&OrderShipped{})
+	sm.AddState(&OrderShipping{})
+	sm.AddState(&OrderPaying{})
+	cartId := sm.AddState(&OrderCart{})
+	_, err := NewPersistentStateMachine[OrderContext](&sm, &store, "order-1", nil).Start(cartId)
+	assert.NoError(t, err)
+	assert.Equal(t, "OrderPaying", sm.Configuration()[0].Name)
+
+	// the renamed states are unknown without the migration
+	_, err = makeOrderV1(&OrderContext{}, &store).Start(4)
+	assert.EqualError(t, err, "Unknown state in snapshot (version 0): OrderPaying")
+}
+
+func TestSnapshotNoMigrationPath(t *testing.T) {
+	store := MakeMemoryStore()
+	saveOrderV0(t, &store)
+	schema := MakeSnapshotSchema(2)
+	schema.AddMigration(1, 2, StateRenames(nil))
+	order := makeOrderV1(&OrderContext{}, &store)
+	order.SetSnapshotSchema(&schema)
+	_, err := order.Start(4)
+	assert.True(t, errors.Is(err, ErrNoMigrationPath))
+	assert.EqualError(t, err, "No snapshot migration path from version 0 to 2")
+
+	// a snapshot of a newer version cannot be restored
+	newer := Snapshot{Version: 3}
+	assert.ErrorIs(t, schema.Migrate(&newer), ErrNoMigrationPath)
+	assert.Panics(t, func() { schema.AddMigration(2, 3, StateRenames(nil)) })
+	assert.Panics(t, func() { schema.AddMigration(1, 2, StateRenames(nil)) })
+}
+
+func TestStateRenames(t *testing.T) {
+	migration := StateRenames(map[string]string{"Shop": "Store", "Shop/Cart": "Store/Basket"})
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"Shop", "Store"},
+		{"Shop/Cart", "Store/Basket"},
+		{"Shop/Cart/Item", "Store/Basket/Item"},
+		{"Shop/Paying", "Store/Paying"},
+		{"Other", "Other"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		snapshot := Snapshot{State: tc.path}
+		assert.NoError(t, migration(&snapshot))
+		assert.Equal(t, tc.expected, snapshot.State, tc.path)
+	}
+}
+
+type FirstAlike struct {
+	StateDefault[OrderContext]
+}
+
+func (s *FirstAlike) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	proxy.SetName("Alike")
+	return nil, nil
+}
+
+type SecondAlike struct {
+	StateDefault[OrderContext]
+}
+
+func (s *SecondAlike) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	proxy.SetName("Alike")
+	return nil, nil
+}
+
+type AlikeParent struct {
+	StateDefault[OrderContext]
+}
+
+func (s *AlikeParent) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	SetStartingState[FirstAlike](proxy)
+	return nil, nil
+}
+
+type Slashed struct {
+	StateDefault[OrderContext]
+}
+
+func (s *Slashed) Setup(proxy StateSetupProxy[OrderContext]) (EntryAction, ExitAction) {
+	proxy.SetName("Order/Slashed")
+	return nil, nil
+}
+
+func TestDuplicateStatePath(t *testing.T) {
+	sm := MakeStateMachine(&OrderContext{})
+	firstId := sm.AddState(&FirstAlike{})
+	sm.AddState(&SecondAlike{})
+	assert.PanicsWithValue(t, "State path already exist: Alike", func() { sm.Initialize(firstId) })
+
+	// the same name under different parents is allowed
+	sm = MakeStateMachine(&OrderContext{})
+	parentId := sm.AddState(&AlikeParent{})
+	sm.AddSubState(&FirstAlike{}, parentId)
+	sm.AddState(&SecondAlike{})
+	assert.NotPanics(t, func() { sm.Initialize(parentId) })
+}
+
+func TestStateNameWithSlash(t *testing.T) {
+	def := MakeDefinition[OrderContext]()
+	id := def.AddState(&Slashed{})
+	assert.PanicsWithValue(t, "State name contains '/': Order/Slashed", func() { def.Build(id) })
+}
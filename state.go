@@ -4,7 +4,10 @@
 package statechart
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"time"
 )
 
 // The Event interface
@@ -63,11 +66,43 @@ const (
 	DEFER
 )
 
+func (r ResultType) String() string {
+	switch r {
+	case FORWARD:
+		return "Forward"
+	case DISCARD:
+		return "Discard"
+	case TRANSIT:
+		return "Transit"
+	case DEFER:
+		return "Defer"
+	}
+	return "Unknown"
+}
+
+// The kind of a transition
+type TransitionKind int16
+
+const (
+	// Exits the states up to the common ancestor of the active state and the target state
+	EXTERNAL TransitionKind = iota
+	// Doesn't exit the source state when the target is the source state or one of its
+	// sub-states, only the active sub-states of the source are exited (a local self transition
+	// of a simple state runs the action only)
+	LOCAL
+)
+
 // encapsulate the result for a reaction
 type ReactionResult struct {
 	status      ResultType
-	targetState interface{} // Proxy to the target state
-	action      BaseAction  // transition Action
+	targetState interface{}   // Proxy to the target state
+	local       bool          // true for a LOCAL transition
+	action      BaseAction    // transition Action
+	deferTTL    time.Duration // time to live of a deferred event
+	// transition Action that can fail
+	fallibleAction FallibleBaseAction
+	// transition Action receiving the context of the event, bound to the instance
+	actionCtx func(ctx context.Context, event Event)
 }
 
 // Custom reaction function type.
@@ -80,10 +115,29 @@ type UmlDocReaction struct {
 	GuardText      string
 }
 
+// How an EventReaction selects its events, in order of precedence
+type matchKind int16
+
+const (
+	// the event type is the reaction event type
+	matchExact matchKind = iota
+	// the event type implements the reaction interface
+	matchInterface
+	// any event
+	matchAny
+)
+
 // This is used to link an event to a custom reaction
 type EventReaction struct {
-	reaction      func(Event) ReactionResult
+	// `instance` provides the context of the event, bound to the instance running the step
+	reaction      func(instance contextProvider, event Event) ReactionResult
 	eventSelector func(Event) bool
+	match         matchKind
+	eventType     reflect.Type  // the event pointer type, or the interface type
+	deferred      bool          // true if the reaction always defers the event
+	deferTTL      time.Duration // time to live of the deferred event
+	unbound       bool          // true if the reaction runs user code that doesn't receive the instance
+	local         bool          // true if the reaction is a LOCAL transition (documentation)
 	docEventName  string
 	umlDoc        []UmlDocReaction
 }
@@ -95,19 +149,66 @@ func MakeEventReaction[T any, PT EventCst[T]](reaction Reaction[T, PT], doc ...U
 			_, ok := e.(PT)
 			return ok
 		},
+		eventType:    reflect.TypeOf(PT(nil)),
 		docEventName: reflect.TypeOf(PT(nil)).Elem().Name(),
 		umlDoc:       doc,
 	}
 
 	if reaction != nil {
-		newObj.reaction = func(e Event) ReactionResult {
+		newObj.reaction = func(_ contextProvider, e Event) ReactionResult {
 			return reaction(e.(PT))
 		}
+		newObj.unbound = true
 	}
 
 	return newObj
 }
 
+// makes an EventReaction matching the events that implement the interface `I`
+// `I` the interface type (panics if `I` is not an interface)
+func MakeInterfaceEventReaction[I any](reaction func(I) ReactionResult, doc ...UmlDocReaction) EventReaction {
+	interfaceType := reflect.TypeOf((*I)(nil)).Elem()
+	if interfaceType.Kind() != reflect.Interface {
+		panic("MakeInterfaceEventReaction requires an interface type")
+	}
+	newObj := EventReaction{
+		eventSelector: func(e Event) bool {
+			_, ok := any(e).(I)
+			return ok
+		},
+		match:        matchInterface,
+		eventType:    interfaceType,
+		docEventName: interfaceType.Name(),
+		umlDoc:       doc,
+	}
+	if reaction != nil {
+		newObj.reaction = func(_ contextProvider, e Event) ReactionResult {
+			return reaction(any(e).(I))
+		}
+		newObj.unbound = true
+	}
+	return newObj
+}
+
+// makes an EventReaction matching any event
+func MakeAnyEventReaction(reaction func(Event) ReactionResult, doc ...UmlDocReaction) EventReaction {
+	newObj := EventReaction{
+		eventSelector: func(e Event) bool {
+			return true
+		},
+		match:        matchAny,
+		docEventName: "any",
+		umlDoc:       doc,
+	}
+	if reaction != nil {
+		newObj.reaction = func(_ contextProvider, e Event) ReactionResult {
+			return reaction(e)
+		}
+		newObj.unbound = true
+	}
+	return newObj
+}
+
 // The State[C] Interface where `C` is the user context
 type State[C any] interface {
 	isState() bool
@@ -132,6 +233,10 @@ type StateCst[S any, C any] interface {
 type StateProxy[C any] interface {
 	// Returns the name of the State
 	Name() string
+	// Returns the key of the State ("" if the state was added without a key)
+	Key() string
+	// Returns the StateId of the State
+	Id() StateId
 	// Returns an ancestor of the current state
 	GetAncestor(state StateId) State[C]
 	// Returns the user context
@@ -140,8 +245,13 @@ type StateProxy[C any] interface {
 	// It is ok to cache the stateId, to improve performance
 	// `selector` a function that is used to test if a state is a match
 	FindStateId(selector func(state State[C]) bool) StateId
+	// Find the StateId of a state added with a key (see AddKeyedState)
+	// `key` the key of the state
+	// `selector` a function that is used to test if a state is a match
+	FindKeyedStateId(key string, selector func(state State[C]) bool) StateId
 	// Create a transition result (only needed for custom reactions)
-	Transit(state StateId, action BaseAction) ReactionResult
+	// `kind` the transition kind (EXTERNAL by default)
+	Transit(state StateId, action BaseAction, kind ...TransitionKind) ReactionResult
 	// Create a forward result (only needed for custom reactions)
 	Forward() ReactionResult
 	// Create a discard result (only needed for custom reactions)
@@ -150,6 +260,38 @@ type StateProxy[C any] interface {
 	Defer() ReactionResult
 	// Post an event to the event queue that will be processed after the current reaction
 	PostEvent(event Event)
+	// Returns the events currently deferred, in the order they were deferred
+	DeferredEvents() []Event
+	// Returns the metadata of the event being processed (see EventMetadata), the zero value
+	// outside of a run-to-completion step
+	EventMetadata() EventMetadata
+	// Returns the context of the event being processed (see DispatchEventContext), the events
+	// posted by PostEvent keep it. It is context.Background outside of a run-to-completion step.
+	Context() context.Context
+	// Returns true while an event-sourced state machine replays its event log (see
+	// NewEventSourcedStateMachine), the actions should then skip their external effects
+	IsReplaying() bool
+	// Returns the proxy bound to the instance running the step.
+	// The states of a Definition are shared by its instances, so the proxies given to Setup
+	// don't know the instance: GetContext returns nil, PostEvent panics, and so on. The actions
+	// and the custom reactions of a Definition reach the instance with the bound proxy, from the
+	// context they receive (see EntryActionCtx, ActionCtx and ReactionCtx):
+	//
+	//	proxy.SetEntryActionCtx(func(ctx context.Context) {
+	//		proxy.Bind(ctx).GetContext().Open()
+	//	})
+	//
+	// The proxies of a state machine made by MakeStateMachine are returned as is.
+	// `ctx` the context received by the action or the reaction
+	Bind(ctx context.Context) StateProxy[C]
+	// Returns the StateId of the entry point `name` of a super state, to use as a transition target
+	// `superState` the super state (or sub machine state) owning the entry point
+	// `name` the name of the entry point
+	EntryPointId(superState StateId, name string) StateId
+	// Returns the StateId of the exit point `name` of the nearest ancestor (or the state itself)
+	// that has one, to use as a transition target
+	// `name` the name of the exit point
+	ExitPointId(name string) StateId
 }
 
 // Finds the state id of the state that matches the Concrete State Type
@@ -162,6 +304,17 @@ func FindStateId[S any, C any, PS StateCst[S, C]](proxy StateProxy[C]) StateId {
 	return proxy.FindStateId(selector)
 }
 
+// Finds the state id of the state that matches the Concrete State Type and the key
+// `S` is the actual user state
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `proxy` is the proxy to the internal state in the machine
+// `key` is the key used to add the state
+func FindStateIdByKey[S any, C any, PS StateCst[S, C]](proxy StateProxy[C], key string) StateId {
+	selector := GeneticStateSelector[S, C, PS]
+	return proxy.FindKeyedStateId(key, selector)
+}
+
 // `StateSetupProxy` is a `StateProxy` that can add reactions and set the starting state.
 type StateSetupProxy[C any] interface {
 	StateProxy[C]
@@ -171,6 +324,25 @@ type StateSetupProxy[C any] interface {
 	AddReaction(reaction EventReaction)
 	// Set a starting state (used for supper state)
 	SetStartingState(state StateId)
+	// Makes the state the target of the entry point `name` of its parent.
+	// For a top state of a definition, the entry point is the one of the sub machine state
+	// when the definition is mounted with AddSubMachine.
+	AddEntryPoint(name string)
+	// Adds the exit point `name` to the state, the transitions to the exit point (from the
+	// sub-states) go to `target`
+	AddExitPoint(name string, target StateId)
+	// Sets an entry action that can fail, instead of the entry action returned by Setup
+	SetFallibleEntryAction(action FallibleEntryAction)
+	// Sets an exit action that can fail, instead of the exit action returned by Setup
+	SetFallibleExitAction(action FallibleExitAction)
+	// Sets an entry action receiving the context of the event, instead of the entry action returned by Setup
+	SetEntryActionCtx(action EntryActionCtx)
+	// Sets an exit action receiving the context of the event, instead of the exit action returned by Setup
+	SetExitActionCtx(action ExitActionCtx)
+	// Sets the invariant of the state, checked while the state is active (see WithInvariantChecks)
+	SetInvariant(invariant func() error)
+	// Sets the do-activity of the state, run while the state is active (see DoActivity)
+	SetDoActivity(activity DoActivity)
 }
 
 // Set a starting state using a State Type as a key
@@ -183,6 +355,17 @@ func SetStartingState[S any, C any, PS StateCst[S, C]](state StateSetupProxy[C])
 	state.SetStartingState(id)
 }
 
+// Set a starting state using a State Type and a key
+// `S` is the actual user state
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `proxy` is the proxy to the internal state in the machine
+// `key` is the key used to add the state
+func SetStartingStateByKey[S any, C any, PS StateCst[S, C]](state StateSetupProxy[C], key string) {
+	id := FindStateIdByKey[S, C, PS](state, key)
+	state.SetStartingState(id)
+}
+
 // Add a simple state transition
 // `E` is the event type
 // `S` is the actual user state that we are going to
@@ -191,16 +374,50 @@ func SetStartingState[S any, C any, PS StateCst[S, C]](state StateSetupProxy[C])
 // `PS` is a pointer to `S` (deducted)
 // `from` is the proxy of the current state
 // `action` is the action associated with the transition (optional)
-func AddSimpleStateTransition[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], action Action[E, PE]) {
-	toId := FindStateId[S, C, PS](from)
+// `kind` is the transition kind (EXTERNAL by default)
+func AddSimpleStateTransition[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], action Action[E, PE], kind ...TransitionKind) {
+	addSimpleTransition(from, FindStateId[S, C, PS](from), action, kind...)
+}
+
+// Returns the transition kind of the optional `kind` argument
+func transitionKindOf(kind []TransitionKind) TransitionKind {
+	if len(kind) == 0 {
+		return EXTERNAL
+	}
+	return kind[0]
+}
+
+// Adds the reaction of a simple transition to the state `toId`
+func addSimpleTransition[E any, C any, PE EventCst[E]](from StateSetupProxy[C], toId StateId, action Action[E, PE], kind ...TransitionKind) {
+	baseAction := ToBaseAction(action)
+	transitionKind := transitionKindOf(kind)
+	// the slice is made once, so the reaction doesn't allocate
+	kinds := []TransitionKind{transitionKind}
 	reaction := func(e PE) ReactionResult {
-		return from.Transit(toId, ToBaseAction(action))
+		return from.Transit(toId, baseAction, kinds...)
 	}
 	actionDocText := ""
 	if action != nil {
 		actionDocText = "WithAction"
 	}
-	from.AddReaction(MakeEventReaction(reaction, UmlDocReaction{TRANSIT, toId, actionDocText, ""}))
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{TRANSIT, toId, actionDocText, ""})
+	eventReaction.unbound = action != nil
+	eventReaction.local = transitionKind == LOCAL
+	from.AddReaction(eventReaction)
+}
+
+// Add a simple state transition to a keyed state
+// `E` is the event type
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `key` is the key of the target state
+// `action` is the action associated with the transition (optional)
+// `kind` is the transition kind (EXTERNAL by default)
+func AddSimpleStateTransitionByKey[E any, S any, C any, PE EventCst[E], PS StateCst[S, C]](from StateSetupProxy[C], key string, action Action[E, PE], kind ...TransitionKind) {
+	addSimpleTransition(from, FindStateIdByKey[S, C, PS](from, key), action, kind...)
 }
 
 // Add a custom reaction
@@ -213,6 +430,34 @@ func AddCustomStateReaction[E any, C any, PE EventCst[E]](from StateSetupProxy[C
 	from.AddReaction(MakeEventReaction(reaction, UmlDocReaction{DISCARD, INVALID_STATE_ID, "Custom(TODO)", ""}))
 }
 
+// Add a custom reaction to the events that implement an interface.
+// In a state, a reaction to the exact event type takes precedence over an interface reaction,
+// which takes precedence over an any event reaction (see AddAnyEventReaction). If no reaction
+// matches, the event is forwarded to the parent state.
+// `I` is the interface type
+// `C` is the user context (deducted)
+// `from` is the proxy of the current state
+// `reaction` is the custom reaction function
+// `doc` documents the reaction in the UML diagram (optional)
+func AddInterfaceReaction[I any, C any](from StateSetupProxy[C], reaction func(I) ReactionResult, doc ...UmlDocReaction) {
+	if len(doc) == 0 {
+		doc = []UmlDocReaction{{DISCARD, INVALID_STATE_ID, "Custom(TODO)", ""}}
+	}
+	from.AddReaction(MakeInterfaceEventReaction(reaction, doc...))
+}
+
+// Add a custom reaction to any event (wildcard), see AddInterfaceReaction for the precedence
+// `C` is the user context (deducted)
+// `from` is the proxy of the current state
+// `reaction` is the custom reaction function
+// `doc` documents the reaction in the UML diagram (optional)
+func AddAnyEventReaction[C any](from StateSetupProxy[C], reaction func(Event) ReactionResult, doc ...UmlDocReaction) {
+	if len(doc) == 0 {
+		doc = []UmlDocReaction{{DISCARD, INVALID_STATE_ID, "Custom(TODO)", ""}}
+	}
+	from.AddReaction(MakeAnyEventReaction(reaction, doc...))
+}
+
 // Add an in-state reaction
 // `E` is the event type
 // `C` is the user context (deducted)
@@ -236,10 +481,15 @@ func AddDiscard[E any, C any, PE EventCst[E]](state StateSetupProxy[C]) {
 	reaction := func(e PE) ReactionResult {
 		return ReactionResult{status: DISCARD}
 	}
-	state.AddReaction(MakeEventReaction(reaction, UmlDocReaction{DISCARD, INVALID_STATE_ID, "", ""}))
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{DISCARD, INVALID_STATE_ID, "", ""})
+	eventReaction.unbound = false
+	state.AddReaction(eventReaction)
 }
 
 // Add a defer event reaction
+// A deferred event is kept by the state machine while the active state (or the ancestor that
+// handles the event first) defers it. After each state change, the deferred events that are no
+// longer deferred are replayed, in the order they were deferred and before the other queued events.
 // `E` is the event type
 // `C` is the user context (deducted)
 // `PE` is a pointer to E (deducted)
@@ -248,7 +498,29 @@ func AddDefer[E any, C any, PE EventCst[E]](state StateSetupProxy[C]) {
 	reaction := func(e PE) ReactionResult {
 		return ReactionResult{status: DEFER}
 	}
-	state.AddReaction(MakeEventReaction(reaction, UmlDocReaction{DEFER, INVALID_STATE_ID, "", ""}))
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{DEFER, INVALID_STATE_ID, "", ""})
+	eventReaction.deferred = true
+	eventReaction.unbound = false
+	state.AddReaction(eventReaction)
+}
+
+// Add a defer event reaction with a time to live. The deferred event is dropped (and reported
+// to the observers) once it is deferred for longer than `ttl`, measured from the time it was first
+// deferred. The expiry is checked at the start of each dispatch and before replaying the deferred events.
+// `E` is the event type
+// `C` is the user context (deducted)
+// `PE` is a pointer to E (deducted)
+// `state` is the proxy of the current state
+// `ttl` the time to live of the deferred event
+func AddDeferWithTTL[E any, C any, PE EventCst[E]](state StateSetupProxy[C], ttl time.Duration) {
+	reaction := func(e PE) ReactionResult {
+		return ReactionResult{status: DEFER, deferTTL: ttl}
+	}
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{DEFER, INVALID_STATE_ID, fmt.Sprintf("TTL %v", ttl), ""})
+	eventReaction.deferred = true
+	eventReaction.unbound = false
+	eventReaction.deferTTL = ttl
+	state.AddReaction(eventReaction)
 }
 
 // Returns true if the state is of type `*S`
@@ -295,6 +567,55 @@ func (e *EventDefault) isEvent() bool {
 	return true
 }
 
+// A state that completes its parent state. Entering a final state posts a CompletionEvent
+// for the parent, use AddCompletionTransition in the parent to leave it.
+// Several final states of the same parent are added with AddKeyedSubState.
+type FinalState[C any] struct {
+	StateDefault[C]
+}
+
+func (*FinalState[C]) Setup(proxy StateSetupProxy[C]) (EntryAction, ExitAction) {
+	return nil, nil
+}
+
+func (*FinalState[C]) isFinalState() bool {
+	return true
+}
+
+// The event posted when a final state is entered
+type CompletionEvent struct {
+	EventDefault
+	// the completed state (the parent of the final state)
+	State StateId
+	// the final state that was entered
+	FinalState StateId
+}
+
+// Add a transition taken when the state completes (one of its final states is entered).
+// The CompletionEvent of the nested states is forwarded to the parent state.
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the state
+// `action` is the action associated with the transition (optional)
+func AddCompletionTransition[S any, C any, PS StateCst[S, C]](from StateSetupProxy[C], action Action[CompletionEvent, *CompletionEvent]) {
+	toId := FindStateId[S, C, PS](from)
+	baseAction := ToBaseAction(action)
+	reaction := func(e *CompletionEvent) ReactionResult {
+		if e.State != from.Id() {
+			return from.Forward()
+		}
+		return from.Transit(toId, baseAction)
+	}
+	actionDocText := ""
+	if action != nil {
+		actionDocText = "WithAction"
+	}
+	eventReaction := MakeEventReaction(reaction, UmlDocReaction{TRANSIT, toId, actionDocText, ""})
+	eventReaction.unbound = action != nil
+	from.AddReaction(eventReaction)
+}
+
 type UmlDiagramType int16
 
 const (
@@ -4,6 +4,7 @@
 package statechart
 
 import (
+	"context"
 	"io"
 	"sync"
 )
@@ -15,8 +16,9 @@ type StateMachine[C any] struct {
 }
 
 // Creates a state machine with a user context
-func MakeStateMachine[C any](userContext_ *C) StateMachine[C] {
-	return StateMachine[C]{impl: stateMachineImpl[C]{userContext: userContext_}}
+// `options` the optional settings of the state machine (WithObserver, WithMaxDeferredEvents, ...)
+func MakeStateMachine[C any](userContext_ *C, options ...Option) StateMachine[C] {
+	return StateMachine[C]{impl: stateMachineImpl[C]{machineOptions: makeOptions(options), userContext: userContext_}}
 }
 
 // Adds a new State to the State Machine
@@ -37,6 +39,77 @@ func (sm *StateMachine[C]) AddSubState(state State[C], parentId StateId) StateId
 	return sm.impl.AddSubState(state, parentId)
 }
 
+// Adds a new keyed State to the State Machine.
+// Several states of the same type can be added with different keys, they are found with
+// FindStateIdByKey (FindStateId only finds the states added without a key).
+// `state` the new state object to add
+// `key` the key of the state, unique for the state type
+// returns the new stateId
+func (sm *StateMachine[C]) AddKeyedState(state State[C], key string) StateId {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	return sm.impl.AddKeyedState(state, key)
+}
+
+// Adds a keyed Sub-State to the State Machine, see AddKeyedState
+// `state` the new state object to add
+// `parentId` the parent (super state) ID
+// `key` the key of the state, unique for the state type
+func (sm *StateMachine[C]) AddKeyedSubState(state State[C], parentId StateId, key string) StateId {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	return sm.impl.AddKeyedSubState(state, parentId, key)
+}
+
+// Mounts a sub machine (a built definition, see MakeSubMachine) as a sub machine state.
+// The states of the sub machine are copies of the definition states (a shallow copy of the
+// state struct) added under `container` and set up again with this machine. They only find the
+// states of the sub machine with FindStateId, and their names are prefixed with the container name.
+// Entering the container enters the initial state of the sub machine, and entering a FinalState
+// of the sub machine posts a CompletionEvent for the container (see AddCompletionTransition).
+// `container` the sub machine state, its Setup adds the reactions of the sub machine as a whole
+// `sub` the sub machine to mount
+// `parentId` the parent of the container (INVALID_STATE_ID for a top state)
+// returns the StateId of the container
+func (sm *StateMachine[C]) AddSubMachine(container State[C], sub SubMachine[C], parentId StateId) StateId {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	return sm.impl.AddSubMachine(container, sub, parentId)
+}
+
+// Sets the error state, the target of the abort when an action fails with the policy
+// ABORT_TO_ERROR_STATE (see WithActionFailurePolicy)
+// `id` the error state
+func (sm *StateMachine[C]) SetErrorState(id StateId) {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	sm.impl.SetErrorState(id)
+}
+
+// Sets the event registry, the declared event alphabet of the state machine. Analyze reports the
+// events handled but not registered, and the registered events handled by no state. The event
+// journal (see NewRecorder) uses the registered names.
+// `registry` the event registry
+func (sm *StateMachine[C]) SetEventRegistry(registry *EventRegistry) {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	sm.impl.SetEventRegistry(registry)
+}
+
+// Adds an observer, like WithObserver. It must not be called while an event is dispatched.
+// `observer` the observer
+func (sm *StateMachine[C]) AddObserver(observer Observer) {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	sm.dispatchMutex.Lock()
+	defer sm.dispatchMutex.Unlock()
+	sm.impl.addObserver(observer)
+}
+
+func (sm *StateMachine[C]) machineImpl() *stateMachineImpl[C] {
+	return &sm.impl
+}
+
 // Initializes the state machine
 // `initStateId` the initial starting state
 func (sm *StateMachine[C]) Initialize(initStateId StateId) {
@@ -54,6 +127,80 @@ func (sm *StateMachine[C]) DispatchEvent(event Event) {
 	sm.impl.DispatchEvent(event)
 }
 
+// Dispatches an events to the state machine with a context.
+// The context is given to the reactions and actions (StateProxy.Context) while the event and
+// the events it posts are processed. An event whose context is done when it should be processed
+// is dropped (DROP_CONTEXT_DONE).
+// `ctx` the context of the event
+// `event` The Event to dispatch
+func (sm *StateMachine[C]) DispatchEventContext(ctx context.Context, event Event) {
+	sm.dispatchMutex.Lock()
+	defer sm.dispatchMutex.Unlock()
+	sm.impl.DispatchEventContext(ctx, event)
+}
+
+// Returns the events currently deferred, in the order they were deferred.
+// It must not be called from an action, use StateProxy.DeferredEvents instead
+func (sm *StateMachine[C]) DeferredEvents() []Event {
+	return sm.impl.DeferredEvents()
+}
+
+// Returns the active configuration, from the top state down to the active state.
+// The active state is a super state (IsSuperStateLeaf) only with WithSuperStateLeaf.
+// It must not be called from an action
+func (sm *StateMachine[C]) Configuration() []StateInfo {
+	return sm.impl.Configuration()
+}
+
+// Returns the active state (INVALID_STATE_ID before Initialize).
+// It must not be called from an action
+func (sm *StateMachine[C]) CurrentStateId() StateId {
+	return sm.impl.CurrentStateId()
+}
+
+// Returns true if the state is the active state or one of its ancestors.
+// It must not be called from an action
+func (sm *StateMachine[C]) IsInState(id StateId) bool {
+	return sm.impl.IsInState(id)
+}
+
+// Returns the user context of the state machine
+func (sm *StateMachine[C]) UserContext() *C {
+	return sm.impl.userContext
+}
+
+// Returns true if the active state or one of its ancestors has a reaction to the event, the
+// other events are discarded by the top state.
+// It must not be called from an action
+// `event` a sample of the event type, e.g. &MyEvent{}
+func (sm *StateMachine[C]) HasReaction(event Event) bool {
+	return sm.impl.HasReaction(event)
+}
+
+// Returns the stable identifier of a state, used in the snapshots: the names of its ancestors
+// and its name, separated by '/' (e.g. "Checkout/Paying")
+// `id` the state
+func (sm *StateMachine[C]) StatePath(id StateId) string {
+	return sm.impl.definition().statePath(id)
+}
+
+// Returns true if the state machine was stopped by an action failure (see STOP_ON_FAILURE),
+// the events dispatched to a stopped machine are dropped.
+// It must not be called from an action
+func (sm *StateMachine[C]) IsStopped() bool {
+	return sm.impl.IsStopped()
+}
+
+// Returns the findings of the static analysis of the state machine (after Initialize)
+func (sm *StateMachine[C]) Analyze() []Finding {
+	return sm.impl.definition().analyze()
+}
+
+// Returns the model of the state machine (after Initialize), see Model
+func (sm *StateMachine[C]) Model() Model {
+	return sm.impl.definition().model()
+}
+
 // Sets the Debug Trace Logger for the state machine
 func (sm *StateMachine[C]) SetDebugLogger(logger func(msg string, keysAndValues ...interface{})) {
 	sm.impl.DebugLogger = logger
@@ -66,3 +213,28 @@ func (sm *StateMachine[C]) SetDebugLogger(logger func(msg string, keysAndValues
 func (sm *StateMachine[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
 	sm.impl.GenerateUml(w, umlSyntax, diagramType)
 }
+
+// Finds the state id of a state of the machine (the states of the mounted sub machines are
+// not found, see FindStateId)
+// `S` is the actual user state
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `sm` the state machine
+func FindState[S any, C any, PS StateCst[S, C]](sm *StateMachine[C]) StateId {
+	return FindStateByKey[S, C, PS](sm, "")
+}
+
+// Finds the state id of a keyed state of the machine
+// `S` is the actual user state
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `sm` the state machine
+// `key` is the key used to add the state
+func FindStateByKey[S any, C any, PS StateCst[S, C]](sm *StateMachine[C], key string) StateId {
+	sm.setupMutex.Lock()
+	defer sm.setupMutex.Unlock()
+	if id, ok := sm.impl.definition().findKeyedStateId(nil, key, GeneticStateSelector[S, C, PS]); ok {
+		return id
+	}
+	panic("State not found")
+}
@@ -4,45 +4,82 @@
 package statechart
 
 import (
+	"context"
 	"io"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 type stateImpl[C any] struct {
 	id            StateId
 	name          string
+	key           string // distinguishes the states of the same type ("" if not keyed)
 	userState     State[C]
-	stateMachine  *stateMachineImpl[C]
+	definition    *definitionImpl[C]
 	events        []EventReaction
 	parent        *stateImpl[C]
 	isSuperState  bool
 	startingState *stateImpl[C]
-	enterAction   func()
-	exitAction    func()
+	// the actions receive the instance running the step, see stateMachineImpl.Context
+	enterAction func(instance contextProvider) error
+	exitAction  func(instance contextProvider) error
+	invariant   func() error
+	doActivity  DoActivity
+	// the first action of the state that doesn't receive the instance ("" if none), the states
+	// of an instantiated Definition can't have one (see checkBoundActions)
+	unbound string
+	// the sub machine state containing this state when it was mounted with AddSubMachine (nil
+	// for the states of the machine itself), the states are only found in their scope
+	scope        *stateImpl[C]
+	isSubMachine bool
+	// the state entered by default when the sub machine state is the target of a transition
+	subMachineEntry *stateImpl[C]
+	// the kind of an entry or exit point, and the state it leads to (the key is the point name)
+	pseudo   pseudoKind
+	redirect *stateImpl[C]
+	// depth in the hierarchy (1 for a top state), computed by build
+	level int
+	// event type -> reactions of this state and its ancestors, computed by build
+	dispatch map[reflect.Type][]reactionHandler[C]
 }
 
 func (s *stateImpl[C]) Name() string {
 	return s.name
 }
 
+func (s *stateImpl[C]) Id() StateId {
+	return s.id
+}
+
+func (s *stateImpl[C]) Key() string {
+	return s.key
+}
+
 func (s *stateImpl[C]) SetName(name string) {
 	s.name = name
 }
 
 func (s *stateImpl[C]) AddReaction(container EventReaction) {
+	if s.definition.built {
+		panic("Cannot add a reaction after the state machine is initialized")
+	}
 	s.events = append(s.events, container)
 }
 
 func (s *stateImpl[C]) SetStartingState(state StateId) {
-	startingState := s.stateMachine.getState(state)
+	startingState := s.definition.getState(state)
 	if startingState.parent != s {
 		panic("Starting State has to be direct child")
 	}
 	s.startingState = startingState
 }
 
-func (s *stateImpl[C]) Transit(state StateId, reaction BaseAction) ReactionResult {
-	return s.stateMachine.transit(state, reaction)
+func (s *stateImpl[C]) Transit(state StateId, reaction BaseAction, kind ...TransitionKind) ReactionResult {
+	result := s.definition.transit(state, reaction)
+	result.local = transitionKindOf(kind) == LOCAL
+	return result
 }
 
 func (s *stateImpl[C]) Forward() ReactionResult {
@@ -58,11 +95,31 @@ func (s *stateImpl[C]) Defer() ReactionResult {
 }
 
 func (s *stateImpl[C]) PostEvent(event Event) {
-	s.stateMachine.postedEvents = append(s.stateMachine.postedEvents, event)
+	s.postEvent(s.ownerInstance("PostEvent"), event)
+}
+
+// Posts an event to the queue of `sm`
+func (s *stateImpl[C]) postEvent(sm *stateMachineImpl[C], event Event) {
+	sm.post(event, s.name)
+}
+
+func (s *stateImpl[C]) DeferredEvents() []Event {
+	return s.ownerInstance("DeferredEvents").deferredEvents.slice()
 }
 
+// Returns the context of the state machine, the states of a Definition use the proxy bound to
+// the instance (see StateProxy.Bind)
 func (s *stateImpl[C]) GetContext() *C {
-	return s.stateMachine.userContext
+	return s.ownerInstance("GetContext").userContext
+}
+
+// Returns the instance owning the definition, panics for the states of a Definition
+// `method` the proxy method called
+func (s *stateImpl[C]) ownerInstance(method string) *stateMachineImpl[C] {
+	if s.definition.owner == nil {
+		panic(method + " called on a state of a Definition, use the proxy bound to the instance (see StateProxy.Bind)")
+	}
+	return s.definition.owner
 }
 
 func (s *stateImpl[C]) GetAncestor(ancestorStateId StateId) State[C] {
@@ -80,44 +137,48 @@ func (s *stateImpl[C]) GetAncestor(ancestorStateId StateId) State[C] {
 }
 
 func (s *stateImpl[C]) FindStateId(selector func(state State[C]) bool) StateId {
-	if id, ok := s.stateMachine.findStateId(selector); ok {
-		return id
-	}
-	panic("State not found")
+	return s.FindKeyedStateId("", selector)
 }
 
-func (s *stateImpl[C]) findReaction(e Event) *EventReaction {
-	for _, r := range s.events {
-		if r.eventSelector(e) {
-			return &r
-		}
+func (s *stateImpl[C]) FindKeyedStateId(key string, selector func(state State[C]) bool) StateId {
+	if id, ok := s.definition.findKeyedStateId(s.scope, key, selector); ok {
+		return id
 	}
-	return nil
+	panic("State not found")
 }
 
-func (s *stateImpl[C]) processEvent(e Event) ReactionResult {
-	logger := s.stateMachine.DebugLogger
-	r := s.findReaction(e)
-	if r != nil && r.reaction != nil {
-		if logger != nil {
-			logger("Process Event", "event", reflect.TypeOf(e), "state", s.name)
-		}
-		return r.reaction(e)
-	}
-	if s.stateMachine.DebugLogger != nil {
-		logger("Forward Event", "event", reflect.TypeOf(e), "state", s.name)
-	}
-	return ReactionResult{status: FORWARD}
+// Create a transition result (only needed for custom reactions)
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `kind` is the transition kind (EXTERNAL by default)
+func Transit[S any, C any, PS StateCst[S, C]](from StateProxy[C], kind ...TransitionKind) ReactionResult {
+	toId := FindStateId[S, C, PS](from)
+	return from.Transit(toId, nil, kind...)
 }
 
-func Transit[S any, C any, PS StateCst[S, C]](from StateProxy[C]) ReactionResult {
+// Create a transition result with an action (only needed for custom reactions)
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `action` is the action associated with the transition
+// `kind` is the transition kind (EXTERNAL by default)
+func TransitWithAction[S any, C any, E any, PS StateCst[S, C], PE EventCst[E]](from StateProxy[C], action Action[E, PE], kind ...TransitionKind) ReactionResult {
 	toId := FindStateId[S, C, PS](from)
-	return from.Transit(toId, nil)
+	return from.Transit(toId, ToBaseAction(action), kind...)
 }
 
-func TransitWithAction[S any, C any, E any, PS StateCst[S, C], PE EventCst[E]](from StateProxy[C], action Action[E, PE]) ReactionResult {
-	toId := FindStateId[S, C, PS](from)
-	return from.Transit(toId, ToBaseAction(action))
+// Create a transition result to a keyed state (only needed for custom reactions)
+// `S` is the actual user state that we are going to
+// `C` is the user context (deducted)
+// `PS` is a pointer to `S` (deducted)
+// `from` is the proxy of the current state
+// `key` is the key of the target state
+func TransitTo[S any, C any, PS StateCst[S, C]](from StateProxy[C], key string) ReactionResult {
+	toId := FindStateIdByKey[S, C, PS](from, key)
+	return from.Transit(toId, nil)
 }
 
 func GetAncestor[S any, C any, PS StateCst[S, C]](state StateProxy[C]) *S {
@@ -130,181 +191,522 @@ func GetAncestor[S any, C any, PS StateCst[S, C]](state StateProxy[C]) *S {
 
 ////////////////////////////////////////////////////
 
-type stateMachineImpl[C any] struct {
-	states         []*stateImpl[C]
-	currentState   *stateImpl[C]
-	DebugLogger    func(msg string, keysAndValues ...interface{})
-	userContext    *C
-	initialized    bool
-	postedEvents   []Event
-	deferredEvents []Event
+// The shared part of a state machine: the states, their reactions and the initial state.
+// It is built once and then used by one or more stateMachineImpl instances.
+type definitionImpl[C any] struct {
+	states       []*stateImpl[C]
+	initialState *stateImpl[C]
+	initialPath  *transitionPath[C]
+	built        bool
+	// the instance that created this definition, used by the state proxies (nil for a shared
+	// Definition, its instances are reached through the proxies bound to them, see StateProxy.Bind)
+	owner *stateMachineImpl[C]
+	// why a shared Definition can't be instantiated ("" if it can), see checkBoundActions
+	unbound string
+	// cache of the transition paths, filled while dispatching
+	transitions map[transitionKey[C]]*transitionPath[C]
+	// guards the caches filled while dispatching (the transition paths and the dispatch tables)
+	cacheMutex sync.RWMutex
+	// the target of the abort with ABORT_TO_ERROR_STATE
+	errorState *stateImpl[C]
+	// the declared event alphabet (see SetEventRegistry)
+	eventRegistry *EventRegistry
+}
+
+func (d *definitionImpl[C]) setErrorState(id StateId) {
+	if d.built {
+		panic("Cannot set the error state after the definition is built")
+	}
+	d.errorState = d.getState(id)
 }
 
-func (sm *stateMachineImpl[C]) addStateImpl(state State[C]) *stateImpl[C] {
-	if sm.states == nil {
-		sm.states = make([]*stateImpl[C], 0, 10)
+func (d *definitionImpl[C]) addStateImpl(state State[C], key string, scope *stateImpl[C]) *stateImpl[C] {
+	if d.built {
+		panic("Cannot add a state after the definition is built")
+	}
+	if d.states == nil {
+		d.states = make([]*stateImpl[C], 0, 10)
 	}
 	// The only place we use reflection. It is ok because it's not in the hot path
-	newStateType := reflect.TypeOf(state)
+	newStateType := userStateType(state)
 	selector := func(s State[C]) bool {
-		return reflect.TypeOf(s) == newStateType
+		return userStateType(s) == newStateType
 	}
-	if _, ok := sm.findStateId(selector); ok {
-		panic("State kind already exist")
+	if _, ok := d.findKeyedStateId(scope, key, selector); ok {
+		if len(key) == 0 {
+			panic("State kind already exist")
+		}
+		panic("State kind already exist with key " + key)
 	}
-	newStateImpl := &stateImpl[C]{id: (StateId)(len(sm.states)), userState: state, stateMachine: sm, events: make([]EventReaction, 0, 16)}
-	sm.states = append(sm.states, newStateImpl)
+	newStateImpl := &stateImpl[C]{id: (StateId)(len(d.states)), key: key, scope: scope, userState: state, definition: d, events: make([]EventReaction, 0, 16)}
+	d.states = append(d.states, newStateImpl)
 	return newStateImpl
 }
 
-func (sm *stateMachineImpl[C]) getState(id StateId) *stateImpl[C] {
-	if (int)(id) < len(sm.states) {
-		return sm.states[id]
+func (d *definitionImpl[C]) getState(id StateId) *stateImpl[C] {
+	if id >= 0 && (int)(id) < len(d.states) {
+		return d.states[id]
 	}
 	panic("State not found")
 }
 
-func (sm *stateMachineImpl[C]) AddState(state State[C]) StateId {
-	if sm.initialized {
-		panic("Cannot call AddState after calling Initialized")
-	}
-	return sm.addStateImpl(state).id
+func (d *definitionImpl[C]) addState(state State[C], key string) StateId {
+	return d.addStateImpl(state, key, nil).id
 }
 
-func (sm *stateMachineImpl[C]) AddSubState(state State[C], parentId StateId) StateId {
-	if sm.initialized {
-		panic("Cannot call AddSubState after calling Initialize")
-	}
-	newStateImpl := sm.addStateImpl(state)
-	parentImpl := sm.getState(parentId)
+func (d *definitionImpl[C]) addSubState(state State[C], parentId StateId, key string) StateId {
+	return d.addSubStateImpl(state, d.getState(parentId), key, nil).id
+}
+
+func (d *definitionImpl[C]) addSubStateImpl(state State[C], parentImpl *stateImpl[C], key string, scope *stateImpl[C]) *stateImpl[C] {
 	if parentImpl.userState == state {
 		panic("parent can't be self")
 	}
+	newStateImpl := d.addStateImpl(state, key, scope)
 	parentImpl.isSuperState = true
 	newStateImpl.parent = parentImpl
-	return newStateImpl.id
+	return newStateImpl
+}
+
+// Finds a state registered without a key
+func (d *definitionImpl[C]) findStateId(selector func(state State[C]) bool) (StateId, bool) {
+	return d.findKeyedStateId(nil, "", selector)
 }
 
-func (sm *stateMachineImpl[C]) findStateId(selector func(state State[C]) bool) (StateId, bool) {
-	for _, state := range sm.states {
-		if selector(state.userState) {
+// Finds a state registered with `key` in `scope` (nil for the states of the machine itself)
+func (d *definitionImpl[C]) findKeyedStateId(scope *stateImpl[C], key string, selector func(state State[C]) bool) (StateId, bool) {
+	for _, state := range d.states {
+		if state.pseudo == notPseudo && state.scope == scope && state.key == key && selector(state.userState) {
 			return state.id, true
 		}
 	}
 	return 0, false
 }
 
-func (sm *stateMachineImpl[C]) Initialize(initStateId StateId) {
-	if sm.initialized {
-		panic("Cannot call Initialize more then once")
+// Calls Setup on every state and validates the initial state.
+func (d *definitionImpl[C]) build(initStateId StateId) {
+	if d.built {
+		panic("Cannot build a definition more then once")
 	}
-	sm.initialized = true
-	sm.postedEvents = make([]Event, 0, 10)
-	for _, state := range sm.states {
-		state.enterAction, state.exitAction = state.userState.Setup(state)
+	for _, state := range d.states {
+		state.setActions(state.userState.Setup(state))
 		if len(state.name) == 0 {
-			// the default name is struct name
-			state.name = reflect.TypeOf(state.userState).Elem().Name()
+			// the default name is struct name (without the type parameters), followed by the
+			// key for a keyed state
+			state.name, _, _ = strings.Cut(userStateType(state.userState).Elem().Name(), "[")
+			if len(state.key) != 0 {
+				state.name += "_" + state.key
+			}
 		}
-	}
-	nextState := sm.getState(initStateId)
-	if nextState.isSuperState {
-		if nextState.startingState != nil {
-			nextState = nextState.startingState
-		} else {
-			panic("Not a allowed in UML (SupperState cannot be current). Set a sub-state to initial state, or create an empty initial sate")
-			// TODO add build or library flag to support this.
+		if state.scope != nil {
+			// the names of the mounted states are prefixed by the sub machine state name
+			state.name = state.scope.name + "_" + state.name
 		}
 	}
-	doEnters(nextState, nil)
-	sm.currentState = nextState
+	if d.owner == nil {
+		d.unbound = d.checkBoundActions()
+	}
+	d.buildPseudoStates()
+	d.checkStatePaths()
+	d.buildDispatchTables()
+	d.setInitialState(initStateId)
+	d.built = true
 }
 
-func (sm *stateMachineImpl[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
-	if !sm.initialized {
+func (d *definitionImpl[C]) setInitialState(initStateId StateId) {
+	d.initialPath = d.transitionPath(nil, d.getState(initStateId), nil, false)
+	d.initialState = d.initialPath.leaf
+}
+
+func (d *definitionImpl[C]) transit(to StateId, transitionAction BaseAction) ReactionResult {
+	targetState := d.getState(to)
+	return ReactionResult{status: TRANSIT, targetState: targetState, action: transitionAction}
+}
+
+func (d *definitionImpl[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
+	if !d.built {
 		panic("State Machine not Initialized")
 	}
 	if umlSyntax == PLANT_UML {
-		plantUmlPrint(w, sm, diagramType)
+		plantUmlPrint(w, d, diagramType, nil)
+	}
+}
+
+// A running instance of a definition, it holds the user context, the current state and the event queues
+type stateMachineImpl[C any] struct {
+	*definitionImpl[C]
+	machineOptions
+	currentState   *stateImpl[C]
+	DebugLogger    func(msg string, keysAndValues ...interface{})
+	userContext    *C
+	initialized    bool
+	postedEvents   eventQueue
+	deferredEvents eventQueue
+	// the number of deferred events with a time to live, the expiry scan is skipped at zero
+	expiringEvents int
+	// true after an action failed with STOP_ON_FAILURE
+	stopped bool
+	// true while transiting to the error state
+	aborting bool
+	// the context of the event being processed (nil for context.Background)
+	eventContext context.Context
+	// the event being processed (nil outside of a run-to-completion step)
+	currentEvent Event
+	// the metadata of the event being processed
+	currentMetadata EventMetadata
+	// true while the event log is replayed (see NewEventSourcedStateMachine)
+	replaying bool
+	// true during the step of a replayed event, the machine time is then its recorded time
+	replayStep bool
+	replayTime time.Time
+	// serializes the run-to-completion steps and the inspection of the instance
+	runMutex sync.Mutex
+	// the context given to the actions during the step, bound to the instance (see Context)
+	boundContext context.Context
+	// the state proxies bound to the instance, made by the first call to StateProxy.Bind
+	proxies []instanceProxy[C]
+	// the cancel functions of the running do-activities, by state id
+	activities []context.CancelFunc
+	// runs the do-activities, nil to run them in goroutines
+	activityRunner activityRunner
+}
+
+// Returns the definition, a machine made from MakeStateMachine owns a private one
+func (sm *stateMachineImpl[C]) definition() *definitionImpl[C] {
+	if sm.definitionImpl == nil {
+		sm.definitionImpl = &definitionImpl[C]{owner: sm}
+	}
+	return sm.definitionImpl
+}
+
+func (sm *stateMachineImpl[C]) AddState(state State[C]) StateId {
+	return sm.AddKeyedState(state, "")
+}
+
+func (sm *stateMachineImpl[C]) AddKeyedState(state State[C], key string) StateId {
+	if sm.initialized {
+		panic("Cannot call AddState after calling Initialized")
+	}
+	return sm.definition().addState(state, key)
+}
+
+func (sm *stateMachineImpl[C]) AddSubMachine(container State[C], sub SubMachine[C], parentId StateId) StateId {
+	if sm.initialized {
+		panic("Cannot call AddSubMachine after calling Initialized")
+	}
+	return sub.mount(sm.definition(), container, parentId)
+}
+
+func (sm *stateMachineImpl[C]) SetErrorState(id StateId) {
+	if sm.initialized {
+		panic("Cannot call SetErrorState after calling Initialized")
+	}
+	sm.definition().setErrorState(id)
+}
+
+func (sm *stateMachineImpl[C]) SetEventRegistry(registry *EventRegistry) {
+	if sm.initialized {
+		panic("Cannot call SetEventRegistry after calling Initialized")
+	}
+	sm.definition().setEventRegistry(registry)
+}
+
+func (sm *stateMachineImpl[C]) AddSubState(state State[C], parentId StateId) StateId {
+	return sm.AddKeyedSubState(state, parentId, "")
+}
+
+func (sm *stateMachineImpl[C]) AddKeyedSubState(state State[C], parentId StateId, key string) StateId {
+	if sm.initialized {
+		panic("Cannot call AddSubState after calling Initialize")
 	}
+	return sm.definition().addSubState(state, parentId, key)
+}
 
+func (sm *stateMachineImpl[C]) Initialize(initStateId StateId) {
+	if sm.initialized {
+		panic("Cannot call Initialize more then once")
+	}
+	sm.buildDefinition(initStateId)
+	sm.start()
 }
+
+// Builds the private definition, or only sets its initial state when it was already built by
+// a snapshot that failed to restore (see snapshotConfig.restore)
+func (sm *stateMachineImpl[C]) buildDefinition(initStateId StateId) {
+	if d := sm.definition(); d.built && d.owner == sm {
+		d.setInitialState(initStateId)
+	} else {
+		d.build(initStateId)
+	}
+}
+
+// Enters the initial state of the (already built) definition
+func (sm *stateMachineImpl[C]) start() {
+	if sm.initialized {
+		panic("Cannot call Initialize more then once")
+	}
+	sm.checkLeaf(sm.initialState)
+	if sm.actionFailurePolicy == ABORT_TO_ERROR_STATE && sm.errorState == nil {
+		panic("ABORT_TO_ERROR_STATE requires an error state (see SetErrorState)")
+	}
+	sm.initialized = true
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	defer func() { sm.boundContext = nil }()
+	sm.currentState = sm.runTransition(nil, sm.initialPath, ReactionResult{}, sm.initialState, nil)
+	if sm.stopped {
+		sm.dropPostedEvents()
+		return
+	}
+	sm.postCompletion()
+	sm.checkInvariants(nil)
+	// the events posted by the initial transition (e.g. a CompletionEvent or an
+	// ActionFailedEvent) are processed before Initialize returns
+	sm.runPostedEvents()
+}
+
+func (sm *stateMachineImpl[C]) GenerateUml(w io.Writer, umlSyntax UmlSyntax, diagramType UmlDiagramType) {
+	sm.definition().GenerateUml(w, umlSyntax, diagramType)
+}
+
 func (sm *stateMachineImpl[C]) DispatchEvent(event Event) {
+	sm.dispatch(queuedEvent{event: event})
+}
+
+func (sm *stateMachineImpl[C]) DispatchEventContext(ctx context.Context, event Event) {
+	sm.dispatch(queuedEvent{event: event, ctx: ctx})
+}
+
+// Runs the run-to-completion step of an event
+func (sm *stateMachineImpl[C]) dispatch(event queuedEvent) {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	defer func() { sm.replayStep = false }()
+	if event.replayed {
+		// the deferral time, the deferral TTL and the metadata use the recorded time
+		sm.replayStep = true
+		sm.replayTime = event.metadata.EnqueuedAt
+	}
+	sm.enqueued(&event)
+	if sm.stopped {
+		sm.dropEvent(&event, DROP_MACHINE_STOPPED)
+		return
+	}
+	sm.dropExpiredEvents()
 	// Add event to the queue first
-	sm.postedEvents = append(sm.postedEvents, event)
-	for len(sm.postedEvents) > 0 {
-		result, nextState := processEvent(sm.currentState, sm.currentState, sm.postedEvents[0])
-		if result == TRANSIT {
+	sm.postedEvents.pushBack(event)
+	sm.runPostedEvents()
+}
+
+// Processes the posted events until the queue is empty, it must be called while holding the run
+// mutex
+func (sm *stateMachineImpl[C]) runPostedEvents() {
+	defer func() {
+		sm.eventContext = nil
+		sm.boundContext = nil
+		sm.currentEvent = nil
+		sm.currentMetadata = EventMetadata{}
+	}()
+	// Ordering: the events are processed in the order they were posted, except after a state
+	// change where the deferred events that are no longer deferred are replayed first, in the
+	// order they were deferred.
+	for sm.postedEvents.len() > 0 {
+		current := sm.postedEvents.popFront()
+		if current.deferred {
+			// a replayed event that the current state still defers goes back to the deferred
+			// queue without running a reaction, in its original place
+			if handler := sm.currentState.deferringHandler(current.event); handler != nil {
+				sm.deferEvent(current, handler.deferTTL)
+				continue
+			}
+		}
+		if (current.ctx != nil && current.ctx.Err() != nil) || (current.activity != nil && current.activity.Err() != nil) {
+			// the dispatch was canceled or its deadline was exceeded, or the do-activity that
+			// returned the event was canceled
+			sm.dropEvent(&current, DROP_CONTEXT_DONE)
+			continue
+		}
+		sm.eventContext = current.ctx
+		sm.boundContext = nil
+		current.metadata.DispatchedAt = sm.now()
+		sm.currentEvent = current.event
+		sm.currentMetadata = current.metadata
+		from := sm.currentState
+		result, nextState := sm.processEvent(current.event)
+		if result.status == TRANSIT {
+			if sm.stopped {
+				// an action failed with STOP_ON_FAILURE, the active state is where it failed
+				sm.currentState = nextState
+				sm.dropPostedEvents()
+				return
+			}
 			if sm.DebugLogger != nil {
-				sm.DebugLogger("Change State", "from", sm.currentState.name, "to", nextState.name)
+				sm.DebugLogger("Change State", "from", sm.currentState.name, "to", nextState.name, "id", current.metadata.ID)
 			}
 			sm.currentState = nextState
-			if len(sm.deferredEvents) > 0 {
-				// push deferredEvents to the front of the queue
-				sm.postedEvents = append(sm.deferredEvents, sm.postedEvents[1:]...)
-				// clear deferredEvents
-				sm.deferredEvents = sm.deferredEvents[:0]
-				// force a start over
-				continue
+			for _, o := range sm.observers.transitions {
+				o.OnTransition(current.event, current.metadata, from.id, nextState.id)
 			}
-		} else if result == DEFER {
-			sm.deferredEvents = append(sm.deferredEvents, event)
+			sm.postCompletion()
+			sm.replayDeferredEvents()
+		} else if result.status == DEFER {
+			sm.deferEvent(current, result.deferTTL)
+		}
+		sm.checkInvariants(current.event)
+	}
+}
+
+// Drops the posted events, when the state machine is stopped
+func (sm *stateMachineImpl[C]) dropPostedEvents() {
+	for sm.postedEvents.len() > 0 {
+		dropped := sm.postedEvents.popFront()
+		sm.dropEvent(&dropped, DROP_MACHINE_STOPPED)
+	}
+}
+
+// Panics if `leaf` is a super state and the option WithSuperStateLeaf is not used
+func (sm *stateMachineImpl[C]) checkLeaf(leaf *stateImpl[C]) {
+	if leaf.isSuperState && !sm.allowSuperStateLeaf {
+		panic("Not a allowed in UML (SupperState cannot be current). Set a sub-state to initial state, or create an empty initial sate, or use WithSuperStateLeaf")
+	}
+}
+
+// Posts an event with the context of the event being processed
+// `source` the default source of the event (see EventMetadata)
+func (sm *stateMachineImpl[C]) post(event Event, source string) {
+	// the context of the event being processed carries its metadata, not the one of this event
+	queued := queuedEvent{event: event, ctx: sm.eventContext}
+	sm.stamp(&queued)
+	if queued.metadata.Source == "" {
+		queued.metadata.Source = source
+	}
+	if sm.currentEvent != nil {
+		sm.inheritMetadata(&queued.metadata, &sm.currentMetadata)
+	}
+	sm.postedEvents.pushBack(queued)
+}
+
+// Posts a CompletionEvent if the current state is a final state
+func (sm *stateMachineImpl[C]) postCompletion() {
+	if isFinalState(sm.currentState.userState) && sm.currentState.parent != nil {
+		sm.post(&CompletionEvent{State: sm.currentState.parent.id, FinalState: sm.currentState.id}, sm.currentState.name)
+	}
+}
+
+// Adds an event to the deferred queue, applying the size limit
+// `deferTTL` the time to live of the event, measured from the time it was first deferred
+func (sm *stateMachineImpl[C]) deferEvent(event queuedEvent, deferTTL time.Duration) {
+	if !event.deferred {
+		event.deferred = true
+		event.deferredAt = sm.now()
+	}
+	event.deferTTL = deferTTL
+	if sm.maxDeferredEvents > 0 && sm.deferredEvents.len() >= sm.maxDeferredEvents {
+		switch sm.overflowPolicy {
+		case DROP_OLDEST:
+			dropped := sm.popDeferred()
+			sm.dropEvent(&dropped, DROP_DEFERRED_OVERFLOW)
+		case DROP_NEWEST:
+			sm.dropEvent(&event, DROP_DEFERRED_OVERFLOW)
+			return
+		default:
+			panic("Deferred queue overflow")
 		}
-		// pop front
-		sm.postedEvents = sm.postedEvents[1:]
 	}
+	sm.pushDeferred(event)
+}
 
+// Adds an event at the back of the deferred queue, counting the events with a time to live
+func (sm *stateMachineImpl[C]) pushDeferred(event queuedEvent) {
+	if event.deferTTL > 0 {
+		sm.expiringEvents++
+	}
+	sm.deferredEvents.pushBack(event)
 }
 
-func processEvent[C any](currentState *stateImpl[C], activeState *stateImpl[C], event Event) (ResultType, *stateImpl[C]) {
-	result := activeState.processEvent(event)
-	switch result.status {
-	case FORWARD:
-		if activeState.parent != nil {
-			return processEvent(currentState, activeState.parent, event)
+// Removes the event at the front of the deferred queue, counting the events with a time to live
+func (sm *stateMachineImpl[C]) popDeferred() queuedEvent {
+	event := sm.deferredEvents.popFront()
+	if event.deferTTL > 0 {
+		sm.expiringEvents--
+	}
+	return event
+}
+
+// Drops the deferred events that are deferred for longer than their time to live
+func (sm *stateMachineImpl[C]) dropExpiredEvents() {
+	if sm.expiringEvents == 0 {
+		return
+	}
+	now := sm.now()
+	for n := sm.deferredEvents.len(); n > 0; n-- {
+		event := sm.popDeferred()
+		if event.expired(now) {
+			sm.dropEvent(&event, DROP_DEFERRED_EXPIRED)
+		} else {
+			sm.pushDeferred(event)
 		}
-		// The top state will discard
-		return DISCARD, nil
-	case DISCARD:
-		return DISCARD, nil
-	case TRANSIT:
-		if result.targetState == nil {
-			panic("next state is empty Transit was not call in the event handler")
+	}
+}
+
+// Moves all the deferred events to the front of the posted queue, in the order they were
+// deferred. The events the current state still defers, by AddDefer or by a custom reaction,
+// are deferred again as they are replayed, so the deferred queue keeps its order.
+func (sm *stateMachineImpl[C]) replayDeferredEvents() {
+	sm.dropExpiredEvents()
+	sm.postedEvents.prependAll(&sm.deferredEvents)
+	sm.expiringEvents = 0
+}
+
+// Returns the events currently deferred, in the order they were deferred
+func (sm *stateMachineImpl[C]) DeferredEvents() []Event {
+	sm.runMutex.Lock()
+	defer sm.runMutex.Unlock()
+	sm.dropExpiredEvents()
+	return sm.deferredEvents.slice()
+}
+
+func (sm *stateMachineImpl[C]) processEvent(event Event) (ReactionResult, *stateImpl[C]) {
+	logger := sm.DebugLogger
+	for _, handler := range sm.currentState.handlers(event) {
+		if logger != nil {
+			metadata := &sm.currentMetadata
+			logger("Process Event", "event", reflect.TypeOf(event), "state", handler.state.name,
+				"id", metadata.ID, "correlation", metadata.CorrelationID, "causation", metadata.CausationID, "source", metadata.Source)
 		}
-		nextState := result.targetState.(*stateImpl[C])
-		// Find LCN
-		lca := findRoot(currentState, nextState)
-		// Run all the exits not including lca
-		doExits(currentState, lca)
-		// Run the action
-		if result.action != nil {
-			result.action(event)
+		result := handler.reaction(sm, event)
+		if len(sm.observers.reactions) != 0 {
+			sm.reacted(event, handler.state, result)
 		}
-		// Run all the enters not including lca
-		doEnters(nextState, lca)
-		// if the next state is supper state and has a starting start
-		if nextState.isSuperState {
-			if nextState.startingState != nil {
-				nextState = nextState.startingState
-				// run enter on initial state
-				if nextState.enterAction != nil {
-					nextState.enterAction()
+		switch result.status {
+		case FORWARD:
+			if logger != nil {
+				logger("Forward Event", "event", reflect.TypeOf(event), "state", handler.state.name)
+			}
+			continue
+		case DISCARD:
+			if len(sm.observers.actions) != 0 {
+				if action := documentedAction(&handler, result); action != "" {
+					sm.actionRun(event, &handler, action)
 				}
-			} else {
-				panic("Not a allowed in UML (SupperState cannot be current). Set a sub-state to initial state, or create an empty initial sate")
-				// TODO add build or library flag to support this.
 			}
+			return result, nil
+		case TRANSIT:
+			if result.targetState == nil {
+				panic("next state is empty Transit was not call in the event handler")
+			}
+			// the state owning the reaction is the source of the transition
+			path := sm.transitionPath(sm.currentState, result.targetState.(*stateImpl[C]), handler.state, result.local)
+			sm.checkLeaf(path.leaf)
+			return result, sm.runTransition(event, path, result, result.targetState.(*stateImpl[C]), &handler)
+		case DEFER:
+			return result, nil
+		default:
+			panic("Invalid ResultType")
 		}
-		return TRANSIT, nextState
-	case DEFER:
-		return DEFER, nil
 	}
-	panic("Invalid ResultType")
-}
-
-func (sm *stateMachineImpl[C]) transit(to StateId, transitionAction BaseAction) ReactionResult {
-	targetState := sm.getState(to)
-	return ReactionResult{TRANSIT, targetState, transitionAction}
+	// The top state will discard
+	return ReactionResult{status: DISCARD}, nil
 }
 
 func calcHierarchyLevel[C any](state *stateImpl[C]) int {
@@ -317,9 +719,12 @@ func calcHierarchyLevel[C any](state *stateImpl[C]) int {
 }
 
 func findRoot[C any](left, right *stateImpl[C]) *stateImpl[C] {
-	// Note Level could be saved in BaseState
-	ll := calcHierarchyLevel(left)
-	rl := calcHierarchyLevel(right)
+	if left == nil || right == nil {
+		// entering from outside of the state machine
+		return nil
+	}
+	ll := left.level
+	rl := right.level
 	if ll > rl {
 		// swap left and right
 		left, right = right, left
@@ -343,23 +748,3 @@ func findRoot[C any](left, right *stateImpl[C]) *stateImpl[C] {
 	}
 	return left
 }
-
-func doEnters[C any](state *stateImpl[C], root *stateImpl[C]) {
-	if state == root {
-		return
-	}
-	doEnters(state.parent, root)
-	if state.enterAction != nil {
-		state.enterAction()
-	}
-}
-
-func doExits[C any](state *stateImpl[C], root *stateImpl[C]) {
-	if state == root {
-		return
-	}
-	if state.exitAction != nil {
-		state.exitAction()
-	}
-	doExits(state.parent, root)
-}
@@ -151,9 +151,9 @@ func TestAddState(t *testing.T) {
 	assert.True(t, sm.states[ctx.OffId].isSuperState)
 	assert.False(t, sm.states[ctx.TagId].isSuperState)
 
-	assert.Equal(t, &ctx, sm.states[ctx.OnId].stateMachine.userContext)
-	assert.Equal(t, &ctx, sm.states[ctx.OffId].stateMachine.userContext)
-	assert.Equal(t, &ctx, sm.states[ctx.TagId].stateMachine.userContext)
+	assert.Equal(t, &ctx, sm.states[ctx.OnId].GetContext())
+	assert.Equal(t, &ctx, sm.states[ctx.OffId].GetContext())
+	assert.Equal(t, &ctx, sm.states[ctx.TagId].GetContext())
 }
 
 func TestInit(t *testing.T) {
@@ -245,10 +245,11 @@ func TestDefer(t *testing.T) {
 	sm.Initialize(ctx.OffId)
 	sm.DispatchEvent(&TagEvent{})
 
+	// the external transition exits and re-enters Off
 	ctx.OnEnter.Validate(0)
 	ctx.OnExit.Validate(0)
-	ctx.OffEnter.Validate(1)
-	ctx.OffExit.Validate(0)
+	ctx.OffEnter.Validate(2)
+	ctx.OffExit.Validate(1)
 	ctx.TagEnter.Validate(1)
 	ctx.TagExit.Validate(0)
 
@@ -257,8 +258,8 @@ func TestDefer(t *testing.T) {
 
 	ctx.OnEnter.Validate(0)
 	ctx.OnExit.Validate(0)
-	ctx.OffEnter.Validate(1)
-	ctx.OffExit.Validate(0)
+	ctx.OffEnter.Validate(2)
+	ctx.OffExit.Validate(1)
 	ctx.TagEnter.Validate(1)
 	ctx.TagExit.Validate(0)
 
@@ -266,8 +267,8 @@ func TestDefer(t *testing.T) {
 	assert.Equal(t, ctx.OnId, sm.currentState.id)
 	ctx.OnEnter.Validate(1)
 	ctx.OnExit.Validate(0)
-	ctx.OffEnter.Validate(1)
-	ctx.OffExit.Validate(1)
+	ctx.OffEnter.Validate(2)
+	ctx.OffExit.Validate(2)
 	ctx.TagEnter.Validate(1)
 	ctx.TagExit.Validate(1)
 
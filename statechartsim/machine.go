@@ -0,0 +1,349 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+// Package statechartsim simulates state machines interactively (see cmd/statechart-sim): a
+// registered Go state machine (see Register and FromStateMachine) or an exported JSON model
+// (see statechart.Model and FromModel).
+package statechartsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	statechart "github.com/hhassoubi/go-statechart"
+)
+
+// A simulated state machine
+type Machine interface {
+	// Returns the model of the machine
+	Model() statechart.Model
+	// Returns the paths of the active configuration, from the top state down to the active state
+	Configuration() []string
+	// Dispatches an event
+	// `event` the event name (see statechart.ModelReaction)
+	// returns the steps that ran (reactions, exits, actions and entries)
+	Dispatch(event string) ([]string, error)
+}
+
+// Creates a new simulated machine in its initial configuration
+type Factory func() (Machine, error)
+
+var registry = struct {
+	factories map[string]Factory
+	mutex     sync.Mutex
+}{factories: map[string]Factory{}}
+
+// Registers a machine, typically in an init function of the main package of a simulator
+// `name` the name of the machine (panics if it is already registered)
+// `factory` the factory of the machine
+func Register(name string, factory Factory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.factories[name]; ok {
+		panic(fmt.Sprintf("The machine %s is already registered", name))
+	}
+	registry.factories[name] = factory
+}
+
+// Returns the names of the registered machines, sorted
+func Registered() []string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the factory of a registered machine
+// `name` the name of the machine
+func Lookup(name string) (Factory, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	factory, ok := registry.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown machine: %s", name)
+	}
+	return factory, nil
+}
+
+// Records the steps of the dispatched events
+type tracer[C any] struct {
+	statechart.ObserverDefault
+	machine  *statechart.StateMachine[C]
+	registry *statechart.EventRegistry
+	steps    []string
+}
+
+// Returns the name of an event in the registry, else its type
+func (t *tracer[C]) name(event statechart.Event) string {
+	if name, ok := t.registry.Name(event); ok {
+		return name
+	}
+	return fmt.Sprintf("%T", event)
+}
+
+func (t *tracer[C]) OnReaction(event statechart.Event, state statechart.StateId, result statechart.ResultType, target statechart.StateId) {
+	if result == statechart.TRANSIT {
+		t.steps = append(t.steps, fmt.Sprintf("reaction %s: %s -> %s", t.machine.StatePath(state), t.name(event), t.machine.StatePath(target)))
+	} else {
+		t.steps = append(t.steps, fmt.Sprintf("reaction %s: %s / %v", t.machine.StatePath(state), t.name(event), result))
+	}
+}
+
+func (t *tracer[C]) OnAction(event statechart.Event, state statechart.StateId, action string) {
+	if action == "" {
+		t.steps = append(t.steps, "action")
+	} else {
+		t.steps = append(t.steps, "action "+action)
+	}
+}
+
+func (t *tracer[C]) OnStateExited(state statechart.StateId) {
+	t.steps = append(t.steps, "exit "+t.machine.StatePath(state))
+}
+
+func (t *tracer[C]) OnStateEntered(state statechart.StateId) {
+	t.steps = append(t.steps, "enter "+t.machine.StatePath(state))
+}
+
+func (t *tracer[C]) OnEventDropped(event statechart.Event, metadata statechart.EventMetadata, reason statechart.DropReason) {
+	t.steps = append(t.steps, fmt.Sprintf("drop %s (%v)", t.name(event), reason))
+}
+
+func (t *tracer[C]) OnActionFailed(failure *statechart.ActionFailedEvent) {
+	t.steps = append(t.steps, "action failed: "+failure.Error())
+}
+
+// A simulated Go state machine
+type goMachine[C any] struct {
+	machine  *statechart.StateMachine[C]
+	registry *statechart.EventRegistry
+	tracer   *tracer[C]
+}
+
+// Returns a simulated Go state machine, the events are created by name with the event registry
+// `machine` the initialized state machine, it gets an observer recording the steps
+// `registry` the event registry of the machine
+func FromStateMachine[C any](machine *statechart.StateMachine[C], registry *statechart.EventRegistry) Machine {
+	if registry == nil {
+		panic("A simulated state machine requires an event registry")
+	}
+	m := &goMachine[C]{machine: machine, registry: registry, tracer: &tracer[C]{machine: machine, registry: registry}}
+	machine.AddObserver(m.tracer)
+	return m
+}
+
+func (m *goMachine[C]) Model() statechart.Model {
+	return m.machine.Model()
+}
+
+func (m *goMachine[C]) Configuration() []string {
+	configuration := m.machine.Configuration()
+	paths := make([]string, len(configuration))
+	for i, state := range configuration {
+		paths[i] = m.machine.StatePath(state.Id)
+	}
+	return paths
+}
+
+func (m *goMachine[C]) isEventName(name string) bool {
+	for _, registered := range m.registry.Names() {
+		if registered == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *goMachine[C]) Dispatch(name string) ([]string, error) {
+	event, err := m.registry.NewEvent(name)
+	if err != nil {
+		return nil, err
+	}
+	m.tracer.steps = nil
+	m.machine.DispatchEvent(event)
+	return m.tracer.steps, nil
+}
+
+// Reads an exported JSON model
+// `r` the reader of the JSON model (see statechart.Model)
+func LoadModel(r io.Reader) (statechart.Model, error) {
+	model := statechart.Model{}
+	if err := json.NewDecoder(r).Decode(&model); err != nil {
+		return model, err
+	}
+	return model, nil
+}
+
+// A simulated model: the documented reactions run on an interpreter, the guards are assumed
+// true and the first documented reaction to an event is selected
+type modelMachine struct {
+	model    statechart.Model
+	states   map[string]*statechart.ModelState
+	current  string
+	deferred []string
+}
+
+// Returns a simulated model in its initial configuration
+// `model` the model, e.g. read by LoadModel
+func FromModel(model statechart.Model) (Machine, error) {
+	m := &modelMachine{model: model, states: map[string]*statechart.ModelState{}}
+	for i := range model.States {
+		m.states[model.States[i].Path] = &model.States[i]
+	}
+	if _, ok := m.states[model.Initial]; !ok {
+		return nil, fmt.Errorf("Unknown initial state: %s", model.Initial)
+	}
+	for _, state := range model.States {
+		for _, reaction := range state.Reactions {
+			if _, ok := m.states[reaction.Target]; reaction.Target != "" && !ok {
+				return nil, fmt.Errorf("Unknown target state of %s: %s", state.Path, reaction.Target)
+			}
+		}
+	}
+	m.current = m.enter("", model.Initial, nil)
+	return m, nil
+}
+
+func (m *modelMachine) Model() statechart.Model {
+	return m.model
+}
+
+func (m *modelMachine) Configuration() []string {
+	return ancestors(m.current)
+}
+
+func (m *modelMachine) Dispatch(event string) ([]string, error) {
+	known := false
+	for _, state := range m.model.States {
+		for _, reaction := range state.Reactions {
+			known = known || reaction.Event == event
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("Unknown event: %s", event)
+	}
+	return m.dispatch(event, nil), nil
+}
+
+func (m *modelMachine) dispatch(event string, steps []string) []string {
+	source, reaction := m.reaction(event)
+	if reaction == nil {
+		return append(steps, "drop "+event+" (no reaction)")
+	}
+	guard := ""
+	if reaction.Guard != "" {
+		guard = "[" + reaction.Guard + "]"
+	}
+	switch reaction.Result {
+	case statechart.TRANSIT.String():
+		steps = append(steps, fmt.Sprintf("reaction %s: %s%s -> %s", source, event, guard, reaction.Target))
+		domain := transitionDomain(source, reaction.Target, reaction.Local)
+		for s := m.current; s != domain; s = parentPath(s) {
+			steps = append(steps, "exit "+s)
+		}
+		if reaction.Action != "" {
+			steps = append(steps, "action "+reaction.Action)
+		}
+		m.current = m.enter(domain, reaction.Target, &steps)
+		// the deferred events no longer deferred are replayed
+		deferred := m.deferred
+		m.deferred = nil
+		for _, e := range deferred {
+			steps = m.dispatch(e, steps)
+		}
+	case statechart.DEFER.String():
+		steps = append(steps, fmt.Sprintf("reaction %s: %s%s / Defer", source, event, guard))
+		m.deferred = append(m.deferred, event)
+	default:
+		steps = append(steps, fmt.Sprintf("reaction %s: %s%s / %s", source, event, guard, reaction.Result))
+		if reaction.Action != "" {
+			steps = append(steps, "action "+reaction.Action)
+		}
+	}
+	return steps
+}
+
+// Returns the first reaction to an event, from the active state up to the top state
+func (m *modelMachine) reaction(event string) (string, *statechart.ModelReaction) {
+	for s := m.current; s != ""; s = parentPath(s) {
+		state, ok := m.states[s]
+		if !ok {
+			continue
+		}
+		var wildcard *statechart.ModelReaction
+		for i := range state.Reactions {
+			if state.Reactions[i].Event == event {
+				return s, &state.Reactions[i]
+			} else if state.Reactions[i].Event == "any" && wildcard == nil {
+				wildcard = &state.Reactions[i]
+			}
+		}
+		if wildcard != nil {
+			return s, wildcard
+		}
+	}
+	return "", nil
+}
+
+// Enters the states below `domain` down to `target`, then the starting states
+// returns the new active state
+func (m *modelMachine) enter(domain string, target string, steps *[]string) string {
+	entered := []string{}
+	for _, s := range ancestors(target) {
+		if domain == "" || (s != domain && strings.HasPrefix(s, domain+"/")) {
+			entered = append(entered, s)
+		}
+	}
+	for state, ok := m.states[target]; ok && state.Starting != ""; state, ok = m.states[target] {
+		target = state.Starting
+		entered = append(entered, target)
+	}
+	if steps != nil {
+		for _, s := range entered {
+			*steps = append(*steps, "enter "+s)
+		}
+	}
+	return target
+}
+
+// Returns the state whose sub-states are exited and entered by a transition, empty for the
+// top level
+func transitionDomain(source string, target string, local bool) string {
+	switch {
+	case local && strings.HasPrefix(target, source+"/"):
+		return source
+	case local && strings.HasPrefix(source, target+"/"):
+		return target
+	}
+	// an external transition exits and enters its source and target
+	domain := parentPath(source)
+	for domain != "" && !strings.HasPrefix(target, domain+"/") {
+		domain = parentPath(domain)
+	}
+	return domain
+}
+
+// Returns the paths of a state and its ancestors, from the top state down to the state
+func ancestors(path string) []string {
+	paths := []string{}
+	for s := path; s != ""; s = parentPath(s) {
+		paths = append([]string{s}, paths...)
+	}
+	return paths
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
@@ -0,0 +1,167 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechartsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	statechart "github.com/hhassoubi/go-statechart"
+)
+
+// A simulation session: the events dispatched to a machine, and their history to step back
+type Session struct {
+	factory Factory
+	machine Machine
+	history []string
+}
+
+// Creates a session
+// `factory` creates the machine, and creates it again to step back
+func NewSession(factory Factory) (*Session, error) {
+	machine, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{factory: factory, machine: machine}, nil
+}
+
+// Returns the paths of the active configuration, from the top state down to the active state
+func (s *Session) Configuration() []string {
+	return s.machine.Configuration()
+}
+
+// A machine creating its events by name, only these names can be dispatched
+type eventNamer interface {
+	isEventName(name string) bool
+}
+
+// Returns the events acceptable in the active configuration: the events of the documented
+// reactions of the active state and its ancestors, from the active state up. An event deferred
+// by the innermost state reacting to it is not acceptable, and a Go machine only accepts the
+// names of its event registry (not the any event and interface reactions).
+func (s *Session) AcceptedEvents() []string {
+	states := map[string][]statechart.ModelReaction{}
+	for _, state := range s.machine.Model().States {
+		states[state.Path] = state.Reactions
+	}
+	namer, named := s.machine.(eventNamer)
+	configuration := s.machine.Configuration()
+	events := []string{}
+	seen := map[string]bool{}
+	for i := len(configuration) - 1; i >= 0; i-- {
+		for _, reaction := range states[configuration[i]] {
+			event := reaction.Event
+			if seen[event] || (named && !namer.isEventName(event)) {
+				continue
+			}
+			seen[event] = true
+			if reaction.Result != statechart.DEFER.String() {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// Dispatches an event
+// `event` the event name
+// returns the steps that ran
+func (s *Session) Dispatch(event string) ([]string, error) {
+	steps, err := s.machine.Dispatch(event)
+	if err != nil {
+		return nil, err
+	}
+	s.history = append(s.history, event)
+	return steps, nil
+}
+
+// Returns the events dispatched, in order
+func (s *Session) History() []string {
+	return append([]string(nil), s.history...)
+}
+
+// Steps back to the configuration before the last event: a new machine replays the history
+// but the last event
+func (s *Session) Back() error {
+	if len(s.history) == 0 {
+		return fmt.Errorf("No event to step back")
+	}
+	machine, err := s.factory()
+	if err != nil {
+		return err
+	}
+	history := s.history[:len(s.history)-1]
+	for _, event := range history {
+		if _, err := machine.Dispatch(event); err != nil {
+			return err
+		}
+	}
+	s.machine = machine
+	s.history = history
+	return nil
+}
+
+const help = `Commands:
+  state     prints the active configuration
+  events    prints the events acceptable in the active configuration
+  <event>   dispatches the event and prints the steps that ran
+  back      steps back to the configuration before the last event
+  history   prints the events dispatched
+  help      prints this help
+  quit      exits
+`
+
+// Runs the interactive loop, one command per line, until quit or the end of the input
+// `in` the commands
+// `out` the output
+func (s *Session) Run(in io.Reader, out io.Writer) error {
+	fmt.Fprintf(out, "state: %s\n> ", s.configuration())
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		switch command {
+		case "":
+		case "quit":
+			return nil
+		case "help":
+			fmt.Fprint(out, help)
+		case "state":
+			fmt.Fprintf(out, "state: %s\n", s.configuration())
+		case "events":
+			fmt.Fprintf(out, "events: %s\n", strings.Join(s.AcceptedEvents(), ", "))
+		case "history":
+			fmt.Fprintf(out, "history: %s\n", strings.Join(s.history, ", "))
+		case "back":
+			if err := s.Back(); err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+			} else {
+				fmt.Fprintf(out, "state: %s\n", s.configuration())
+			}
+		default:
+			steps, err := s.Dispatch(command)
+			if err != nil {
+				fmt.Fprintf(out, "error: %v\n", err)
+				break
+			}
+			for _, step := range steps {
+				fmt.Fprintf(out, "  %s\n", step)
+			}
+			fmt.Fprintf(out, "state: %s\n", s.configuration())
+		}
+		fmt.Fprint(out, "> ")
+	}
+	return scanner.Err()
+}
+
+// Returns the active state, with its ancestors in its path
+func (s *Session) configuration() string {
+	configuration := s.machine.Configuration()
+	if len(configuration) == 0 {
+		return "none"
+	}
+	return configuration[len(configuration)-1]
+}
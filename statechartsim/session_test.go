@@ -0,0 +1,165 @@
+package statechartsim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	statechart "github.com/hhassoubi/go-statechart"
+	"github.com/stretchr/testify/assert"
+)
+
+const playerModel = `{
+  "initial": "Off",
+  "states": [
+    {"path": "Off", "reactions": [{"event": "power", "result": "Transit", "target": "On"}]},
+    {"path": "On", "starting": "On/Stopped", "reactions": [
+      {"event": "power", "result": "Transit", "target": "Off"},
+      {"event": "reset", "result": "Transit", "target": "On/Stopped", "local": true}
+    ]},
+    {"path": "On/Stopped", "reactions": [
+      {"event": "play", "result": "Transit", "target": "On/Playing"},
+      {"event": "eject", "result": "Discard", "action": "OpenTray"}
+    ]},
+    {"path": "On/Playing", "reactions": [{"event": "eject", "result": "Defer"}]}
+  ]
+}`
+
+func makePlayerFactory(t *testing.T) Factory {
+	model, err := LoadModel(strings.NewReader(playerModel))
+	assert.NoError(t, err)
+	return func() (Machine, error) { return FromModel(model) }
+}
+
+func TestModelSession(t *testing.T) {
+	session, err := NewSession(makePlayerFactory(t))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Off"}, session.Configuration())
+
+	steps, err := session.Dispatch("power")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reaction Off: power -> On", "exit Off", "enter On", "enter On/Stopped"}, steps)
+	assert.Equal(t, []string{"On", "On/Stopped"}, session.Configuration())
+	assert.Equal(t, []string{"play", "eject", "power", "reset"}, session.AcceptedEvents())
+
+	session.Dispatch("play")
+	steps, _ = session.Dispatch("eject")
+	assert.Equal(t, []string{"reaction On/Playing: eject / Defer"}, steps)
+	// eject is deferred, not acceptable
+	assert.Equal(t, []string{"power", "reset"}, session.AcceptedEvents())
+	// the local transition doesn't exit On, the deferred event is replayed in On/Stopped
+	steps, _ = session.Dispatch("reset")
+	assert.Equal(t, []string{"reaction On: reset -> On/Stopped", "exit On/Playing", "enter On/Stopped",
+		"reaction On/Stopped: eject / Discard", "action OpenTray"}, steps)
+
+	steps, _ = session.Dispatch("power")
+	assert.Equal(t, []string{"reaction On: power -> Off", "exit On/Stopped", "exit On", "enter Off"}, steps)
+	steps, _ = session.Dispatch("play")
+	assert.Equal(t, []string{"drop play (no reaction)"}, steps)
+	_, err = session.Dispatch("stop")
+	assert.EqualError(t, err, "Unknown event: stop")
+
+	assert.Equal(t, []string{"power", "play", "eject", "reset", "power", "play"}, session.History())
+	assert.NoError(t, session.Back())
+	assert.NoError(t, session.Back())
+	assert.Equal(t, []string{"On", "On/Stopped"}, session.Configuration())
+	assert.Equal(t, []string{"power", "play", "eject", "reset"}, session.History())
+}
+
+type LampContext struct {
+}
+
+type SwitchEvent struct {
+	statechart.EventDefault
+}
+
+type DimEvent struct {
+	statechart.EventDefault
+}
+
+type LampOff struct {
+	statechart.StateDefault[LampContext]
+}
+
+func (s *LampOff) Setup(proxy statechart.StateSetupProxy[LampContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[SwitchEvent, LampOn](proxy, nil)
+	statechart.AddDefer[DimEvent](proxy)
+	statechart.AddInterfaceReaction(proxy, func(e fmt.Stringer) statechart.ReactionResult { return proxy.Discard() })
+	statechart.AddAnyEventReaction(proxy, func(e statechart.Event) statechart.ReactionResult { return proxy.Discard() })
+	return nil, nil
+}
+
+type LampOn struct {
+	statechart.StateDefault[LampContext]
+}
+
+func (s *LampOn) Setup(proxy statechart.StateSetupProxy[LampContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[SwitchEvent, LampOff](proxy, func(e *SwitchEvent) {})
+	statechart.AddInStateReaction(proxy, func(e *DimEvent) {})
+	return nil, nil
+}
+
+func makeLamp() (Machine, error) {
+	registry := statechart.MakeEventRegistry()
+	statechart.RegisterEvent[SwitchEvent](&registry, "switch")
+	statechart.RegisterEvent[DimEvent](&registry, "dim")
+	sm := statechart.MakeStateMachine(&LampContext{})
+	sm.SetEventRegistry(&registry)
+	offId := sm.AddState(&LampOff{})
+	sm.AddState(&LampOn{})
+	sm.Initialize(offId)
+	return FromStateMachine(&sm, &registry), nil
+}
+
+func TestStateMachineSession(t *testing.T) {
+	Register("lamp", makeLamp)
+	assert.Contains(t, Registered(), "lamp")
+	factory, err := Lookup("lamp")
+	assert.NoError(t, err)
+	session, err := NewSession(factory)
+	assert.NoError(t, err)
+
+	input := "events\nswitch\nflash\nback\nhistory\nquit\nswitch\n"
+	output := bytes.Buffer{}
+	assert.NoError(t, session.Run(strings.NewReader(input), &output))
+	assert.Equal(t, "state: LampOff\n"+
+		"> events: switch\n"+
+		">   reaction LampOff: switch -> LampOn\n"+
+		"  exit LampOff\n"+
+		"  enter LampOn\n"+
+		"state: LampOn\n"+
+		"> error: Unknown event: flash\n"+
+		"> state: LampOff\n"+
+		"> history: \n"+
+		"> ", output.String())
+
+	// the any event, interface and deferred reactions are not acceptable
+	session, err = NewSession(factory)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"switch"}, session.AcceptedEvents())
+	session.Dispatch("switch")
+	assert.Equal(t, []string{"switch", "dim"}, session.AcceptedEvents())
+
+	_, err = Lookup("radio")
+	assert.EqualError(t, err, "Unknown machine: radio")
+}
+
+func TestStateMachineActions(t *testing.T) {
+	machine, err := makeLamp()
+	assert.NoError(t, err)
+	model, err := FromModel(machine.Model())
+	assert.NoError(t, err)
+	// both backends report the transition and in-state actions
+	for _, m := range []Machine{machine, model} {
+		steps, err := m.Dispatch("switch")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"reaction LampOff: switch -> LampOn", "exit LampOff", "enter LampOn"}, steps)
+		steps, err = m.Dispatch("dim")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"reaction LampOn: dim / Discard", "action WithAction"}, steps)
+		steps, err = m.Dispatch("switch")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"reaction LampOn: switch -> LampOff", "exit LampOn", "action WithAction", "enter LampOff"}, steps)
+	}
+}
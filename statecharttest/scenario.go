@@ -0,0 +1,331 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+// Package statecharttest provides a scenario DSL to test state machines:
+//
+//	scenario := statecharttest.Given(t, sm)
+//	statecharttest.InState[Locked](scenario)
+//	scenario.When(&CoinEvent{})
+//	statecharttest.ExpectTransition[Locked, Unlocked](scenario)
+//	statecharttest.ExpectEntry[Unlocked](scenario)
+//
+// The generic functions find the states by their type and the events by their type, the
+// methods of Scenario are their low-level form taking a StateId or a sample event.
+//
+// The expectations are checked against the trace of the last event, recorded by an observer,
+// and a failed expectation reports the actual trace.
+//
+// A Walker explores a state machine with random sequences of events, see NewWalker.
+package statecharttest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	statechart "github.com/hhassoubi/go-statechart"
+)
+
+type stepKind int16
+
+const (
+	stepEntered stepKind = iota
+	stepExited
+	stepTransition
+	stepDropped
+	stepActionFailed
+	stepInvariantViolated
+)
+
+// A step of the trace of an event
+type step struct {
+	kind   stepKind
+	state  statechart.StateId
+	to     statechart.StateId
+	event  statechart.Event
+	reason statechart.DropReason
+	err    error
+}
+
+// Records the trace of the events
+type tracer struct {
+	statechart.ObserverDefault
+	steps []step
+}
+
+func (t *tracer) OnStateEntered(state statechart.StateId) {
+	t.steps = append(t.steps, step{kind: stepEntered, state: state})
+}
+
+func (t *tracer) OnStateExited(state statechart.StateId) {
+	t.steps = append(t.steps, step{kind: stepExited, state: state})
+}
+
+func (t *tracer) OnTransition(event statechart.Event, metadata statechart.EventMetadata, from statechart.StateId, to statechart.StateId) {
+	t.steps = append(t.steps, step{kind: stepTransition, state: from, to: to, event: event})
+}
+
+func (t *tracer) OnEventDropped(event statechart.Event, metadata statechart.EventMetadata, reason statechart.DropReason) {
+	t.steps = append(t.steps, step{kind: stepDropped, event: event, reason: reason})
+}
+
+func (t *tracer) OnActionFailed(failure *statechart.ActionFailedEvent) {
+	t.steps = append(t.steps, step{kind: stepActionFailed, state: failure.State, err: failure.Err})
+}
+
+func (t *tracer) OnInvariantViolated(violation *statechart.InvariantViolation) {
+	t.steps = append(t.steps, step{kind: stepInvariantViolated, state: violation.State, err: violation.Err})
+}
+
+// A test scenario of a state machine, see Given
+type Scenario[C any] struct {
+	t       testing.TB
+	machine *statechart.StateMachine[C]
+	tracer  *tracer
+	event   statechart.Event
+}
+
+// Starts a scenario. The machine gets an observer recording the trace of the events, it must
+// only be used by one scenario.
+// `t` the test
+// `machine` the initialized state machine
+func Given[C any](t testing.TB, machine *statechart.StateMachine[C]) *Scenario[C] {
+	s := &Scenario[C]{t: t, machine: machine, tracer: &tracer{}}
+	machine.AddObserver(s.tracer)
+	return s
+}
+
+// Expects the state to be active (the active state or one of its ancestors)
+// `state` the state
+func (s *Scenario[C]) InState(state statechart.StateId) *Scenario[C] {
+	s.t.Helper()
+	if !s.machine.IsInState(state) {
+		s.fail("expected to be in state %s, the active configuration is %s", s.name(state), s.configuration())
+	}
+	return s
+}
+
+// Dispatches an event, the next expectations are checked against its trace
+// `event` the event
+func (s *Scenario[C]) When(event statechart.Event) *Scenario[C] {
+	s.tracer.steps = nil
+	s.event = event
+	s.machine.DispatchEvent(event)
+	return s
+}
+
+// Expects a transition of the last event (or of an event it posted) from a state to another one
+// `from` the active state before the transition
+// `to` the active state after the transition
+func (s *Scenario[C]) ExpectTransition(from statechart.StateId, to statechart.StateId) *Scenario[C] {
+	s.t.Helper()
+	for _, step := range s.tracer.steps {
+		if step.kind == stepTransition && step.state == from && step.to == to {
+			return s
+		}
+	}
+	s.fail("expected the transition %s -> %s", s.name(from), s.name(to))
+	return s
+}
+
+// Expects the last event to make no transition
+func (s *Scenario[C]) ExpectNoTransition() *Scenario[C] {
+	s.t.Helper()
+	for _, step := range s.tracer.steps {
+		if step.kind == stepTransition {
+			s.fail("expected no transition")
+			return s
+		}
+	}
+	return s
+}
+
+// Expects the last event to enter the states, in this order
+// `states` the entered states
+func (s *Scenario[C]) ExpectEntry(states ...statechart.StateId) *Scenario[C] {
+	s.t.Helper()
+	if !s.hasSequence(stepEntered, states) {
+		s.fail("expected the entry of %s", s.names(states))
+	}
+	return s
+}
+
+// Expects the last event to exit the states, in this order
+// `states` the exited states
+func (s *Scenario[C]) ExpectExit(states ...statechart.StateId) *Scenario[C] {
+	s.t.Helper()
+	if !s.hasSequence(stepExited, states) {
+		s.fail("expected the exit of %s", s.names(states))
+	}
+	return s
+}
+
+// Expects an event of the same type as `event` to be deferred
+// `event` a sample of the event type, e.g. &MyEvent{}
+func (s *Scenario[C]) ExpectDeferred(event statechart.Event) *Scenario[C] {
+	s.t.Helper()
+	return s.expectDeferred(reflect.TypeOf(event))
+}
+
+// Expects the last event (or an event it posted or replayed) of the same type as `event` to be
+// dropped
+// `event` a sample of the event type, e.g. &MyEvent{}
+// `reason` why the event is dropped
+func (s *Scenario[C]) ExpectDropped(event statechart.Event, reason statechart.DropReason) *Scenario[C] {
+	s.t.Helper()
+	return s.expectDropped(reflect.TypeOf(event), reason)
+}
+
+func (s *Scenario[C]) expectDeferred(eventType reflect.Type) *Scenario[C] {
+	s.t.Helper()
+	deferred := s.machine.DeferredEvents()
+	for _, e := range deferred {
+		if reflect.TypeOf(e) == eventType {
+			return s
+		}
+	}
+	s.fail("expected the event %v to be deferred, the deferred events are %v", eventType, eventTypes(deferred))
+	return s
+}
+
+func (s *Scenario[C]) expectDropped(eventType reflect.Type, reason statechart.DropReason) *Scenario[C] {
+	s.t.Helper()
+	for _, step := range s.tracer.steps {
+		if step.kind == stepDropped && reflect.TypeOf(step.event) == eventType && step.reason == reason {
+			return s
+		}
+	}
+	s.fail("expected the event %v to be dropped (%v)", eventType, reason)
+	return s
+}
+
+// Expects the state `S` to be active (the active state or one of its ancestors)
+// `S` the user state
+// `scenario` the scenario
+func InState[S any, C any, PS statechart.StateCst[S, C]](scenario *Scenario[C]) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.InState(statechart.FindState[S, C, PS](scenario.machine))
+}
+
+// Expects a transition of the last event (or of an event it posted) from the state `From` to
+// the state `To`
+// `From` the active user state before the transition
+// `To` the active user state after the transition
+// `scenario` the scenario
+func ExpectTransition[From any, To any, C any, PF statechart.StateCst[From, C], PT statechart.StateCst[To, C]](scenario *Scenario[C]) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.ExpectTransition(statechart.FindState[From, C, PF](scenario.machine), statechart.FindState[To, C, PT](scenario.machine))
+}
+
+// Expects the last event to enter the state `S`
+// `S` the user state
+// `scenario` the scenario
+func ExpectEntry[S any, C any, PS statechart.StateCst[S, C]](scenario *Scenario[C]) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.ExpectEntry(statechart.FindState[S, C, PS](scenario.machine))
+}
+
+// Expects the last event to exit the state `S`
+// `S` the user state
+// `scenario` the scenario
+func ExpectExit[S any, C any, PS statechart.StateCst[S, C]](scenario *Scenario[C]) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.ExpectExit(statechart.FindState[S, C, PS](scenario.machine))
+}
+
+// Expects an event of type `E` to be deferred
+// `E` the event type, e.g. MyEvent for the events &MyEvent{}
+// `scenario` the scenario
+func ExpectDeferred[E any, C any, PE statechart.EventCst[E]](scenario *Scenario[C]) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.expectDeferred(reflect.TypeOf(PE(nil)))
+}
+
+// Expects the last event (or an event it posted or replayed) of type `E` to be dropped
+// `E` the event type, e.g. MyEvent for the events &MyEvent{}
+// `scenario` the scenario
+// `reason` why the event is dropped
+func ExpectDropped[E any, C any, PE statechart.EventCst[E]](scenario *Scenario[C], reason statechart.DropReason) *Scenario[C] {
+	scenario.t.Helper()
+	return scenario.expectDropped(reflect.TypeOf(PE(nil)), reason)
+}
+
+// Returns true if the states are a subsequence of the steps of a kind
+func (s *Scenario[C]) hasSequence(kind stepKind, states []statechart.StateId) bool {
+	i := 0
+	for _, step := range s.tracer.steps {
+		if i < len(states) && step.kind == kind && step.state == states[i] {
+			i++
+		}
+	}
+	return i == len(states)
+}
+
+// Reports a failed expectation with the actual trace
+func (s *Scenario[C]) fail(format string, args ...any) {
+	s.t.Helper()
+	s.t.Errorf("%s\n%s", fmt.Sprintf(format, args...), s.trace())
+}
+
+// Returns the readable trace of the last event
+func (s *Scenario[C]) trace() string {
+	builder := strings.Builder{}
+	if s.event == nil {
+		builder.WriteString("no event dispatched")
+		return builder.String()
+	}
+	fmt.Fprintf(&builder, "actual trace of %v:", reflect.TypeOf(s.event))
+	if len(s.tracer.steps) == 0 {
+		builder.WriteString(" (empty)")
+	}
+	for _, step := range s.tracer.steps {
+		builder.WriteString("\n  ")
+		switch step.kind {
+		case stepEntered:
+			builder.WriteString("enter " + s.name(step.state))
+		case stepExited:
+			builder.WriteString("exit " + s.name(step.state))
+		case stepTransition:
+			fmt.Fprintf(&builder, "transition %s -> %s (%v)", s.name(step.state), s.name(step.to), reflect.TypeOf(step.event))
+		case stepDropped:
+			fmt.Fprintf(&builder, "drop %v (%v)", reflect.TypeOf(step.event), step.reason)
+		case stepActionFailed:
+			fmt.Fprintf(&builder, "action of %s failed: %v", s.name(step.state), step.err)
+		case stepInvariantViolated:
+			fmt.Fprintf(&builder, "invariant of %s violated: %v", s.name(step.state), step.err)
+		}
+	}
+	return builder.String()
+}
+
+func (s *Scenario[C]) name(state statechart.StateId) string {
+	if state == statechart.INVALID_STATE_ID {
+		return "<none>"
+	}
+	return s.machine.StatePath(state)
+}
+
+func (s *Scenario[C]) names(states []statechart.StateId) string {
+	names := make([]string, len(states))
+	for i, state := range states {
+		names[i] = s.name(state)
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+func (s *Scenario[C]) configuration() string {
+	configuration := s.machine.Configuration()
+	if len(configuration) == 0 {
+		return "empty"
+	}
+	return s.machine.StatePath(configuration[len(configuration)-1].Id)
+}
+
+func eventTypes(events []statechart.Event) []reflect.Type {
+	types := make([]reflect.Type, len(events))
+	for i, e := range events {
+		types[i] = reflect.TypeOf(e)
+	}
+	return types
+}
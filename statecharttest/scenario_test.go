@@ -0,0 +1,162 @@
+package statecharttest
+
+import (
+	"fmt"
+	"testing"
+
+	statechart "github.com/hhassoubi/go-statechart"
+	"github.com/stretchr/testify/assert"
+)
+
+type TurnstileContext struct {
+}
+
+type CoinEvent struct {
+	statechart.EventDefault
+}
+
+type PushEvent struct {
+	statechart.EventDefault
+}
+
+type ServiceEvent struct {
+	statechart.EventDefault
+}
+
+type Locked struct {
+	statechart.StateDefault[TurnstileContext]
+}
+
+func (s *Locked) Setup(proxy statechart.StateSetupProxy[TurnstileContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[CoinEvent, Unlocked](proxy, nil)
+	statechart.AddSimpleStateTransition[ServiceEvent, Maintenance](proxy, nil)
+	return nil, nil
+}
+
+type Unlocked struct {
+	statechart.StateDefault[TurnstileContext]
+}
+
+func (s *Unlocked) Setup(proxy statechart.StateSetupProxy[TurnstileContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[PushEvent, Locked](proxy, nil)
+	return nil, nil
+}
+
+// Maintenance keeps the coins until the turnstile is serviced
+type Maintenance struct {
+	statechart.StateDefault[TurnstileContext]
+}
+
+func (s *Maintenance) Setup(proxy statechart.StateSetupProxy[TurnstileContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddDefer[CoinEvent](proxy)
+	statechart.AddSimpleStateTransition[ServiceEvent, Locked](proxy, nil)
+	return nil, nil
+}
+
+func makeTurnstile() *statechart.StateMachine[TurnstileContext] {
+	sm := statechart.MakeStateMachine(&TurnstileContext{}, statechart.WithMaxDeferredEvents(1, statechart.DROP_NEWEST))
+	lockedId := sm.AddState(&Locked{})
+	sm.AddState(&Unlocked{})
+	sm.AddState(&Maintenance{})
+	sm.Initialize(lockedId)
+	return &sm
+}
+
+func TestScenario(t *testing.T) {
+	scenario := Given(t, makeTurnstile())
+	InState[Locked](scenario)
+
+	scenario.When(&CoinEvent{})
+	ExpectTransition[Locked, Unlocked](scenario)
+	ExpectExit[Locked](scenario)
+	ExpectEntry[Unlocked](scenario)
+	InState[Unlocked](scenario)
+
+	scenario.When(&CoinEvent{}).ExpectNoTransition()
+
+	scenario.When(&PushEvent{})
+	ExpectTransition[Unlocked, Locked](scenario)
+
+	scenario.When(&ServiceEvent{})
+	ExpectTransition[Locked, Maintenance](scenario)
+
+	scenario.When(&CoinEvent{}).ExpectNoTransition()
+	ExpectDeferred[CoinEvent](scenario)
+
+	scenario.When(&CoinEvent{})
+	ExpectDropped[CoinEvent](scenario, statechart.DROP_DEFERRED_OVERFLOW)
+
+	// the deferred coin is replayed in Locked
+	scenario.When(&ServiceEvent{})
+	ExpectTransition[Maintenance, Locked](scenario)
+	ExpectTransition[Locked, Unlocked](scenario)
+	ExpectEntry[Locked](scenario)
+	ExpectEntry[Unlocked](scenario)
+}
+
+func TestScenarioStateIds(t *testing.T) {
+	sm := makeTurnstile()
+	locked := statechart.FindState[Locked](sm)
+	unlocked := statechart.FindState[Unlocked](sm)
+	maintenance := statechart.FindState[Maintenance](sm)
+
+	Given(t, sm).InState(locked).
+		When(&CoinEvent{}).ExpectTransition(locked, unlocked).ExpectExit(locked).ExpectEntry(unlocked).InState(unlocked).
+		When(&PushEvent{}).ExpectTransition(unlocked, locked).
+		When(&ServiceEvent{}).ExpectTransition(locked, maintenance).
+		When(&CoinEvent{}).ExpectDeferred(&CoinEvent{}).
+		When(&CoinEvent{}).ExpectDropped(&CoinEvent{}, statechart.DROP_DEFERRED_OVERFLOW).
+		When(&ServiceEvent{}).ExpectEntry(locked, unlocked)
+}
+
+// Records the failures of a scenario
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {
+}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestScenarioFailures(t *testing.T) {
+	sm := makeTurnstile()
+	locked := statechart.FindState[Locked](sm)
+	unlocked := statechart.FindState[Unlocked](sm)
+	maintenance := statechart.FindState[Maintenance](sm)
+	recorder := &recordingT{}
+
+	Given(recorder, sm).InState(unlocked)
+	assert.Equal(t, []string{"expected to be in state Unlocked, the active configuration is Locked\nno event dispatched"}, recorder.failures)
+
+	recorder.failures = nil
+	Given(recorder, makeTurnstile()).
+		When(&CoinEvent{}).ExpectTransition(locked, maintenance).ExpectEntry(maintenance).ExpectDeferred(&CoinEvent{}).
+		ExpectNoTransition().ExpectDropped(&CoinEvent{}, statechart.DROP_DEFERRED_OVERFLOW)
+	trace := "actual trace of *statecharttest.CoinEvent:\n  exit Locked\n  enter Unlocked\n" +
+		"  transition Locked -> Unlocked (*statecharttest.CoinEvent)"
+	assert.Equal(t, []string{
+		"expected the transition Locked -> Maintenance\n" + trace,
+		"expected the entry of [Maintenance]\n" + trace,
+		"expected the event *statecharttest.CoinEvent to be deferred, the deferred events are []\n" + trace,
+		"expected no transition\n" + trace,
+		"expected the event *statecharttest.CoinEvent to be dropped (DeferredOverflow)\n" + trace,
+	}, recorder.failures)
+
+	recorder.failures = nil
+	scenario := Given(recorder, makeTurnstile())
+	InState[Unlocked](scenario)
+	scenario.When(&CoinEvent{})
+	ExpectTransition[Locked, Maintenance](scenario)
+	ExpectDeferred[CoinEvent](scenario)
+	ExpectDropped[CoinEvent](scenario, statechart.DROP_DEFERRED_OVERFLOW)
+	assert.Equal(t, []string{
+		"expected to be in state Unlocked, the active configuration is Locked\nno event dispatched",
+		"expected the transition Locked -> Maintenance\n" + trace,
+		"expected the event *statecharttest.CoinEvent to be deferred, the deferred events are []\n" + trace,
+		"expected the event *statecharttest.CoinEvent to be dropped (DeferredOverflow)\n" + trace,
+	}, recorder.failures)
+}
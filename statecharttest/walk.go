@@ -0,0 +1,257 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statecharttest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	statechart "github.com/hhassoubi/go-statechart"
+)
+
+// Generates an event, e.g. with random fields
+type EventGenerator func(r *rand.Rand) statechart.Event
+
+// Returns a generator of copies of a sample event
+// `event` the sample, e.g. &MyEvent{Count: 1}
+func Sample(event statechart.Event) EventGenerator {
+	return func(r *rand.Rand) statechart.Event {
+		return cloneEvent(event)
+	}
+}
+
+// An invariant of the state machine, checked after every step of the walks
+type Invariant[C any] func(machine *statechart.StateMachine[C]) error
+
+type namedInvariant[C any] struct {
+	name  string
+	check Invariant[C]
+}
+
+// A Walker runs random walks on new state machines: at each step, it dispatches one of the
+// generated events that the active configuration has a reaction to (or any of them if there is
+// none). A walk fails when an action panics or an invariant is violated, the sequence of events
+// is then shrunk to a minimal reproduction, printed as Go test code:
+//
+//	walker := statecharttest.NewWalker(makeTurnstile, statecharttest.Sample(&CoinEvent{}), statecharttest.Sample(&PushEvent{}))
+//	walker.AddInvariant("coins", func(sm *statechart.StateMachine[TurnstileContext]) error { ... })
+//	walker.Run(t, 1, 100)
+type Walker[C any] struct {
+	factory    func() *statechart.StateMachine[C]
+	generators []EventGenerator
+	invariants []namedInvariant[C]
+	steps      int
+}
+
+// Creates a walker
+// `factory` creates a new initialized state machine for each walk
+// `generators` the generators of the events, one per event type
+func NewWalker[C any](factory func() *statechart.StateMachine[C], generators ...EventGenerator) *Walker[C] {
+	if len(generators) == 0 {
+		panic("A walker requires at least one event generator")
+	}
+	return &Walker[C]{factory: factory, generators: generators, steps: 100}
+}
+
+// Adds an invariant, checked after the initialization and after every step
+// `name` the name of the invariant, in the failures
+// `invariant` returns an error if the invariant is violated
+func (w *Walker[C]) AddInvariant(name string, invariant Invariant[C]) *Walker[C] {
+	w.invariants = append(w.invariants, namedInvariant[C]{name, invariant})
+	return w
+}
+
+// Sets the maximum number of steps of a walk (100 by default)
+// `steps` the number of steps
+func (w *Walker[C]) SetSteps(steps int) *Walker[C] {
+	if steps <= 0 {
+		panic("The number of steps must be positive")
+	}
+	w.steps = steps
+	return w
+}
+
+// Runs random walks, the first failure is reported with its minimal reproduction
+// `t` the test
+// `seed` the seed of the first walk, the walk i uses the seed `seed`+i
+// `walks` the number of walks
+func (w *Walker[C]) Run(t testing.TB, seed int64, walks int) {
+	t.Helper()
+	for i := 0; i < walks; i++ {
+		r := rand.New(rand.NewSource(seed + int64(i)))
+		events, failure := w.walk(r, w.steps, func(step int, n int) int { return r.Intn(n) })
+		if failure != nil {
+			w.report(t, fmt.Sprintf("seed %d", seed+int64(i)), events, failure)
+			return
+		}
+	}
+}
+
+// Runs the walks of a fuzz target, each byte of the fuzz input chooses the event of a step
+// (up to the maximum number of steps):
+//
+//	func FuzzTurnstile(f *testing.F) {
+//		walker.Fuzz(f)
+//	}
+//
+// `f` the fuzz test
+func (w *Walker[C]) Fuzz(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hash := fnv.New64a()
+		hash.Write(data)
+		r := rand.New(rand.NewSource(int64(hash.Sum64())))
+		steps := len(data)
+		if steps > w.steps {
+			steps = w.steps
+		}
+		events, failure := w.walk(r, steps, func(step int, n int) int { return int(data[step]) % n })
+		if failure != nil {
+			w.report(t, fmt.Sprintf("fuzz input %q", data), events, failure)
+		}
+	})
+}
+
+// A failed step of a walk
+type walkFailure struct {
+	// the number of events dispatched, the failing one included
+	step int
+	// the panic or the name of the violated invariant, a shrunk sequence must fail the same way
+	kind    string
+	message string
+}
+
+// Runs a walk on a new machine
+// `pick` chooses the index of the event of a step among `n` candidates
+// returns the events dispatched and the failure, nil if the walk succeeded
+func (w *Walker[C]) walk(r *rand.Rand, steps int, pick func(step int, n int) int) ([]statechart.Event, *walkFailure) {
+	machine := w.factory()
+	if failure := w.check(machine, 0); failure != nil {
+		return nil, failure
+	}
+	events := []statechart.Event{}
+	for step := 0; step < steps; step++ {
+		candidates := []statechart.Event{}
+		all := make([]statechart.Event, len(w.generators))
+		for i, generator := range w.generators {
+			all[i] = generator(r)
+			if machine.HasReaction(all[i]) {
+				candidates = append(candidates, all[i])
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = all
+		}
+		event := candidates[pick(step, len(candidates))]
+		events = append(events, event)
+		if failure := w.step(machine, event, step+1); failure != nil {
+			return events, failure
+		}
+	}
+	return events, nil
+}
+
+// Dispatches the events on a new machine
+func (w *Walker[C]) replay(events []statechart.Event) *walkFailure {
+	machine := w.factory()
+	if failure := w.check(machine, 0); failure != nil {
+		return failure
+	}
+	for i, event := range events {
+		if failure := w.step(machine, event, i+1); failure != nil {
+			return failure
+		}
+	}
+	return nil
+}
+
+// Dispatches an event and checks the invariants
+func (w *Walker[C]) step(machine *statechart.StateMachine[C], event statechart.Event, step int) (failure *walkFailure) {
+	defer func() {
+		if p := recover(); p != nil {
+			failure = &walkFailure{step, "panic", fmt.Sprintf("panic: %v", p)}
+		}
+	}()
+	machine.DispatchEvent(event)
+	return w.check(machine, step)
+}
+
+func (w *Walker[C]) check(machine *statechart.StateMachine[C], step int) *walkFailure {
+	for _, invariant := range w.invariants {
+		if err := invariant.check(machine); err != nil {
+			return &walkFailure{step, invariant.name, fmt.Sprintf("invariant %s violated: %v", invariant.name, err)}
+		}
+	}
+	return nil
+}
+
+// Shrinks a failing sequence: removes the chunks of events, from the halves down to the single
+// events, while the sequence still fails the same way
+func (w *Walker[C]) shrink(events []statechart.Event, failure *walkFailure) ([]statechart.Event, *walkFailure) {
+	events = events[:failure.step]
+	for size := len(events) / 2; size >= 1; size /= 2 {
+		for start := 0; start+size <= len(events); {
+			candidate := append(append([]statechart.Event{}, events[:start]...), events[start+size:]...)
+			if f := w.replay(candidate); f != nil && f.kind == failure.kind {
+				events, failure = candidate[:f.step], f
+			} else {
+				start += size
+			}
+		}
+	}
+	return events, failure
+}
+
+func (w *Walker[C]) report(t testing.TB, origin string, events []statechart.Event, failure *walkFailure) {
+	t.Helper()
+	steps := failure.step
+	events, failure = w.shrink(events, failure)
+	t.Errorf("%s after %d events (%s)\nminimal reproduction (%d events):\n%s", failure.message, steps, origin, len(events),
+		reproduction(events, failure))
+}
+
+// Returns the Go test code of a reproduction
+func reproduction(events []statechart.Event, failure *walkFailure) string {
+	builder := strings.Builder{}
+	builder.WriteString("func TestWalkReproduction(t *testing.T) {\n")
+	builder.WriteString("\tmachine := factory() // the factory of the walker\n")
+	for _, event := range events {
+		fmt.Fprintf(&builder, "\tmachine.DispatchEvent(%s)\n", goLiteral(event))
+	}
+	fmt.Fprintf(&builder, "\t// %s\n}", failure.message)
+	return builder.String()
+}
+
+// Returns the Go literal of an event, with its exported fields that are not zero
+func goLiteral(event statechart.Event) string {
+	value := reflect.ValueOf(event)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return fmt.Sprintf("%#v", event)
+	}
+	value = value.Elem()
+	fields := []string{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Anonymous || !field.IsExported() || value.Field(i).IsZero() {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s: %#v", field.Name, value.Field(i).Interface()))
+	}
+	return fmt.Sprintf("&%v{%s}", value.Type(), strings.Join(fields, ", "))
+}
+
+// Returns a shallow copy of an event (of a pointer to struct, the other events are shared)
+func cloneEvent(event statechart.Event) statechart.Event {
+	value := reflect.ValueOf(event)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return event
+	}
+	clone := reflect.New(value.Elem().Type())
+	clone.Elem().Set(value.Elem())
+	return clone.Interface().(statechart.Event)
+}
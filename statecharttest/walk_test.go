@@ -0,0 +1,110 @@
+package statecharttest
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	statechart "github.com/hhassoubi/go-statechart"
+	"github.com/stretchr/testify/assert"
+)
+
+type CounterContext struct {
+	count int
+}
+
+type StartEvent struct {
+	statechart.EventDefault
+}
+
+type TickEvent struct {
+	statechart.EventDefault
+	Step int
+}
+
+type ResetEvent struct {
+	statechart.EventDefault
+}
+
+type Idle struct {
+	statechart.StateDefault[CounterContext]
+}
+
+func (s *Idle) Setup(proxy statechart.StateSetupProxy[CounterContext]) (statechart.EntryAction, statechart.ExitAction) {
+	statechart.AddSimpleStateTransition[StartEvent, Running](proxy, nil)
+	return nil, nil
+}
+
+type Running struct {
+	statechart.StateDefault[CounterContext]
+}
+
+func (s *Running) Setup(proxy statechart.StateSetupProxy[CounterContext]) (statechart.EntryAction, statechart.ExitAction) {
+	s.Init(proxy)
+	statechart.AddCustomStateReaction(proxy, func(e *TickEvent) statechart.ReactionResult {
+		s.GetContext().count += e.Step
+		return proxy.Discard()
+	})
+	statechart.AddCustomStateReaction(proxy, func(e *ResetEvent) statechart.ReactionResult {
+		if s.GetContext().count == 0 {
+			panic("nothing to reset")
+		}
+		s.GetContext().count = 0
+		return proxy.Discard()
+	})
+	return nil, nil
+}
+
+func makeCounter() *statechart.StateMachine[CounterContext] {
+	sm := statechart.MakeStateMachine(&CounterContext{})
+	idleId := sm.AddState(&Idle{})
+	sm.AddState(&Running{})
+	sm.Initialize(idleId)
+	return &sm
+}
+
+func makeCounterWalker() *Walker[CounterContext] {
+	tick := func(r *rand.Rand) statechart.Event { return &TickEvent{Step: 1 + r.Intn(2)} }
+	return NewWalker(makeCounter, Sample(&StartEvent{}), tick)
+}
+
+func TestWalker(t *testing.T) {
+	makeCounterWalker().Run(t, 1, 20)
+}
+
+func FuzzWalker(f *testing.F) {
+	makeCounterWalker().Fuzz(f)
+}
+
+func TestWalkerInvariantViolation(t *testing.T) {
+	recorder := &recordingT{}
+	walker := makeCounterWalker().AddInvariant("bounded", func(sm *statechart.StateMachine[CounterContext]) error {
+		if sm.UserContext().count > 3 {
+			return errors.New("count above 3")
+		}
+		return nil
+	})
+	walker.Run(recorder, 1, 20)
+	assert.Len(t, recorder.failures, 1)
+	assert.Contains(t, recorder.failures[0], "invariant bounded violated: count above 3 after ")
+	assert.Contains(t, recorder.failures[0], "minimal reproduction (3 events):\n"+
+		"func TestWalkReproduction(t *testing.T) {\n"+
+		"\tmachine := factory() // the factory of the walker\n"+
+		"\tmachine.DispatchEvent(&statecharttest.StartEvent{})\n"+
+		"\tmachine.DispatchEvent(&statecharttest.TickEvent{Step: 2})\n"+
+		"\tmachine.DispatchEvent(&statecharttest.TickEvent{Step: 2})\n"+
+		"\t// invariant bounded violated: count above 3\n}")
+}
+
+func TestWalkerPanic(t *testing.T) {
+	recorder := &recordingT{}
+	walker := NewWalker(makeCounter, Sample(&StartEvent{}), Sample(&TickEvent{Step: 1}), Sample(&ResetEvent{}))
+	walker.Run(recorder, 1, 20)
+	assert.Len(t, recorder.failures, 1)
+	assert.Contains(t, recorder.failures[0], "minimal reproduction (2 events):\n"+
+		"func TestWalkReproduction(t *testing.T) {\n"+
+		"\tmachine := factory() // the factory of the walker\n"+
+		"\tmachine.DispatchEvent(&statecharttest.StartEvent{})\n"+
+		"\tmachine.DispatchEvent(&statecharttest.ResetEvent{})\n"+
+		"\t// panic: nothing to reset\n}")
+}
@@ -0,0 +1,130 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The error returned by Store.Load when there is no snapshot for the key
+var ErrSnapshotNotFound = errors.New("Snapshot not found")
+
+// The Store interface keeps the snapshots of the persistent state machines (see
+// NewPersistentStateMachine). Save must be atomic: a failed or interrupted Save leaves the
+// previous snapshot.
+type Store interface {
+	// Loads a snapshot
+	// `key` the key of the state machine
+	// returns ErrSnapshotNotFound if there is no snapshot for the key
+	Load(key string) ([]byte, error)
+	// Saves a snapshot, replacing the previous one
+	// `key` the key of the state machine
+	// `data` the snapshot
+	Save(key string, data []byte) error
+}
+
+// A Store keeping the snapshots in memory
+type MemoryStore struct {
+	snapshots map[string][]byte
+	mutex     sync.Mutex
+}
+
+// Creates an empty memory store
+func MakeMemoryStore() MemoryStore {
+	return MemoryStore{snapshots: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Load(key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.snapshots[key]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStore) Save(key string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.snapshots == nil {
+		s.snapshots = map[string][]byte{}
+	}
+	s.snapshots[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// A Store keeping each snapshot in a file of a directory, named after the key.
+// A snapshot is written to a temporary file, synced, then renamed over the previous one.
+type FileStore struct {
+	dir string
+}
+
+// Creates a file store
+// `dir` the directory of the snapshots, it must exist
+func MakeFileStore(dir string) FileStore {
+	return FileStore{dir: dir}
+}
+
+func (s FileStore) path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key || key == "." || key == ".." {
+		return "", fmt.Errorf("Invalid snapshot key: %q", key)
+	}
+	return filepath.Join(s.dir, key+".snapshot"), nil
+}
+
+func (s FileStore) Load(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSnapshotNotFound
+	}
+	return data, err
+}
+
+func (s FileStore) Save(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(s.dir, key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// removes the temporary file if it is not renamed
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Syncs a directory, so a rename in the directory survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,284 @@
+// MIT License: https://github.com/hhassoubi/go-statechart/blob/master/LICENSE
+// Copyright (c) 2023 Hicham Hassoubi
+
+package statechart
+
+import (
+	"context"
+	"reflect"
+)
+
+// A built definition ready to be mounted as a sub machine state with AddSubMachine
+type SubMachine[C any] struct {
+	mount func(d *definitionImpl[C], container State[C], parentId StateId) StateId
+}
+
+// Makes a sub machine from a built definition with the same context type as the host
+// `sub` the built definition of the sub machine
+func MakeSubMachine[C any](sub Definition[C]) SubMachine[C] {
+	return MakeAdaptedSubMachine(sub, func(context *C) *C { return context })
+}
+
+// Makes a sub machine from a built definition with a different context type
+// `sub` the built definition of the sub machine
+// `adapter` returns the sub machine context from the host context
+func MakeAdaptedSubMachine[C any, D any](sub Definition[D], adapter func(*C) *D) SubMachine[C] {
+	if !sub.IsBuilt() {
+		panic("Sub machine definition not built")
+	}
+	return SubMachine[C]{func(d *definitionImpl[C], container State[C], parentId StateId) StateId {
+		return mountDefinition(d, container, sub.impl, parentId, adapter)
+	}}
+}
+
+// Adds the states of `subDef` as sub states of `container`, see StateMachine.AddSubMachine
+func mountDefinition[C any, D any](d *definitionImpl[C], container State[C], subDef *definitionImpl[D], parentId StateId, adapter func(*C) *D) StateId {
+	var containerImpl *stateImpl[C]
+	if parentId == INVALID_STATE_ID {
+		containerImpl = d.addStateImpl(container, "", nil)
+	} else {
+		containerImpl = d.addSubStateImpl(container, d.getState(parentId), "", nil)
+	}
+	containerImpl.isSubMachine = true
+	// the parents and scopes are always added before their children
+	mounted := make(map[*stateImpl[D]]*stateImpl[C], len(subDef.states))
+	for _, subState := range subDef.states {
+		if subState.pseudo != notPseudo {
+			// the entry and exit points are added again by the Setup of the mounted states
+			continue
+		}
+		parent := containerImpl
+		if subState.parent != nil {
+			parent = mounted[subState.parent]
+		}
+		scope := containerImpl
+		if subState.scope != nil {
+			scope = mounted[subState.scope]
+		}
+		state := &adaptedState[C, D]{inner: cloneState(subState.userState), adapter: adapter}
+		newState := d.addSubStateImpl(state, parent, subState.key, scope)
+		newState.isSubMachine = subState.isSubMachine
+		mounted[subState] = newState
+	}
+	for subState, newState := range mounted {
+		if subState.subMachineEntry != nil {
+			newState.subMachineEntry = mounted[subState.subMachineEntry]
+		}
+	}
+	containerImpl.subMachineEntry = mounted[subDef.initialState]
+	return containerImpl.id
+}
+
+// Returns a shallow copy of a state (a pointer to a struct)
+func cloneState[D any](state State[D]) State[D] {
+	if wrapped, ok := state.(interface{ cloneWrapper() State[D] }); ok {
+		return wrapped.cloneWrapper()
+	}
+	value := reflect.ValueOf(state)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		panic("A sub machine state has to be a pointer to a struct")
+	}
+	clone := reflect.New(value.Elem().Type())
+	clone.Elem().Set(value.Elem())
+	return clone.Interface().(State[D])
+}
+
+// A state wrapping a user state of a state machine with the context `D` into a state machine
+// with the context `C`
+type adaptedState[C any, D any] struct {
+	inner   State[D]
+	adapter func(*C) *D
+}
+
+// Implemented by adaptedState, to get the user state
+type wrappedState interface {
+	innerState() any
+}
+
+func (s *adaptedState[C, D]) innerState() any {
+	return s.inner
+}
+
+// Clones the wrapped state when a mounted sub machine is mounted again
+func (s *adaptedState[C, D]) cloneWrapper() State[C] {
+	return &adaptedState[C, D]{inner: cloneState(s.inner), adapter: s.adapter}
+}
+
+func (s *adaptedState[C, D]) isState() bool {
+	return true
+}
+
+func (s *adaptedState[C, D]) Setup(proxy StateSetupProxy[C]) (EntryAction, ExitAction) {
+	state := proxy.(*stateImpl[C])
+	return s.inner.Setup(&adaptedProxy[C, D]{state, state, s.adapter})
+}
+
+// Returns the type of the user state, unwrapping the adapted states
+func userStateType[C any](state State[C]) reflect.Type {
+	if wrapped, ok := state.(wrappedState); ok {
+		return reflect.TypeOf(wrapped.innerState())
+	}
+	return reflect.TypeOf(state)
+}
+
+// Returns true if the user state is a FinalState, unwrapping the adapted states
+func isFinalState[C any](state State[C]) bool {
+	var userState any = state
+	if wrapped, ok := state.(wrappedState); ok {
+		userState = wrapped.innerState()
+	}
+	_, ok := userState.(interface{ isFinalState() bool })
+	return ok
+}
+
+// Returns the user state as a State[D], unwrapping the adapted states
+func unwrapState[C any, D any](state State[C]) (State[D], bool) {
+	if wrapped, ok := state.(wrappedState); ok {
+		inner, ok := wrapped.innerState().(State[D])
+		return inner, ok
+	}
+	inner, ok := any(state).(State[D])
+	return inner, ok
+}
+
+// The StateSetupProxy given to the states of a sub machine
+type adaptedProxy[C any, D any] struct {
+	state *stateImpl[C]
+	// the proxy reaching the instance, the state itself or the proxy bound to an instance
+	runtime StateProxy[C]
+	adapter func(*C) *D
+}
+
+func (p *adaptedProxy[C, D]) Bind(ctx context.Context) StateProxy[D] {
+	if sm := boundInstance(ctx, p.state.definition); sm != nil {
+		return &adaptedProxy[C, D]{p.state, sm.proxy(p.state), p.adapter}
+	}
+	return p
+}
+
+func (p *adaptedProxy[C, D]) Name() string {
+	return p.state.Name()
+}
+
+func (p *adaptedProxy[C, D]) Key() string {
+	return p.state.Key()
+}
+
+func (p *adaptedProxy[C, D]) Id() StateId {
+	return p.state.Id()
+}
+
+func (p *adaptedProxy[C, D]) GetAncestor(ancestorStateId StateId) State[D] {
+	ancestor, ok := unwrapState[C, D](p.state.GetAncestor(ancestorStateId))
+	if !ok {
+		panic("Ancestor not found")
+	}
+	return ancestor
+}
+
+func (p *adaptedProxy[C, D]) GetContext() *D {
+	context := p.runtime.GetContext()
+	if context == nil {
+		return nil
+	}
+	return p.adapter(context)
+}
+
+func (p *adaptedProxy[C, D]) FindStateId(selector func(state State[D]) bool) StateId {
+	return p.FindKeyedStateId("", selector)
+}
+
+func (p *adaptedProxy[C, D]) FindKeyedStateId(key string, selector func(state State[D]) bool) StateId {
+	return p.state.FindKeyedStateId(key, func(state State[C]) bool {
+		inner, ok := unwrapState[C, D](state)
+		return ok && selector(inner)
+	})
+}
+
+func (p *adaptedProxy[C, D]) Transit(state StateId, action BaseAction, kind ...TransitionKind) ReactionResult {
+	return p.state.Transit(state, action, kind...)
+}
+
+func (p *adaptedProxy[C, D]) Forward() ReactionResult {
+	return p.state.Forward()
+}
+
+func (p *adaptedProxy[C, D]) Discard() ReactionResult {
+	return p.state.Discard()
+}
+
+func (p *adaptedProxy[C, D]) Defer() ReactionResult {
+	return p.state.Defer()
+}
+
+func (p *adaptedProxy[C, D]) PostEvent(event Event) {
+	p.runtime.PostEvent(event)
+}
+
+func (p *adaptedProxy[C, D]) DeferredEvents() []Event {
+	return p.runtime.DeferredEvents()
+}
+
+func (p *adaptedProxy[C, D]) SetName(name string) {
+	p.state.SetName(name)
+}
+
+func (p *adaptedProxy[C, D]) AddReaction(reaction EventReaction) {
+	p.state.AddReaction(reaction)
+}
+
+func (p *adaptedProxy[C, D]) SetStartingState(state StateId) {
+	p.state.SetStartingState(state)
+}
+
+func (p *adaptedProxy[C, D]) EntryPointId(superState StateId, name string) StateId {
+	return p.state.EntryPointId(superState, name)
+}
+
+func (p *adaptedProxy[C, D]) ExitPointId(name string) StateId {
+	return p.state.ExitPointId(name)
+}
+
+func (p *adaptedProxy[C, D]) AddEntryPoint(name string) {
+	p.state.AddEntryPoint(name)
+}
+
+func (p *adaptedProxy[C, D]) AddExitPoint(name string, target StateId) {
+	p.state.AddExitPoint(name, target)
+}
+
+func (p *adaptedProxy[C, D]) SetFallibleEntryAction(action FallibleEntryAction) {
+	p.state.SetFallibleEntryAction(action)
+}
+
+func (p *adaptedProxy[C, D]) SetFallibleExitAction(action FallibleExitAction) {
+	p.state.SetFallibleExitAction(action)
+}
+
+func (p *adaptedProxy[C, D]) SetInvariant(invariant func() error) {
+	p.state.SetInvariant(invariant)
+}
+
+func (p *adaptedProxy[C, D]) Context() context.Context {
+	return p.runtime.Context()
+}
+
+func (p *adaptedProxy[C, D]) EventMetadata() EventMetadata {
+	return p.runtime.EventMetadata()
+}
+
+func (p *adaptedProxy[C, D]) IsReplaying() bool {
+	return p.runtime.IsReplaying()
+}
+
+func (p *adaptedProxy[C, D]) SetEntryActionCtx(action EntryActionCtx) {
+	p.state.SetEntryActionCtx(action)
+}
+
+func (p *adaptedProxy[C, D]) SetExitActionCtx(action ExitActionCtx) {
+	p.state.SetExitActionCtx(action)
+}
+
+func (p *adaptedProxy[C, D]) SetDoActivity(activity DoActivity) {
+	p.state.SetDoActivity(activity)
+}
@@ -0,0 +1,190 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type DialContext struct {
+	tries     int
+	maxTries  int
+	connected bool
+	log       string
+}
+
+type DialFailedEvent struct {
+	EventDefault
+}
+
+type DialOkEvent struct {
+	EventDefault
+}
+
+type LinkEvent struct {
+	EventDefault
+}
+
+// Dialing is the only working state of the "connect with retries" sub machine
+type Dialing struct {
+	StateDefault[DialContext]
+}
+
+func (s *Dialing) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCustomStateReaction(proxy, func(e *DialFailedEvent) ReactionResult {
+		ctx := s.GetContext()
+		ctx.tries++
+		if ctx.tries < ctx.maxTries {
+			return proxy.Transit(proxy.Id(), nil)
+		}
+		return TransitTo[FinalState[DialContext], DialContext](proxy, "failed")
+	})
+	AddCustomStateReaction(proxy, func(e *DialOkEvent) ReactionResult {
+		s.GetContext().connected = true
+		return TransitTo[FinalState[DialContext], DialContext](proxy, "ok")
+	})
+	return func() { s.GetContext().log += proxy.Name() + " " }, nil
+}
+
+func makeDialDefinition() Definition[DialContext] {
+	def := MakeDefinition[DialContext]()
+	dialingId := def.AddState(&Dialing{})
+	def.AddKeyedState(&FinalState[DialContext]{}, "ok")
+	def.AddKeyedState(&FinalState[DialContext]{}, "failed")
+	def.Build(dialingId)
+	return def
+}
+
+type LinkContext struct {
+	dial DialContext
+	log  string
+}
+
+type Unlinked struct {
+	StateDefault[LinkContext]
+}
+
+func (s *Unlinked) Setup(proxy StateSetupProxy[LinkContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddSimpleStateTransition[LinkEvent, Linking](proxy, nil)
+	return func() { s.GetContext().log += "Unlinked " }, nil
+}
+
+// Linking is the sub machine state
+type Linking struct {
+	StateDefault[LinkContext]
+}
+
+func (s *Linking) Setup(proxy StateSetupProxy[LinkContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	linkedId := FindStateId[Linked, LinkContext](proxy)
+	unlinkedId := FindStateId[Unlinked, LinkContext](proxy)
+	AddCustomStateReaction(proxy, func(e *CompletionEvent) ReactionResult {
+		if s.GetContext().dial.connected {
+			return proxy.Transit(linkedId, nil)
+		}
+		return proxy.Transit(unlinkedId, nil)
+	})
+	return func() { s.GetContext().dial = DialContext{maxTries: 2} }, nil
+}
+
+type Linked struct {
+	StateDefault[LinkContext]
+}
+
+func (s *Linked) Setup(proxy StateSetupProxy[LinkContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	return func() { s.GetContext().log += "Linked " }, nil
+}
+
+func makeLinkStateMachine(ctx *LinkContext) *StateMachine[LinkContext] {
+	sm := MakeStateMachine(ctx)
+	unlinkedId := sm.AddState(&Unlinked{})
+	dial := MakeAdaptedSubMachine(makeDialDefinition(), func(ctx *LinkContext) *DialContext { return &ctx.dial })
+	sm.AddSubMachine(&Linking{}, dial, INVALID_STATE_ID)
+	sm.AddState(&Linked{})
+	sm.Initialize(unlinkedId)
+	return &sm
+}
+
+func TestSubMachineWithAdapter(t *testing.T) {
+	ctx := LinkContext{}
+	sm := makeLinkStateMachine(&ctx)
+	sm.DispatchEvent(&LinkEvent{})
+	assert.Equal(t, "Linking_Dialing", sm.impl.currentState.name)
+	sm.DispatchEvent(&DialFailedEvent{})
+	sm.DispatchEvent(&DialFailedEvent{})
+	assert.Equal(t, "Unlinked", sm.impl.currentState.name)
+	assert.Equal(t, "Linking_Dialing Linking_Dialing ", ctx.dial.log)
+
+	sm.DispatchEvent(&LinkEvent{})
+	sm.DispatchEvent(&DialFailedEvent{})
+	sm.DispatchEvent(&DialOkEvent{})
+	assert.Equal(t, "Linked", sm.impl.currentState.name)
+	assert.Equal(t, "Unlinked Unlinked Linked ", ctx.log)
+	assert.Equal(t, 1, ctx.dial.tries)
+}
+
+// Primary and Backup mount the same sub machine, with the same context type
+type Primary struct {
+	StateDefault[DialContext]
+}
+
+func (s *Primary) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	AddCompletionTransition[Backup](proxy, nil)
+	return nil, nil
+}
+
+type Backup struct {
+	StateDefault[DialContext]
+}
+
+func (s *Backup) Setup(proxy StateSetupProxy[DialContext]) (EntryAction, ExitAction) {
+	s.Init(proxy)
+	AddCompletionTransition[Dialing](proxy, func(e *CompletionEvent) {
+		s.GetContext().log += "completed "
+	})
+	return func() { s.GetContext().tries = 0 }, nil
+}
+
+func makeFailoverStateMachine(ctx *DialContext) *StateMachine[DialContext] {
+	sm := MakeStateMachine(ctx)
+	dial := MakeSubMachine(makeDialDefinition())
+	primaryId := sm.AddSubMachine(&Primary{}, dial, INVALID_STATE_ID)
+	sm.AddSubMachine(&Backup{}, dial, INVALID_STATE_ID)
+	// the top Dialing is not confused with the mounted ones
+	sm.AddState(&Dialing{})
+	sm.Initialize(primaryId)
+	return &sm
+}
+
+func TestSubMachineMountedTwice(t *testing.T) {
+	ctx := DialContext{maxTries: 1}
+	sm := makeFailoverStateMachine(&ctx)
+	assert.Equal(t, "Primary_Dialing", sm.impl.currentState.name)
+	sm.DispatchEvent(&DialFailedEvent{})
+	assert.Equal(t, "Backup_Dialing", sm.impl.currentState.name)
+	sm.DispatchEvent(&DialOkEvent{})
+	assert.Equal(t, "Dialing", sm.impl.currentState.name)
+	assert.Equal(t, "Primary_Dialing Backup_Dialing completed Dialing ", ctx.log)
+}
+
+func TestSubMachinePanics(t *testing.T) {
+	assert.Panics(t, func() { MakeSubMachine(MakeDefinition[DialContext]()) })
+	sm := MakeStateMachine(&DialContext{})
+	sm.Initialize(sm.AddState(&Dialing{}))
+	assert.Panics(t, func() { sm.AddSubMachine(&Primary{}, MakeSubMachine(makeDialDefinition()), INVALID_STATE_ID) })
+}
+
+func TestSubMachineUml(t *testing.T) {
+	ctx := DialContext{maxTries: 1}
+	sm := makeFailoverStateMachine(&ctx)
+	buffer := bytes.Buffer{}
+	sm.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	assert.Contains(t, buffer.String(), "state Primary <<submachine>> {\n")
+	assert.Contains(t, buffer.String(), "  [*] -> Primary_Dialing \n")
+	assert.Contains(t, buffer.String(), "  state Primary_FinalState_ok <<end>>\n")
+	assert.Contains(t, buffer.String(), "Primary -> Backup : CompletionEvent\n")
+}
@@ -0,0 +1,91 @@
+package statechart
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type SelectEvent struct {
+	EventDefault
+}
+
+type ChosenEvent struct {
+	EventDefault
+}
+
+type Unselected struct {
+	StateDefault[KindContext]
+}
+
+func (s *Unselected) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[SelectEvent, Selecting](proxy, nil)
+	return logEntryExit(proxy)
+}
+
+// Selecting has no starting state, the sub-state is chosen later
+type Selecting struct {
+	StateDefault[KindContext]
+}
+
+func (s *Selecting) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[ChosenEvent, Selected](proxy, nil, LOCAL)
+	return logEntryExit(proxy)
+}
+
+type Selected struct {
+	StateDefault[KindContext]
+}
+
+func (s *Selected) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	return logEntryExit(proxy)
+}
+
+func makeSelectingStateMachine(ctx *KindContext, options ...Option) (*StateMachine[KindContext], StateId) {
+	sm := MakeStateMachine(ctx, options...)
+	unselectedId := sm.AddState(&Unselected{})
+	selectingId := sm.AddState(&Selecting{})
+	sm.AddSubState(&Selected{}, selectingId)
+	return &sm, unselectedId
+}
+
+func TestSuperStateLeaf(t *testing.T) {
+	ctx := KindContext{}
+	sm, unselectedId := makeSelectingStateMachine(&ctx, WithSuperStateLeaf())
+	sm.Initialize(unselectedId)
+	sm.DispatchEvent(&SelectEvent{})
+	assert.Equal(t, "+Unselected -Unselected +Selecting ", ctx.log)
+	selectingId := sm.CurrentStateId()
+	assert.Equal(t, []StateInfo{{Id: selectingId, Name: "Selecting", IsSuperState: true, IsSuperStateLeaf: true}}, sm.Configuration())
+
+	ctx.log = ""
+	sm.DispatchEvent(&ChosenEvent{})
+	assert.Equal(t, "+Selected ", ctx.log)
+	configuration := sm.Configuration()
+	assert.Len(t, configuration, 2)
+	assert.False(t, configuration[0].IsSuperStateLeaf)
+	assert.Equal(t, "Selected", configuration[1].Name)
+	assert.True(t, sm.IsInState(selectingId))
+	assert.False(t, sm.IsInState(unselectedId))
+
+	findings := sm.Analyze()
+	assert.Len(t, findings, 1)
+	assert.Equal(t, SUPER_STATE_WITHOUT_STARTING_STATE, findings[0].Kind)
+	assert.Equal(t, selectingId, findings[0].State)
+	assert.Equal(t, "SUPER_STATE_WITHOUT_STARTING_STATE: super state Selecting has no starting state, it can be the active state", findings[0].String())
+}
+
+func TestSuperStateLeafNotAllowed(t *testing.T) {
+	ctx := KindContext{}
+	sm, unselectedId := makeSelectingStateMachine(&ctx)
+	assert.Equal(t, INVALID_STATE_ID, sm.CurrentStateId())
+	assert.Nil(t, sm.Configuration())
+	sm.Initialize(unselectedId)
+	assert.Panics(t, func() { sm.DispatchEvent(&SelectEvent{}) })
+	// the transition is not started
+	assert.Equal(t, "+Unselected ", ctx.log)
+	assert.Equal(t, unselectedId, sm.CurrentStateId())
+
+	sm, _ = makeSelectingStateMachine(&ctx)
+	assert.Panics(t, func() { sm.Initialize(1) })
+}
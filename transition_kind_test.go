@@ -0,0 +1,125 @@
+package statechart
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type KindContext struct {
+	log string
+}
+
+type RestartEvent struct {
+	EventDefault
+}
+
+type LocalRestartEvent struct {
+	EventDefault
+}
+
+type PingEvent struct {
+	EventDefault
+}
+
+type SwapEvent struct {
+	EventDefault
+}
+
+type ExternalSwapEvent struct {
+	EventDefault
+}
+
+func logEntryExit(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	return func() { proxy.GetContext().log += "+" + proxy.Name() + " " },
+		func() { proxy.GetContext().log += "-" + proxy.Name() + " " }
+}
+
+type KindParent struct {
+	StateDefault[KindContext]
+}
+
+func (s *KindParent) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	SetStartingState[KindChildA](proxy)
+	AddSimpleStateTransition[RestartEvent, KindParent](proxy, nil)
+	AddSimpleStateTransition[LocalRestartEvent, KindParent](proxy, nil, LOCAL)
+	AddCustomStateReaction(proxy, func(e *SwapEvent) ReactionResult {
+		return Transit[KindChildB, KindContext](proxy, LOCAL)
+	})
+	AddSimpleStateTransition[ExternalSwapEvent, KindChildB](proxy, nil)
+	return logEntryExit(proxy)
+}
+
+type KindChildA struct {
+	StateDefault[KindContext]
+}
+
+func (s *KindChildA) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[PingEvent, KindChildA](proxy, func(e *PingEvent) {
+		proxy.GetContext().log += "ping "
+	}, LOCAL)
+	return logEntryExit(proxy)
+}
+
+type KindChildB struct {
+	StateDefault[KindContext]
+}
+
+func (s *KindChildB) Setup(proxy StateSetupProxy[KindContext]) (EntryAction, ExitAction) {
+	AddSimpleStateTransition[PingEvent, KindChildB](proxy, func(e *PingEvent) {
+		proxy.GetContext().log += "ping "
+	})
+	return logEntryExit(proxy)
+}
+
+func makeKindStateMachine(ctx *KindContext) *stateMachineImpl[KindContext] {
+	sm := &stateMachineImpl[KindContext]{userContext: ctx}
+	parentId := sm.AddState(&KindParent{})
+	sm.AddSubState(&KindChildA{}, parentId)
+	sm.AddSubState(&KindChildB{}, parentId)
+	sm.Initialize(parentId)
+	ctx.log = ""
+	return sm
+}
+
+func TestTransitionKind(t *testing.T) {
+	ctx := KindContext{}
+	sm := makeKindStateMachine(&ctx)
+	testCases := []struct {
+		event    Event
+		expected string
+		leaf     string
+	}{
+		// external self transition of a super state exits it
+		{&RestartEvent{}, "-KindChildA -KindParent +KindParent +KindChildA ", "KindChildA"},
+		// local self transition of a super state only exits its sub-states
+		{&LocalRestartEvent{}, "-KindChildA +KindChildA ", "KindChildA"},
+		// local self transition of a simple state runs the action only
+		{&PingEvent{}, "ping ", "KindChildA"},
+		// local transition to a sub-state
+		{&SwapEvent{}, "-KindChildA +KindChildB ", "KindChildB"},
+		// external transition to a sub-state exits and re-enters the source
+		{&ExternalSwapEvent{}, "-KindChildB -KindParent +KindParent +KindChildB ", "KindChildB"},
+		// external self transition of a simple state
+		{&PingEvent{}, "-KindChildB ping +KindChildB ", "KindChildB"},
+		{&LocalRestartEvent{}, "-KindChildB +KindChildA ", "KindChildA"},
+		{&ExternalSwapEvent{}, "-KindChildA -KindParent +KindParent +KindChildB ", "KindChildB"},
+	}
+	for i, tc := range testCases {
+		ctx.log = ""
+		sm.DispatchEvent(tc.event)
+		assert.Equal(t, tc.expected, ctx.log, "case %d", i)
+		assert.Equal(t, tc.leaf, sm.currentState.name, "case %d", i)
+	}
+}
+
+func TestTransitionKindUml(t *testing.T) {
+	ctx := KindContext{}
+	sm := makeKindStateMachine(&ctx)
+	buffer := bytes.Buffer{}
+	sm.GenerateUml(&buffer, PLANT_UML, HIERARCHY_WITH_TRANSITION)
+	assert.Contains(t, buffer.String(), "KindParent -> KindParent : RestartEvent\n")
+	assert.Contains(t, buffer.String(), "KindParent -[dashed]-> KindParent : LocalRestartEvent\n")
+	assert.Contains(t, buffer.String(), "KindChildA -[dashed]-> KindChildA : PingEvent / WithAction\n")
+}